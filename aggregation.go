@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"modbus_test/decode"
+)
+
+// --- Cấu hình tổng hợp theo chu kỳ (min/max/avg/last) ---
+const (
+	enableAggregation = true
+	logAggCSVFile     = "modbus_agg_%s_%s.csv" // Tên cửa sổ (1m, 15m...), timestamp
+)
+
+// Các cửa sổ tổng hợp, căn theo mốc giờ thực (ví dụ 15m: 00, 15, 30, 45).
+// Độ dài cửa sổ phải chia hết cho 24 giờ.
+var aggregationWindows = []time.Duration{1 * time.Minute, 15 * time.Minute}
+
+// registerStats lưu thống kê của một thanh ghi trong cửa sổ hiện tại (thuật toán Welford).
+type registerStats struct {
+	count    int
+	bad      int
+	min, max float64
+	mean, m2 float64
+	last     float64
+}
+
+func (s *registerStats) add(v float64) {
+	s.count++
+	if s.count == 1 || v < s.min {
+		s.min = v
+	}
+	if s.count == 1 || v > s.max {
+		s.max = v
+	}
+	delta := v - s.mean
+	s.mean += delta / float64(s.count)
+	s.m2 += delta * (v - s.mean)
+	s.last = v
+}
+
+// stddev trả về độ lệch chuẩn mẫu (n-1).
+func (s *registerStats) stddev() float64 {
+	if s.count < 2 {
+		return 0
+	}
+	return math.Sqrt(s.m2 / float64(s.count-1))
+}
+
+// windowAggregator tổng hợp dữ liệu cho một độ dài cửa sổ.
+type windowAggregator struct {
+	window    time.Duration
+	label     string
+	start     time.Time
+	end       time.Time
+	stats     map[string]*registerStats
+	csvFile   *os.File
+	csvWriter *csv.Writer
+}
+
+var aggregators []*windowAggregator
+
+// alignWindow trả về mốc bắt đầu cửa sổ chứa t, căn theo nửa đêm giờ địa phương.
+func alignWindow(t time.Time, window time.Duration) time.Time {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	return midnight.Add(t.Sub(midnight) / window * window)
+}
+
+// windowLabel tạo tên ngắn cho cửa sổ: 1m, 15m, 1h, 1d...
+func windowLabel(window time.Duration) string {
+	switch {
+	case window%(24*time.Hour) == 0:
+		return fmt.Sprintf("%dd", window/(24*time.Hour))
+	case window%time.Hour == 0:
+		return fmt.Sprintf("%dh", window/time.Hour)
+	case window%time.Minute == 0:
+		return fmt.Sprintf("%dm", window/time.Minute)
+	default:
+		return fmt.Sprintf("%ds", window/time.Second)
+	}
+}
+
+// --- Hàm khởi tạo các bộ tổng hợp và file CSV tổng hợp ---
+func setupAggregation() {
+	if !enableAggregation {
+		return
+	}
+	ts := time.Now().Format("20060102_150405")
+	for _, window := range aggregationWindows {
+		if window <= 0 || (24*time.Hour)%window != 0 {
+			log.Printf("Bỏ qua cửa sổ tổng hợp %v: độ dài phải chia hết cho 24 giờ", window)
+			continue
+		}
+		agg := &windowAggregator{window: window, label: windowLabel(window)}
+		path := filepath.Join(logDir, fmt.Sprintf(logAggCSVFile, agg.label, ts))
+		f, err := os.Create(path)
+		if err != nil {
+			log.Printf("Lỗi tạo file CSV tổng hợp '%s': %v", path, err)
+		} else {
+			agg.csvFile = f
+			agg.csvWriter = csv.NewWriter(f)
+			agg.csvWriter.Write([]string{"WindowStart", "WindowEnd", "Register", "Count", "BadCount", "Min", "Max", "Mean", "Last", "StdDev"})
+			agg.csvWriter.Flush()
+			log.Printf("Log CSV tổng hợp %s sẽ được ghi tại: %s", agg.label, path)
+		}
+		aggregators = append(aggregators, agg)
+	}
+}
+
+// aggregateCycle đưa kết quả một chu kỳ đọc vào các bộ tổng hợp. Khi chu kỳ thuộc cửa sổ mới,
+// cửa sổ cũ được ghi ra trước.
+func aggregateCycle(ts time.Time, data map[string]interface{}) {
+	for _, agg := range aggregators {
+		if agg.stats != nil && !ts.Before(agg.end) {
+			agg.flush()
+		}
+		if agg.stats == nil {
+			agg.start = alignWindow(ts, agg.window)
+			agg.end = agg.start.Add(agg.window)
+			agg.stats = make(map[string]*registerStats)
+		}
+		for _, name := range outputRegisterNames() {
+			value, ok := data[name]
+			if !ok {
+				continue
+			}
+			v, quality := decode.Classify(value)
+			if _, isString := value.(string); isString && quality == decode.QualityNA && !decode.IsNA(value) {
+				continue // Chuỗi thông thường (Meter_Model, DATETIME...) không tổng hợp
+			}
+			st := agg.stats[name]
+			if st == nil {
+				st = &registerStats{}
+				agg.stats[name] = st
+			}
+			if quality == decode.QualityGood {
+				st.add(v)
+			} else {
+				st.bad++
+			}
+		}
+	}
+}
+
+// flush ghi thống kê của cửa sổ hiện tại ra CSV và log JSON, sau đó bắt đầu cửa sổ mới.
+func (agg *windowAggregator) flush() {
+	if agg.stats == nil {
+		return
+	}
+	logFields := logrus.Fields{
+		"window": agg.label, "window_start": agg.start.Format(time.RFC3339), "window_end": agg.end.Format(time.RFC3339),
+	}
+	formatStat := func(st *registerStats, v float64) string {
+		if st.count == 0 {
+			return ""
+		}
+		return strconv.FormatFloat(math.Round(v*10000)/10000, 'f', -1, 64)
+	}
+	for _, name := range outputRegisterNames() {
+		st, ok := agg.stats[name]
+		if !ok {
+			continue
+		}
+		if st.count > 0 {
+			logFields[name] = map[string]interface{}{
+				"count": st.count, "bad": st.bad, "min": decode.Sanitize(st.min), "max": decode.Sanitize(st.max),
+				"mean": decode.Sanitize(st.mean), "last": decode.Sanitize(st.last), "stddev": decode.Sanitize(st.stddev()),
+			}
+		} else {
+			logFields[name] = map[string]interface{}{"count": 0, "bad": st.bad}
+		}
+		if agg.csvWriter != nil {
+			row := []string{
+				agg.start.Format("2006-01-02 15:04:05"), agg.end.Format("2006-01-02 15:04:05"), name,
+				strconv.Itoa(st.count), strconv.Itoa(st.bad),
+				formatStat(st, st.min), formatStat(st, st.max), formatStat(st, st.mean), formatStat(st, st.last), formatStat(st, st.stddev()),
+			}
+			if err := agg.csvWriter.Write(row); err != nil {
+				logrus.WithError(err).Error("Lỗi ghi dòng CSV tổng hợp")
+			}
+		}
+	}
+	if agg.csvWriter != nil {
+		agg.csvWriter.Flush()
+	}
+	logrus.WithFields(logFields).Info("Modbus Data Aggregate")
+	agg.stats = nil
+}
+
+// --- Hàm ghi cửa sổ dở dang và đóng các file tổng hợp ---
+func closeAggregation() {
+	for _, agg := range aggregators {
+		agg.flush()
+		if agg.csvFile != nil {
+			agg.csvFile.Close()
+		}
+	}
+	if len(aggregators) > 0 {
+		log.Println("Đã đóng các file log CSV tổng hợp.")
+	}
+	aggregators = nil
+}
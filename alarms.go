@@ -0,0 +1,280 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"modbus_test/decode"
+	"modbus_test/sinks"
+)
+
+// --- Định nghĩa cảnh báo (alarm) theo thanh ghi ---
+type AlarmConfig struct {
+	Register string
+	Kind     string        // "HIGH", "LOW", "HIGH_HIGH", "LOW_LOW", "RATE", "STALE", "NA", "COMM_ERROR"
+	Limit    float64       // Ngưỡng; RATE: đơn vị/giây; STALE: số giây giá trị không đổi
+	Deadband float64       // Vùng trễ (hysteresis) khi xóa cảnh báo, cùng đơn vị với Limit
+	OnDelay  time.Duration // Điều kiện phải kéo dài bao lâu mới phát cảnh báo
+	OffDelay time.Duration // Điều kiện phải hết bao lâu mới xóa cảnh báo
+	Severity string        // "INFO", "WARNING", "CRITICAL"
+}
+
+// !!! Điều chỉnh ngưỡng theo hệ thống điện thực tế !!!
+var alarmConfigs = []AlarmConfig{
+	{Register: "Voltage_LNAvg", Kind: "HIGH", Limit: 253, Deadband: 2, OnDelay: 5 * time.Second, OffDelay: 5 * time.Second, Severity: "WARNING"},
+	{Register: "Voltage_LNAvg", Kind: "HIGH_HIGH", Limit: 264, Deadband: 2, OnDelay: 2 * time.Second, OffDelay: 5 * time.Second, Severity: "CRITICAL"},
+	{Register: "Voltage_LNAvg", Kind: "LOW", Limit: 207, Deadband: 2, OnDelay: 5 * time.Second, OffDelay: 5 * time.Second, Severity: "WARNING"},
+	{Register: "Voltage_LNAvg", Kind: "LOW_LOW", Limit: 196, Deadband: 2, OnDelay: 2 * time.Second, OffDelay: 5 * time.Second, Severity: "CRITICAL"},
+	{Register: "Frequency", Kind: "HIGH", Limit: 50.5, Deadband: 0.1, OnDelay: 5 * time.Second, OffDelay: 5 * time.Second, Severity: "WARNING"},
+	{Register: "Frequency", Kind: "LOW", Limit: 49.5, Deadband: 0.1, OnDelay: 5 * time.Second, OffDelay: 5 * time.Second, Severity: "WARNING"},
+	{Register: "Frequency", Kind: "STALE", Limit: 60, Severity: "WARNING"},
+	{Register: "Current_Unbalance_Worst", Kind: "HIGH", Limit: 20, Deadband: 2, OnDelay: 30 * time.Second, OffDelay: 30 * time.Second, Severity: "WARNING"},
+	{Register: "ActivePower_Total", Kind: "RATE", Limit: 100, Deadband: 10, Severity: "INFO"},
+	{Register: "Voltage_LNAvg", Kind: "NA", OnDelay: 10 * time.Second, Severity: "WARNING"},
+	{Register: "Voltage_LNAvg", Kind: "COMM_ERROR", OnDelay: 10 * time.Second, OffDelay: 5 * time.Second, Severity: "CRITICAL"},
+}
+
+// AlarmStatus là trạng thái hiện tại của một cảnh báo.
+type AlarmStatus struct {
+	ID           string    `json:"id"`
+	Register     string    `json:"register"`
+	Kind         string    `json:"kind"`
+	Severity     string    `json:"severity"`
+	Active       bool      `json:"active"`
+	Acknowledged bool      `json:"acknowledged"`
+	RaisedAt     time.Time `json:"raised_at,omitempty"`
+	ClearedAt    time.Time `json:"cleared_at,omitempty"`
+}
+
+type alarmState struct {
+	cfg           AlarmConfig
+	status        AlarmStatus
+	pendingSince  time.Time // Điều kiện phát cảnh báo bắt đầu đúng (chờ OnDelay)
+	clearingSince time.Time // Điều kiện xóa cảnh báo bắt đầu đúng (chờ OffDelay)
+	lastValue     float64
+	lastTime      time.Time
+	lastChange    time.Time
+	lastKey       string // Giá trị lần trước dạng chuỗi (cho STALE)
+	hasLast       bool
+}
+
+var (
+	alarmMu            sync.Mutex
+	alarmStates        []*alarmState
+	pendingAlarmEvents []sinks.AlarmEvent // Sự kiện ACK chờ gửi tới các sink cùng kết quả chu kỳ đọc kế tiếp
+)
+
+// Lỗi của acknowledgeAlarm.
+var (
+	errAlarmNotFound     = errors.New("không tìm thấy cảnh báo")
+	errAlarmAcknowledged = errors.New("cảnh báo đã được xác nhận")
+)
+
+func alarmID(cfg AlarmConfig) string {
+	return cfg.Register + ":" + cfg.Kind
+}
+
+// --- Hàm kiểm tra cấu hình và khởi tạo trạng thái cảnh báo ---
+func setupAlarms() {
+	alarmMu.Lock()
+	defer alarmMu.Unlock()
+	known := make(map[string]bool)
+	for _, name := range outputRegisterNames() {
+		known[name] = true
+	}
+	alarmStates, pendingAlarmEvents = nil, nil
+	seen := make(map[string]bool)
+	for _, cfg := range alarmConfigs {
+		id := alarmID(cfg)
+		var err error
+		switch {
+		case !known[cfg.Register]:
+			err = fmt.Errorf("thanh ghi '%s' không tồn tại", cfg.Register)
+		case seen[id]:
+			err = fmt.Errorf("cảnh báo '%s' bị khai báo trùng", id)
+		}
+		switch cfg.Kind {
+		case "HIGH", "LOW", "HIGH_HIGH", "LOW_LOW", "RATE", "STALE", "NA", "COMM_ERROR":
+		default:
+			err = fmt.Errorf("loại cảnh báo '%s' không hỗ trợ", cfg.Kind)
+		}
+		if err != nil {
+			logrus.WithError(err).WithField("alarm_id", id).Error("Cấu hình cảnh báo không hợp lệ, bỏ qua")
+			continue
+		}
+		seen[id] = true
+		alarmStates = append(alarmStates, &alarmState{
+			cfg:    cfg,
+			status: AlarmStatus{ID: id, Register: cfg.Register, Kind: cfg.Kind, Severity: cfg.Severity, Acknowledged: true},
+		})
+	}
+}
+
+// evaluateAlarms đánh giá toàn bộ cảnh báo với dữ liệu của một chu kỳ, ghi log và trả về
+// các sự kiện phát/xóa cảnh báo phát sinh, kèm các sự kiện xác nhận (ACK) từ sau chu kỳ trước.
+func evaluateAlarms(ts time.Time, data map[string]interface{}) []sinks.AlarmEvent {
+	alarmMu.Lock()
+	defer alarmMu.Unlock()
+	acks := pendingAlarmEvents
+	pendingAlarmEvents = nil
+	var events []sinks.AlarmEvent
+	for _, st := range alarmStates {
+		raiseCond, clearCond, known := st.conditions(ts, data[st.cfg.Register])
+		if !known {
+			continue // Không đủ dữ liệu để đánh giá, giữ nguyên trạng thái
+		}
+		if !st.status.Active {
+			st.clearingSince = time.Time{}
+			if !raiseCond {
+				st.pendingSince = time.Time{}
+				continue
+			}
+			if st.pendingSince.IsZero() {
+				st.pendingSince = ts
+			}
+			if ts.Sub(st.pendingSince) >= st.cfg.OnDelay {
+				st.status.Active = true
+				st.status.Acknowledged = false
+				st.status.RaisedAt = ts
+				st.pendingSince = time.Time{}
+				events = append(events, st.event(ts, sinks.AlarmEventRaise, data[st.cfg.Register]))
+			}
+			continue
+		}
+		st.pendingSince = time.Time{}
+		if !clearCond {
+			st.clearingSince = time.Time{}
+			continue
+		}
+		if st.clearingSince.IsZero() {
+			st.clearingSince = ts
+		}
+		if ts.Sub(st.clearingSince) >= st.cfg.OffDelay {
+			st.status.Active = false
+			st.status.ClearedAt = ts
+			st.clearingSince = time.Time{}
+			events = append(events, st.event(ts, sinks.AlarmEventClear, data[st.cfg.Register]))
+		}
+	}
+	for _, ev := range events {
+		logAlarmEvent(ev)
+	}
+	return append(acks, events...) // ACK đã được ghi log lúc xác nhận
+}
+
+// conditions trả về (điều kiện phát, điều kiện xóa, có đủ dữ liệu hay không) cho giá trị hiện tại.
+func (st *alarmState) conditions(ts time.Time, value interface{}) (bool, bool, bool) {
+	cfg := st.cfg
+	v, quality := decode.Classify(value)
+	if str, isString := value.(string); isString && quality == decode.QualityNA && !decode.IsNA(str) && cfg.Kind == "STALE" {
+		quality = decode.QualityGood // Chuỗi thông thường (Meter_Model, DATETIME...) chỉ dùng cho STALE
+	}
+	switch cfg.Kind {
+	case "NA":
+		return quality == decode.QualityNA, quality != decode.QualityNA, true
+	case "COMM_ERROR":
+		return quality == decode.QualityError, quality != decode.QualityError, true
+	}
+	if quality != decode.QualityGood {
+		return false, false, false
+	}
+
+	switch cfg.Kind {
+	case "HIGH", "HIGH_HIGH":
+		return v > cfg.Limit, v < cfg.Limit-cfg.Deadband, true
+	case "LOW", "LOW_LOW":
+		return v < cfg.Limit, v > cfg.Limit+cfg.Deadband, true
+	case "RATE":
+		prev, prevTime, hadPrev := st.lastValue, st.lastTime, st.hasLast
+		st.lastValue, st.lastTime, st.hasLast = v, ts, true
+		dt := ts.Sub(prevTime).Seconds()
+		if !hadPrev || dt <= 0 {
+			return false, false, false
+		}
+		rate := math.Abs(v-prev) / dt
+		return rate > cfg.Limit, rate < cfg.Limit-cfg.Deadband, true
+	case "STALE":
+		key := fmt.Sprint(value)
+		if !st.hasLast || st.lastKey != key {
+			st.lastChange = ts
+		}
+		st.lastKey, st.hasLast = key, true
+		stale := ts.Sub(st.lastChange).Seconds() >= cfg.Limit
+		return stale, !stale, true
+	}
+	return false, false, false
+}
+
+func (st *alarmState) event(ts time.Time, kind string, value interface{}) sinks.AlarmEvent {
+	return sinks.AlarmEvent{
+		Time: ts, ID: st.status.ID, Register: st.cfg.Register, Kind: st.cfg.Kind, Severity: st.cfg.Severity,
+		Event: kind, Value: decode.Sanitize(value), Limit: st.cfg.Limit,
+	}
+}
+
+func logAlarmEvent(ev sinks.AlarmEvent) {
+	entry := logrus.WithFields(logrus.Fields{
+		"alarm_id": ev.ID, "alarm_event": ev.Event, "register_name": ev.Register, "alarm_kind": ev.Kind,
+		"severity": ev.Severity, "value": ev.Value, "limit": ev.Limit, "alarm_time": ev.Time.Format(time.RFC3339Nano),
+	})
+	if ev.AckBy != "" {
+		entry = entry.WithField("ack_by", ev.AckBy)
+	}
+	if ev.Event == sinks.AlarmEventRaise {
+		entry.Warn("Alarm Event")
+	} else {
+		entry.Info("Alarm Event")
+	}
+}
+
+// acknowledgeAlarm xác nhận cảnh báo theo ID ("Register:Kind") (REST API). Sự kiện ACK được ghi
+// log ngay và gửi tới các sink cùng kết quả chu kỳ đọc kế tiếp.
+func acknowledgeAlarm(id, by string) (sinks.AlarmEvent, error) {
+	alarmMu.Lock()
+	defer alarmMu.Unlock()
+	for _, st := range alarmStates {
+		if st.status.ID != id {
+			continue
+		}
+		if st.status.Acknowledged {
+			return sinks.AlarmEvent{}, fmt.Errorf("%w: '%s'", errAlarmAcknowledged, id)
+		}
+		st.status.Acknowledged = true
+		ev := st.event(time.Now(), sinks.AlarmEventAck, nil)
+		ev.AckBy = by
+		logAlarmEvent(ev)
+		pendingAlarmEvents = append(pendingAlarmEvents, ev)
+		return ev, nil
+	}
+	return sinks.AlarmEvent{}, fmt.Errorf("%w: '%s'", errAlarmNotFound, id)
+}
+
+// alarmSnapshot trả về các cảnh báo đang active hoặc chưa được xác nhận, sắp xếp theo ID.
+func alarmSnapshot() []AlarmStatus {
+	alarmMu.Lock()
+	defer alarmMu.Unlock()
+	var list []AlarmStatus
+	for _, st := range alarmStates {
+		if st.status.Active || !st.status.Acknowledged {
+			list = append(list, st.status)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+func countActiveAlarms() int {
+	count := 0
+	for _, status := range alarmSnapshot() {
+		if status.Active {
+			count++
+		}
+	}
+	return count
+}
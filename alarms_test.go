@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"modbus_test/sinks"
+)
+
+// alarmEventKinds trả về loại của các sự kiện cảnh báo (RAISE, CLEAR, ACK).
+func alarmEventKinds(events []sinks.AlarmEvent) string {
+	kinds := make([]string, len(events))
+	for i, ev := range events {
+		kinds[i] = ev.Event
+	}
+	return strings.Join(kinds, ",")
+}
+
+func TestAlarmAcknowledgeAPI(t *testing.T) {
+	logrus.SetOutput(io.Discard)
+	defer logrus.SetOutput(io.Discard)
+	oldStates := alarmStates
+	defer func() { alarmStates, pendingAlarmEvents = oldStates, nil }()
+	cfg := AlarmConfig{Register: "V", Kind: "HIGH", Limit: 10, Deadband: 1, Severity: "WARNING"}
+	alarmStates = []*alarmState{{
+		cfg:    cfg,
+		status: AlarmStatus{ID: alarmID(cfg), Register: cfg.Register, Kind: cfg.Kind, Severity: cfg.Severity, Acknowledged: true},
+	}}
+	server := httptest.NewServer(newAPIMux())
+	defer server.Close()
+	post := func(path, body string) (int, map[string]interface{}) {
+		t.Helper()
+		resp, err := http.Post(server.URL+apiPrefix+"/devices/"+deviceID+path, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var out map[string]interface{}
+		json.NewDecoder(resp.Body).Decode(&out)
+		return resp.StatusCode, out
+	}
+
+	ts := time.Date(2026, 10, 19, 12, 0, 0, 0, time.Local)
+	if got := alarmEventKinds(evaluateAlarms(ts, map[string]interface{}{"V": 12.0})); got != "RAISE" {
+		t.Fatalf("sự kiện khi vượt ngưỡng = %q, cần RAISE", got)
+	}
+
+	resp, err := http.Get(server.URL + apiPrefix + "/devices/" + deviceID + "/alarms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var list []AlarmStatus
+	json.NewDecoder(resp.Body).Decode(&list)
+	resp.Body.Close()
+	if len(list) != 1 || !list[0].Active || list[0].Acknowledged {
+		t.Errorf("GET alarms = %+v, cần một cảnh báo active chưa xác nhận", list)
+	}
+
+	if code, ev := post("/alarms/V:HIGH/ack", `{"by": "operator"}`); code != http.StatusOK || ev["event"] != sinks.AlarmEventAck || ev["ack_by"] != "operator" {
+		t.Errorf("POST ack = %d %v", code, ev)
+	}
+	if code, _ := post("/alarms/V:HIGH/ack", ""); code != http.StatusConflict {
+		t.Errorf("xác nhận lần hai = %d, cần 409", code)
+	}
+	if code, _ := post("/alarms/V:LOW/ack", ""); code != http.StatusNotFound {
+		t.Errorf("xác nhận cảnh báo không tồn tại = %d, cần 404", code)
+	}
+	if code, _ := post("/alarms/V:HIGH/ack", "{"); code != http.StatusBadRequest {
+		t.Errorf("body JSON lỗi = %d, cần 400", code)
+	}
+
+	// ACK đi cùng kết quả chu kỳ kế tiếp (tới các sink), đúng một lần
+	events := evaluateAlarms(ts.Add(time.Second), map[string]interface{}{"V": 12.0})
+	if got := alarmEventKinds(events); got != "ACK" || events[0].AckBy != "operator" || events[0].ID != "V:HIGH" {
+		t.Errorf("sự kiện chu kỳ sau khi xác nhận = %+v, cần ACK của operator", events)
+	}
+	if got := alarmEventKinds(evaluateAlarms(ts.Add(2*time.Second), map[string]interface{}{"V": 8.0})); got != "CLEAR" {
+		t.Errorf("sự kiện khi về dưới ngưỡng = %q, cần CLEAR", got)
+	}
+	if list := alarmSnapshot(); len(list) != 0 {
+		t.Errorf("cảnh báo đã xóa và đã xác nhận vẫn còn trong danh sách: %+v", list)
+	}
+}
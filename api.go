@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"modbus_test/registermap"
+)
+
+// --- Cấu hình REST API ---
+const (
+	enableAPI     = true
+	apiListenAddr = ":8080"
+	apiPrefix     = "/api/v1"
+)
+
+//go:embed api_openapi.json
+var apiOpenAPISpec []byte
+
+// RegisterDescription mô tả một thanh ghi trong danh sách của REST API.
+type RegisterDescription struct {
+	Name       string `json:"name"`
+	Group      string `json:"group"`
+	Unit       string `json:"unit,omitempty"`
+	Type       string `json:"type"`
+	Address    uint16 `json:"address,omitempty"`
+	Length     uint16 `json:"length,omitempty"`
+	Derived    bool   `json:"derived"`
+	Expression string `json:"expression,omitempty"`
+}
+
+// DeviceDescription mô tả một thiết bị trong danh sách của REST API.
+type DeviceDescription struct {
+	ID        string `json:"id"`
+	Port      string `json:"port"`
+	SlaveID   int    `json:"slave_id"`
+	Connected bool   `json:"connected"`
+	Registers int    `json:"registers"`
+}
+
+var apiServer *http.Server
+
+// newAPIMux tạo router của REST API; các request theo thiết bị chỉ chấp nhận deviceID hiện tại.
+func newAPIMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+apiPrefix+"/openapi.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(apiOpenAPISpec)
+	})
+	mux.HandleFunc("GET "+apiPrefix+"/devices", handleListDevices)
+	mux.HandleFunc("GET "+apiPrefix+"/devices/{device}/registers", withDevice(handleListRegisters))
+	mux.HandleFunc("GET "+apiPrefix+"/devices/{device}/readings", withDevice(handleListReadings))
+	mux.HandleFunc("GET "+apiPrefix+"/devices/{device}/readings/{register}", withDevice(handleGetReading))
+	mux.HandleFunc("POST "+apiPrefix+"/devices/{device}/registers/{register}/read", withDevice(handleReadRegister))
+	mux.HandleFunc("GET "+apiPrefix+"/devices/{device}/status", withDevice(handleGetStatus))
+	mux.HandleFunc("GET "+apiPrefix+"/devices/{device}/alarms", withDevice(handleListAlarms))
+	mux.HandleFunc("POST "+apiPrefix+"/devices/{device}/alarms/{alarm}/ack", withDevice(handleAckAlarm))
+	if enableDashboard {
+		registerDashboard(mux)
+	}
+	return mux
+}
+
+func setupAPI() {
+	if !enableAPI {
+		return
+	}
+	apiServer = &http.Server{Addr: apiListenAddr, Handler: newAPIMux(), ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		if err := apiServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("Lỗi REST API tại %s: %v", apiListenAddr, err)
+		}
+	}()
+	log.Printf("REST API tại http://%s%s (mô tả OpenAPI: %s/openapi.json)", apiListenAddr, apiPrefix, apiPrefix)
+	if enableDashboard {
+		log.Printf("Dashboard tại http://%s/", apiListenAddr)
+	}
+}
+
+func closeAPI() {
+	if apiServer == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	dashboard.closeAll()
+	apiServer.Shutdown(ctx)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeAPIError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
+
+func withDevice(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.PathValue("device") != deviceID {
+			writeAPIError(w, http.StatusNotFound, "không tìm thấy thiết bị '"+r.PathValue("device")+"'")
+			return
+		}
+		h(w, r)
+	}
+}
+
+func handleListDevices(w http.ResponseWriter, r *http.Request) {
+	status := currentStatus()
+	writeJSON(w, http.StatusOK, []DeviceDescription{{
+		ID: deviceID, Port: portLabel(), SlaveID: int(slaveID), Connected: status.Connected, Registers: len(outputRegisterNames()),
+	}})
+}
+
+func handleListRegisters(w http.ResponseWriter, r *http.Request) {
+	list := make([]RegisterDescription, 0, len(registersToRead)+len(derivedRegisters))
+	for _, reg := range registersToRead {
+		list = append(list, RegisterDescription{
+			Name: reg.Name, Group: registerGroup(reg.Name), Unit: registermap.Unit(reg.Name), Type: reg.Type, Address: reg.Address, Length: reg.Length,
+		})
+	}
+	for _, d := range derivedRegisters {
+		list = append(list, RegisterDescription{
+			Name: d.Name, Group: registerGroup(d.Name), Unit: registermap.Unit(d.Name), Type: "DERIVED", Derived: true, Expression: d.Expression,
+		})
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// handleListReadings trả về giá trị gần nhất của mọi thanh ghi, lọc theo ?group= nếu có.
+func handleListReadings(w http.ResponseWriter, r *http.Request) {
+	group := r.URL.Query().Get("group")
+	readings := []Reading{}
+	for _, name := range outputRegisterNames() {
+		reading, ok := latestReading(name)
+		if ok && (group == "" || reading.Group == group) {
+			readings = append(readings, reading)
+		}
+	}
+	writeJSON(w, http.StatusOK, readings)
+}
+
+func handleGetReading(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("register")
+	reading, ok := latestReading(name)
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, "chưa có giá trị cho thanh ghi '"+name+"'")
+		return
+	}
+	writeJSON(w, http.StatusOK, reading)
+}
+
+// handleReadRegister đọc ngay một thanh ghi vật lý từ thiết bị (dùng chung đường truyền với
+// vòng lặp đọc, xen giữa các lần đọc của vòng lặp).
+func handleReadRegister(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("register")
+	reg, ok := registermap.Find(registersToRead, name)
+	if !ok {
+		if isDerivedRegister(name) {
+			writeAPIError(w, http.StatusBadRequest, "thanh ghi ảo '"+name+"' không đọc trực tiếp được")
+		} else {
+			writeAPIError(w, http.StatusNotFound, "không tìm thấy thanh ghi '"+name+"'")
+		}
+		return
+	}
+	client := currentClient()
+	if client == nil {
+		writeAPIError(w, http.StatusServiceUnavailable, "chưa kết nối tới thiết bị")
+		return
+	}
+	reading := newReading(name, devicePoller.ReadRegister(r.Context(), client, reg), time.Now())
+	recordReading(reading)
+	writeJSON(w, http.StatusOK, reading)
+}
+
+func handleGetStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, currentStatus())
+}
+
+// handleListAlarms trả về các cảnh báo đang active hoặc chưa được xác nhận.
+func handleListAlarms(w http.ResponseWriter, r *http.Request) {
+	list := alarmSnapshot()
+	if list == nil {
+		list = []AlarmStatus{}
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// handleAckAlarm xác nhận một cảnh báo. Body JSON tùy chọn {"by": "tên người xác nhận"}.
+func handleAckAlarm(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		By string `json:"by"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeAPIError(w, http.StatusBadRequest, "body JSON không hợp lệ: "+err.Error())
+			return
+		}
+	}
+	if body.By == "" {
+		body.By = "api"
+	}
+	ev, err := acknowledgeAlarm(r.PathValue("alarm"), body.By)
+	switch {
+	case errors.Is(err, errAlarmNotFound):
+		writeAPIError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, errAlarmAcknowledged):
+		writeAPIError(w, http.StatusConflict, err.Error())
+	default:
+		writeJSON(w, http.StatusOK, ev)
+	}
+}
@@ -0,0 +1,615 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/goburrow/modbus"
+	"github.com/sirupsen/logrus"
+
+	"modbus_test/decode"
+	"modbus_test/registermap"
+	"modbus_test/sinks"
+	"modbus_test/transport"
+)
+
+// Mã thoát của chương trình, dùng khi gọi từ script
+const (
+	exitOK        = 0
+	exitError     = 1 // Lỗi chung: file, sink, giải mã...
+	exitUsage     = 2 // Sai lệnh, sai tham số hoặc file cấu hình không hợp lệ
+	exitCommError = 3 // Không kết nối được hoặc thiết bị không trả lời (timeout, lỗi đường truyền)
+	exitException = 4 // Thiết bị trả lời bằng Modbus exception
+)
+
+// cliError gắn mã thoát cho lỗi của một lệnh.
+type cliError struct {
+	code int
+	err  error
+}
+
+func (e *cliError) Error() string { return e.err.Error() }
+func (e *cliError) Unwrap() error { return e.err }
+
+func usageErrorf(format string, args ...interface{}) error {
+	return &cliError{code: exitUsage, err: fmt.Errorf(format, args...)}
+}
+
+// transportError phân loại lỗi của một yêu cầu Modbus: exception do thiết bị trả về, địa chỉ cấu
+// hình sai, hoặc lỗi đường truyền (timeout, CRC, mất kết nối...).
+func transportError(err error) error {
+	var mbErr *modbus.ModbusError
+	switch {
+	case errors.As(err, &mbErr):
+		return &cliError{code: exitException, err: fmt.Errorf("%w (%s)", err, transport.ExceptionMessage(mbErr.ExceptionCode))}
+	case errors.Is(err, transport.ErrInvalidAddress):
+		return &cliError{code: exitUsage, err: err}
+	}
+	return &cliError{code: exitCommError, err: err}
+}
+
+func exitCode(err error) int {
+	var ce *cliError
+	switch {
+	case err == nil, errors.Is(err, flag.ErrHelp):
+		return exitOK
+	case errors.As(err, &ce):
+		return ce.code
+	}
+	return exitError
+}
+
+// cliCommand là một lệnh con: modbus_go <lệnh> [tham số].
+type cliCommand struct {
+	Name    string
+	Summary string
+	Run     func(args []string) error
+}
+
+var cliCommands = []cliCommand{
+	{Name: "poll", Summary: "đọc thiết bị liên tục và ghi ra các sink (mặc định khi không có lệnh)", Run: runPollCommand},
+	{Name: "read", Summary: "đọc một hoặc nhiều thanh ghi rồi thoát", Run: runReadCommand},
+	{Name: "write", Summary: "ghi giá trị vào thanh ghi", Run: runWriteCommand},
+	{Name: "scan", Summary: "dò slave ID hoặc dải địa chỉ thanh ghi đọc được", Run: runScanCommand},
+	{Name: "simulate", Summary: "chạy bộ mô phỏng slave (RTU qua cổng COM hoặc Modbus TCP)", Run: runSimulateCommand},
+	{Name: "replay", Summary: "phát lại file log CSV/JSON tới các sink", Run: runReplayCommand},
+	{Name: "query", Summary: "xuất dữ liệu từ SQLite ra CSV", Run: runQueryCommand},
+}
+
+func printUsage(w io.Writer) {
+	fmt.Fprintf(w, "Cách dùng: %s <lệnh> [tham số]\n\nCác lệnh:\n", os.Args[0])
+	for _, cmd := range cliCommands {
+		fmt.Fprintf(w, "  %-9s %s\n", cmd.Name, cmd.Summary)
+	}
+	fmt.Fprintf(w, "\nXem tham số của từng lệnh: %s <lệnh> -h\n", os.Args[0])
+	fmt.Fprintf(w, "Mã thoát: %d thành công, %d lỗi chung, %d sai tham số/cấu hình, %d lỗi kết nối/timeout, %d Modbus exception\n",
+		exitOK, exitError, exitUsage, exitCommError, exitException)
+}
+
+// runCLI chọn lệnh theo tham số đầu tiên và trả về mã thoát.
+func runCLI(args []string) int {
+	logrus.SetOutput(os.Stderr) // Kết quả các lệnh in ra stdout, log ra stderr để dùng được trong script
+	name := "poll"
+	if len(args) > 0 {
+		switch args[0] {
+		case "help", "-h", "-help", "--help":
+			printUsage(os.Stdout)
+			return exitOK
+		}
+		if !strings.HasPrefix(args[0], "-") {
+			name, args = args[0], args[1:]
+		}
+	}
+	for _, cmd := range cliCommands {
+		if cmd.Name != name {
+			continue
+		}
+		err := cmd.Run(args)
+		if err != nil && !errors.Is(err, flag.ErrHelp) {
+			log.Printf("Lỗi lệnh %s: %v", name, err)
+		}
+		return exitCode(err)
+	}
+	fmt.Fprintf(os.Stderr, "Lệnh không hợp lệ: %s\n\n", name)
+	printUsage(os.Stderr)
+	return exitUsage
+}
+
+// parseFlags phân tích tham số; lỗi cú pháp trả về mã thoát exitUsage. Lệnh không nhận tham số
+// vị trí thì maxArgs = 0.
+func parseFlags(fs *flag.FlagSet, args []string, maxArgs int) error {
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return &cliError{code: exitUsage, err: err}
+	}
+	if maxArgs >= 0 && fs.NArg() > maxArgs {
+		return usageErrorf("tham số thừa: %s", strings.Join(fs.Args(), " "))
+	}
+	return nil
+}
+
+// connectionFlags là các tham số kết nối dùng chung cho các lệnh làm việc với thiết bị.
+type connectionFlags struct {
+	configPath string
+	values     Config
+}
+
+func addConnectionFlags(fs *flag.FlagSet) *connectionFlags {
+	f := &connectionFlags{values: defaultConfig()}
+	fs.StringVar(&f.configPath, "config", "", "file cấu hình YAML")
+	fs.StringVar(&f.values.Port, "port", f.values.Port, "cổng COM (COM3, /dev/ttyUSB0)")
+	fs.StringVar(&f.values.Address, "tcp", "", "dùng Modbus TCP tới host:port thay cho cổng COM")
+	fs.IntVar(&f.values.BaudRate, "baud", f.values.BaudRate, "tốc độ baud")
+	fs.IntVar(&f.values.DataBits, "data-bits", f.values.DataBits, "số bit dữ liệu")
+	fs.StringVar(&f.values.Parity, "parity", f.values.Parity, "parity: N, E, O")
+	fs.IntVar(&f.values.StopBits, "stop-bits", f.values.StopBits, "số stop bit")
+	fs.IntVar(&f.values.SlaveID, "slave", f.values.SlaveID, "địa chỉ slave")
+	fs.IntVar(&f.values.TimeoutMs, "timeout-ms", f.values.TimeoutMs, "thời gian chờ phản hồi (ms)")
+	fs.IntVar(&f.values.AddressBase, "address-base", f.values.AddressBase, "địa chỉ thanh ghi bắt đầu từ 0 hay 1")
+	return f
+}
+
+// addFaultsFlag thêm tham số --faults cho các lệnh làm việc với thiết bị (không dùng cho simulate).
+func (f *connectionFlags) addFaultsFlag(fs *flag.FlagSet) {
+	fs.StringVar(&f.values.Faults, "faults", "", "gài lỗi đường truyền khi thử với bộ mô phỏng, ví dụ timeout=0.05,disconnect=0.01,seed=1 (xem README)")
+}
+
+// apply đọc file cấu hình (nếu có), ghi đè bằng các tham số được truyền trên dòng lệnh rồi áp
+// dụng cho chương trình.
+func (f *connectionFlags) apply(fs *flag.FlagSet) error {
+	cfg := defaultConfig()
+	if f.configPath != "" {
+		var err error
+		if cfg, err = loadConfig(f.configPath); err != nil {
+			return &cliError{code: exitUsage, err: err}
+		}
+	}
+	fs.Visit(func(fl *flag.Flag) {
+		switch fl.Name {
+		case "port":
+			cfg.Transport, cfg.Port = "rtu", f.values.Port
+		case "tcp":
+			cfg.Transport, cfg.Address = "tcp", f.values.Address
+		case "baud":
+			cfg.BaudRate = f.values.BaudRate
+		case "data-bits":
+			cfg.DataBits = f.values.DataBits
+		case "parity":
+			cfg.Parity = f.values.Parity
+		case "stop-bits":
+			cfg.StopBits = f.values.StopBits
+		case "slave":
+			cfg.SlaveID = f.values.SlaveID
+		case "timeout-ms":
+			cfg.TimeoutMs = f.values.TimeoutMs
+		case "address-base":
+			cfg.AddressBase = f.values.AddressBase
+		case "interval":
+			cfg.PollInterval = f.values.PollInterval
+		case "log-dir":
+			cfg.LogDir = f.values.LogDir
+		case "faults":
+			cfg.Faults = f.values.Faults
+		}
+	})
+	if err := cfg.validate(); err != nil {
+		return &cliError{code: exitUsage, err: err}
+	}
+	applyConfig(cfg)
+	return nil
+}
+
+// selectSinks chỉ bật các sink có tên trong danh sách (tham số --sinks).
+func selectSinks(list string) error {
+	selected := make(map[string]bool)
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if _, ok := sinkConfigIndex(name); !ok {
+			return usageErrorf("sink '%s' không tồn tại", name)
+		}
+		selected[name] = true
+	}
+	for i := range sinkConfigs {
+		sinkConfigs[i].Enabled = selected[sinkConfigs[i].Name]
+	}
+	return nil
+}
+
+// connectDevice mở kết nối theo cấu hình hiện tại.
+func connectDevice(ctx context.Context) (*transport.Client, error) {
+	client := transport.NewClientConn(deviceConn(), addressBase)
+	if err := client.Connect(ctx); err != nil {
+		return nil, &cliError{code: exitCommError, err: fmt.Errorf("không thể kết nối %s: %w", transportDescription(), err)}
+	}
+	return client, nil
+}
+
+// --- Lệnh poll ---
+func runPollCommand(args []string) error {
+	fs := flag.NewFlagSet("poll", flag.ContinueOnError)
+	conn := addConnectionFlags(fs)
+	conn.addFaultsFlag(fs)
+	fs.DurationVar(&conn.values.PollInterval, "interval", conn.values.PollInterval, "thời gian nghỉ giữa hai chu kỳ đọc")
+	fs.StringVar(&conn.values.LogDir, "log-dir", conn.values.LogDir, "thư mục log")
+	sinkList := fs.String("sinks", "", "chỉ bật các sink này, cách nhau bởi dấu phẩy (mặc định: theo sinkConfigs và file cấu hình)")
+	cycles := fs.Uint64("cycles", 0, "dừng sau số chu kỳ đọc này (0 = chạy tới khi nhấn Ctrl+C)")
+	if err := parseFlags(fs, args, 0); err != nil {
+		return err
+	}
+	if err := conn.apply(fs); err != nil {
+		return err
+	}
+	if *sinkList != "" {
+		if err := selectSinks(*sinkList); err != nil {
+			return err
+		}
+	}
+	return runPoll(*cycles)
+}
+
+// registerFlags là các tham số chọn thanh ghi của lệnh read/write: theo tên trong bảng
+// registersToRead, hoặc theo địa chỉ và kiểu dữ liệu.
+type registerFlags struct {
+	names string
+	addr  uint
+	typ   string
+	count uint
+	scale float64
+}
+
+func addRegisterFlags(fs *flag.FlagSet, defaultType string) *registerFlags {
+	f := &registerFlags{}
+	fs.StringVar(&f.names, "name", "", "tên thanh ghi trong bảng registersToRead (read: nhiều tên cách nhau bởi dấu phẩy, hỗ trợ *)")
+	fs.UintVar(&f.addr, "addr", 0, "địa chỉ thanh ghi (theo address-base)")
+	fs.StringVar(&f.typ, "type", defaultType, "kiểu dữ liệu (FLOAT32, INT16U, INT32, UTF8...)")
+	fs.UintVar(&f.count, "count", 0, "số thanh ghi (mặc định theo kiểu; bắt buộc với kiểu chuỗi)")
+	fs.Float64Var(&f.scale, "scale", 0, "hệ số chia của PF kiểu *_I16 (mặc định decode.PFInt16Scale)")
+	return f
+}
+
+func (f *registerFlags) registers(fs *flag.FlagSet) ([]registermap.Register, error) {
+	addrSet := false
+	fs.Visit(func(fl *flag.Flag) { addrSet = addrSet || fl.Name == "addr" })
+	if f.names != "" {
+		if addrSet {
+			return nil, usageErrorf("chỉ dùng một trong hai: --name hoặc --addr")
+		}
+		var patterns []string
+		for _, p := range strings.Split(f.names, ",") {
+			patterns = append(patterns, strings.TrimSpace(p))
+		}
+		var regs []registermap.Register
+		for _, reg := range registersToRead {
+			if len(sinks.FilterNames([]string{reg.Name}, patterns)) > 0 {
+				regs = append(regs, reg)
+			}
+		}
+		if len(regs) == 0 {
+			return nil, usageErrorf("không có thanh ghi nào khớp với '%s'", f.names)
+		}
+		return regs, nil
+	}
+	if !addrSet {
+		return nil, usageErrorf("cần --name hoặc --addr")
+	}
+	if f.addr > 0xFFFF {
+		return nil, usageErrorf("địa chỉ %d vượt quá 65535", f.addr)
+	}
+	typ := strings.ToUpper(f.typ)
+	count := uint16(f.count)
+	if count == 0 {
+		var ok bool
+		if count, ok = registermap.TypeRegisterCounts[typ]; !ok {
+			return nil, usageErrorf("kiểu %s cần khai báo --count", typ)
+		}
+	}
+	if count > 125 {
+		return nil, usageErrorf("--count tối đa 125 thanh ghi")
+	}
+	if f.scale < 0 {
+		return nil, usageErrorf("--scale phải lớn hơn 0")
+	}
+	return []registermap.Register{{Name: fmt.Sprintf("addr_%d", f.addr), Address: uint16(f.addr), Type: typ, Length: count, Scale: f.scale}}, nil
+}
+
+// readResult là kết quả đọc một thanh ghi của lệnh read.
+type readResult struct {
+	Register string      `json:"register"`
+	Address  uint16      `json:"address"`
+	Type     string      `json:"type"`
+	Value    interface{} `json:"value,omitempty"`
+	Unit     string      `json:"unit,omitempty"`
+	Raw      string      `json:"raw,omitempty"`
+	Error    string      `json:"error,omitempty"`
+}
+
+// --- Lệnh read ---
+func runReadCommand(args []string) error {
+	fs := flag.NewFlagSet("read", flag.ContinueOnError)
+	conn := addConnectionFlags(fs)
+	conn.addFaultsFlag(fs)
+	regFlags := addRegisterFlags(fs, "FLOAT32")
+	format := fs.String("format", "text", "định dạng kết quả: text, json, csv")
+	showRaw := fs.Bool("raw", false, "in thêm bytes thô (hex)")
+	if err := parseFlags(fs, args, 0); err != nil {
+		return err
+	}
+	if *format != "text" && *format != "json" && *format != "csv" {
+		return usageErrorf("định dạng '%s' không hỗ trợ", *format)
+	}
+	if err := conn.apply(fs); err != nil {
+		return err
+	}
+	regs, err := regFlags.registers(fs)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := signalContext()
+	defer cancel()
+	client, err := connectDevice(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	var results []readResult
+	var firstErr error
+	for _, reg := range regs {
+		r := readResult{Register: reg.Name, Address: reg.Address, Type: reg.Type, Unit: registermap.Unit(reg.Name)}
+		data, err := client.ReadRaw(ctx, reg)
+		if err == nil {
+			var value interface{}
+			if value, err = decode.Decode(data, reg); err == nil {
+				r.Value = outputValue(value)
+			} else {
+				err = &cliError{code: exitError, err: fmt.Errorf("lỗi giải mã %s: %w", reg.Name, err)}
+			}
+		} else {
+			err = transportError(err)
+		}
+		if *showRaw && data != nil {
+			r.Raw = fmt.Sprintf("%x", data)
+		}
+		if err != nil {
+			r.Error = err.Error()
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+		results = append(results, r)
+	}
+	if err := printReadResults(os.Stdout, results, *format); err != nil {
+		return err
+	}
+	return firstErr
+}
+
+func printReadResults(w io.Writer, results []readResult, format string) error {
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(results)
+	case "csv":
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"register", "address", "type", "value", "unit", "raw", "error"})
+		for _, r := range results {
+			cw.Write([]string{r.Register, strconv.Itoa(int(r.Address)), r.Type, formatReadValue(r.Value), r.Unit, r.Raw, r.Error})
+		}
+		cw.Flush()
+		return cw.Error()
+	}
+	for _, r := range results {
+		line := fmt.Sprintf("%-30s ", r.Register)
+		if r.Error != "" {
+			line += "LỖI: " + r.Error
+		} else {
+			line += formatReadValue(r.Value)
+			if r.Unit != "" {
+				line += " " + r.Unit
+			}
+		}
+		if r.Raw != "" {
+			line += " [" + r.Raw + "]"
+		}
+		fmt.Fprintln(w, line)
+	}
+	return nil
+}
+
+// formatReadValue in số thực không dùng dạng mũ (bộ đếm năng lượng INT64 lớn).
+func formatReadValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return fmt.Sprint(value)
+}
+
+// --- Lệnh write ---
+func runWriteCommand(args []string) error {
+	fs := flag.NewFlagSet("write", flag.ContinueOnError)
+	conn := addConnectionFlags(fs)
+	conn.addFaultsFlag(fs)
+	regFlags := addRegisterFlags(fs, "INT16U")
+	value := fs.String("value", "", "giá trị cần ghi (bắt buộc)")
+	dryRun := fs.Bool("dry-run", false, "chỉ in bytes sẽ ghi, không gửi tới thiết bị")
+	verify := fs.Bool("verify", false, "đọc lại sau khi ghi để kiểm tra")
+	if err := parseFlags(fs, args, 0); err != nil {
+		return err
+	}
+	valueSet := false
+	fs.Visit(func(fl *flag.Flag) { valueSet = valueSet || fl.Name == "value" })
+	if !valueSet {
+		return usageErrorf("thiếu --value")
+	}
+	if err := conn.apply(fs); err != nil {
+		return err
+	}
+	regs, err := regFlags.registers(fs)
+	if err != nil {
+		return err
+	}
+	if len(regs) != 1 {
+		return usageErrorf("lệnh write chỉ ghi một thanh ghi, '%s' khớp %d thanh ghi", regFlags.names, len(regs))
+	}
+	reg := regs[0]
+	payload, err := decode.Encode(*value, reg)
+	if err != nil {
+		return &cliError{code: exitUsage, err: err}
+	}
+	if *dryRun {
+		fmt.Printf("%s (địa chỉ %d, %d thanh ghi, %s): %x\n", reg.Name, reg.Address, len(payload)/2, reg.Type, payload)
+		return nil
+	}
+
+	ctx, cancel := signalContext()
+	defer cancel()
+	client, err := connectDevice(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	if err := client.WriteRaw(ctx, reg, payload); err != nil {
+		return transportError(err)
+	}
+	logrus.WithFields(logrus.Fields{
+		"register_name": reg.Name, "address": reg.Address, "data_type": reg.Type, "value": *value, "raw_bytes_hex": fmt.Sprintf("%x", payload),
+	}).Info("Đã ghi thanh ghi")
+	if *verify {
+		reg.Length = uint16(len(payload) / 2)
+		readBack, err := client.ReadRaw(ctx, reg)
+		if err != nil {
+			return transportError(err)
+		}
+		if string(readBack) != string(payload) {
+			return fmt.Errorf("giá trị đọc lại %x khác giá trị đã ghi %x", readBack, payload)
+		}
+	}
+	fmt.Printf("%s = %s (đã ghi %x)\n", reg.Name, *value, payload)
+	return nil
+}
+
+// parseIDRange phân tích danh sách dạng "1-10,15,20-22" trong khoảng [min, max].
+func parseIDRange(s string, min, max int) ([]int, error) {
+	var ids []int
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		lo, hi, isRange := strings.Cut(part, "-")
+		from, err := strconv.Atoi(strings.TrimSpace(lo))
+		if err != nil {
+			return nil, usageErrorf("khoảng '%s' không hợp lệ", part)
+		}
+		to := from
+		if isRange {
+			if to, err = strconv.Atoi(strings.TrimSpace(hi)); err != nil {
+				return nil, usageErrorf("khoảng '%s' không hợp lệ", part)
+			}
+		}
+		if from < min || to > max || from > to {
+			return nil, usageErrorf("khoảng '%s' phải nằm trong %d..%d", part, min, max)
+		}
+		for id := from; id <= to; id++ {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// --- Lệnh scan ---
+func runScanCommand(args []string) error {
+	fs := flag.NewFlagSet("scan", flag.ContinueOnError)
+	conn := addConnectionFlags(fs)
+	conn.addFaultsFlag(fs)
+	slaves := fs.String("slaves", "1-247", "dải slave ID cần dò, ví dụ 1-10,20")
+	addresses := fs.String("addresses", "", "dò dải địa chỉ thanh ghi (ví dụ 3000-3100) trên --slave thay vì dò slave")
+	probe := fs.Uint("addr", uint(registersToRead[0].Address), "địa chỉ thanh ghi dùng để dò slave")
+	if err := parseFlags(fs, args, 0); err != nil {
+		return err
+	}
+	if err := conn.apply(fs); err != nil {
+		return err
+	}
+	ctx, cancel := signalContext()
+	defer cancel()
+	client, err := connectDevice(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if *addresses != "" {
+		ids, err := parseIDRange(*addresses, addressBase, 0xFFFF)
+		if err != nil {
+			return err
+		}
+		found := 0
+		for _, addr := range ids {
+			if ctx.Err() != nil {
+				break
+			}
+			data, err := client.ReadRaw(ctx, registermap.Register{Address: uint16(addr), Length: 1})
+			var mbErr *modbus.ModbusError
+			switch {
+			case err == nil:
+				found++
+				fmt.Printf("%5d: %x\n", addr, data)
+			case errors.As(err, &mbErr):
+				continue // Địa chỉ không tồn tại trên thiết bị
+			case ctx.Err() != nil:
+				continue // Đang dừng: vòng lặp sẽ thoát ở lần kiểm tra tiếp theo
+			default:
+				return transportError(err)
+			}
+		}
+		log.Printf("Slave %d: đọc được %d/%d địa chỉ", slaveID, found, len(ids))
+		if found == 0 {
+			return &cliError{code: exitCommError, err: fmt.Errorf("không đọc được địa chỉ nào trong '%s'", *addresses)}
+		}
+		return nil
+	}
+
+	ids, err := parseIDRange(*slaves, 1, 247)
+	if err != nil {
+		return err
+	}
+	var found []string
+	for _, id := range ids {
+		if ctx.Err() != nil {
+			break
+		}
+		client.SetSlaveID(byte(id))
+		_, err := client.ReadRaw(ctx, registermap.Register{Address: uint16(*probe), Length: 1})
+		var mbErr *modbus.ModbusError
+		switch {
+		case err == nil:
+			fmt.Printf("Slave %3d: trả lời\n", id)
+		case errors.As(err, &mbErr) && mbErr.ExceptionCode != modbus.ExceptionCodeGatewayPathUnavailable &&
+			mbErr.ExceptionCode != modbus.ExceptionCodeGatewayTargetDeviceFailedToRespond:
+			// Thiết bị có tồn tại nhưng không có thanh ghi dò
+			fmt.Printf("Slave %3d: trả lời với exception %d (%s)\n", id, mbErr.ExceptionCode, transport.ExceptionMessage(mbErr.ExceptionCode))
+		default:
+			logrus.WithError(err).WithField("slave_id", id).Debug("Slave không trả lời")
+			continue
+		}
+		found = append(found, strconv.Itoa(id))
+	}
+	if len(found) == 0 {
+		return &cliError{code: exitCommError, err: fmt.Errorf("không tìm thấy slave nào trong '%s'", *slaves)}
+	}
+	log.Printf("Tìm thấy %d slave: %s", len(found), strings.Join(found, ", "))
+	return nil
+}
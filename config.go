@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"modbus_test/transport"
+)
+
+// Config là cấu hình chạy đọc từ file YAML (--config). Trường không khai báo trong file giữ giá
+// trị mặc định trong mã nguồn; tham số dòng lệnh ghi đè cả hai. Ví dụ site.yaml:
+//
+//	transport: rtu
+//	port: COM3
+//	baud_rate: 19200
+//	parity: N
+//	slave_id: 1
+//	timeout_ms: 1000
+//	poll_interval: 1s
+//	log_dir: logs_go_final
+//	sinks:
+//	  mqtt: true
+//	  csv: false
+type Config struct {
+	Transport    string          `yaml:"transport"` // "rtu" hoặc "tcp"
+	Port         string          `yaml:"port"`      // Cổng COM (COM3, /dev/ttyUSB0)
+	BaudRate     int             `yaml:"baud_rate"`
+	DataBits     int             `yaml:"data_bits"`
+	Parity       string          `yaml:"parity"` // "N", "E", "O"
+	StopBits     int             `yaml:"stop_bits"`
+	Address      string          `yaml:"address"` // host:port khi transport = "tcp"
+	SlaveID      int             `yaml:"slave_id"`
+	TimeoutMs    int             `yaml:"timeout_ms"`
+	AddressBase  int             `yaml:"address_base"` // 0 hoặc 1
+	PollInterval time.Duration   `yaml:"poll_interval"`
+	LogDir       string          `yaml:"log_dir"`
+	Sinks        map[string]bool `yaml:"sinks"`  // Bật/tắt sink theo tên, ghi đè Enabled trong sinkConfigs
+	Faults       string          `yaml:"faults"` // Gài lỗi đường truyền (transport.ParseFaultSpec), chỉ dùng với bộ mô phỏng
+}
+
+// defaultConfig trả về cấu hình mặc định (các giá trị khai báo trong mã nguồn).
+func defaultConfig() Config {
+	return Config{
+		Transport: transportType, Port: portNameSimple, BaudRate: baudRate, DataBits: dataBits, Parity: parity,
+		StopBits: stopBits, Address: tcpAddress, SlaveID: int(slaveID), TimeoutMs: timeoutMs, AddressBase: addressBase,
+		PollInterval: pollInterval, LogDir: logDir, Faults: faultSpec,
+	}
+}
+
+// loadConfig đọc file YAML đè lên cấu hình mặc định. Khóa không biết (gõ sai tên) bị báo lỗi.
+func loadConfig(path string) (Config, error) {
+	cfg := defaultConfig()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, fmt.Errorf("lỗi đọc file cấu hình '%s': %w", path, err)
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) { // io.EOF: file rỗng, giữ mặc định
+		return cfg, fmt.Errorf("file cấu hình '%s' không hợp lệ: %w", path, err)
+	}
+	return cfg, nil
+}
+
+func (c Config) validate() error {
+	switch {
+	case c.Transport != "rtu" && c.Transport != "tcp":
+		return fmt.Errorf("transport '%s' không hỗ trợ (dùng rtu hoặc tcp)", c.Transport)
+	case c.Transport == "rtu" && c.Port == "":
+		return fmt.Errorf("thiếu tên cổng (port)")
+	case c.Transport == "tcp" && c.Address == "":
+		return fmt.Errorf("thiếu địa chỉ Modbus TCP (address)")
+	case c.BaudRate <= 0:
+		return fmt.Errorf("baud_rate không hợp lệ: %d", c.BaudRate)
+	case c.DataBits < 5 || c.DataBits > 8:
+		return fmt.Errorf("data_bits không hợp lệ: %d", c.DataBits)
+	case strings.ToUpper(c.Parity) != "N" && strings.ToUpper(c.Parity) != "E" && strings.ToUpper(c.Parity) != "O":
+		return fmt.Errorf("parity không hợp lệ: '%s' (dùng N, E hoặc O)", c.Parity)
+	case c.StopBits != 1 && c.StopBits != 2:
+		return fmt.Errorf("stop_bits không hợp lệ: %d", c.StopBits)
+	case c.SlaveID < 0 || c.SlaveID > 247:
+		return fmt.Errorf("slave_id phải trong khoảng 0..247, nhận %d", c.SlaveID)
+	case c.TimeoutMs <= 0:
+		return fmt.Errorf("timeout_ms phải lớn hơn 0")
+	case c.AddressBase != 0 && c.AddressBase != 1:
+		return fmt.Errorf("address_base phải là 0 hoặc 1")
+	case c.PollInterval <= 0:
+		return fmt.Errorf("poll_interval phải lớn hơn 0")
+	case c.LogDir == "":
+		return fmt.Errorf("thiếu log_dir")
+	}
+	for name := range c.Sinks {
+		if _, ok := sinkConfigIndex(name); !ok {
+			return fmt.Errorf("sink '%s' không tồn tại", name)
+		}
+	}
+	if _, err := transport.ParseFaultSpec(c.Faults); err != nil {
+		return fmt.Errorf("faults không hợp lệ: %w", err)
+	}
+	return nil
+}
+
+// applyConfig ghi cấu hình vào các biến dùng chung của chương trình.
+func applyConfig(c Config) {
+	transportType, portNameSimple, baudRate, dataBits = c.Transport, c.Port, c.BaudRate, c.DataBits
+	parity, stopBits, tcpAddress = strings.ToUpper(c.Parity), c.StopBits, c.Address
+	slaveID, timeoutMs, addressBase = byte(c.SlaveID), c.TimeoutMs, c.AddressBase
+	pollInterval, logDir, faultSpec = c.PollInterval, c.LogDir, c.Faults
+	for name, enabled := range c.Sinks {
+		if i, ok := sinkConfigIndex(name); ok {
+			sinkConfigs[i].Enabled = enabled
+		}
+	}
+	updateDeviceIdentity()
+}
+
+func sinkConfigIndex(name string) (int, bool) {
+	for i, cfg := range sinkConfigs {
+		if cfg.Name == name {
+			return i, true
+		}
+	}
+	return -1, false
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"math"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"modbus_test/decode"
+	"modbus_test/registermap"
+)
+
+// --- Cấu hình phát hiện reset/tràn bộ đếm điện năng ---
+const (
+	energyResetTimeRegister = "Accum_Energy_Reset_Time"
+	maxPlausiblePowerKW     = 5000.0 // Công suất lớn nhất có thể của phụ tải; chênh lệch vượt quá mức này bị coi là nhảy bất thường
+	plausibleJumpMargin     = 1.5    // Hệ số an toàn cho ngưỡng nhảy bất thường
+	minPlausibleJumpKWh     = 1.0    // Ngưỡng tối thiểu để tránh báo nhầm khi 2 lần đọc quá sát nhau
+	rolloverHighFraction    = 0.9    // Giá trị trước phải nằm ở 10% cuối dải đếm mới được coi là tràn
+)
+
+// Các loại sự kiện của bộ đếm.
+const (
+	counterEventReset     = "counter_reset"
+	counterEventResetTime = "reset_time_changed"
+	counterEventRollover  = "counter_rollover"
+	counterEventJump      = "counter_jump"
+)
+
+const counterEventMessage = "Energy Counter Event"
+
+// counterModulus trả về dải giá trị (đơn vị thô) của bộ đếm có độ rộng cố định theo kiểu dữ liệu.
+// Trả về false với kiểu không tràn trong thực tế (INT64...) hoặc không phải bộ đếm.
+func counterModulus(regType string) (float64, bool) {
+	switch regType {
+	case "INT16U":
+		return 1 << 16, true
+	case "INT32U":
+		return 1 << 32, true
+	case "INT48U":
+		return 1 << 48, true
+	case "BCD16":
+		return 1e4, true
+	case "BCD32", "INT32M10":
+		return 1e8, true
+	}
+	return 0, false
+}
+
+// checkResetTime phát hiện thời điểm reset bộ đếm (Accum_Energy_Reset_Time) thay đổi.
+// Khi thay đổi, toàn bộ mốc so sánh của các bộ đếm bị xóa để không tính chênh lệch qua lần reset.
+func (e *energyTracker) checkResetTime(data map[string]interface{}) {
+	resetTime, ok := data[energyResetTimeRegister].(string)
+	if !ok || resetTime == "" || decode.IsNA(resetTime) {
+		return
+	}
+	if _, quality := decode.Classify(resetTime); quality == decode.QualityError {
+		return
+	}
+	previous := e.state.ResetTime
+	e.state.ResetTime = resetTime
+	if previous == "" || previous == resetTime {
+		return
+	}
+	logrus.WithFields(logrus.Fields{
+		"event": counterEventResetTime, "register_name": energyResetTimeRegister, "previous": previous, "current": resetTime,
+	}).Warn(counterEventMessage)
+	for counter := range e.state.LastValues {
+		delete(e.state.LastValues, counter)
+	}
+}
+
+// counterDelta tính điện năng tiêu thụ (kWh) của một bộ đếm kể từ lần đọc trước, có xử lý
+// tràn bộ đếm, reset (chênh lệch âm) và nhảy bất thường. Trả về false nếu không có chênh lệch
+// hợp lệ; khi đó mốc so sánh được đặt lại theo giá trị hiện tại.
+func (e *energyTracker) counterDelta(counter string, raw float64, ts time.Time) (float64, bool) {
+	value := raw * energyCounterScale
+	last, seen := e.state.LastValues[counter]
+	lastTime := e.state.LastTimes[counter]
+	e.state.LastValues[counter] = value
+	e.state.LastTimes[counter] = ts
+	if !seen {
+		return 0, false
+	}
+	fields := logrus.Fields{"counter": counter, "previous": last, "current": value}
+
+	delta := value - last
+	if delta < 0 {
+		reg, _ := registermap.Find(registersToRead, counter)
+		modulus, fixedWidth := counterModulus(reg.Type)
+		modulus *= energyCounterScale
+		if fixedWidth && last >= modulus*rolloverHighFraction {
+			delta += modulus
+			fields["event"] = counterEventRollover
+			fields["modulus"] = modulus
+			logrus.WithFields(fields).Warn(counterEventMessage)
+		} else {
+			fields["event"] = counterEventReset
+			logrus.WithFields(fields).Warn(counterEventMessage)
+			return 0, false
+		}
+	}
+
+	elapsedHours := ts.Sub(lastTime).Hours()
+	if lastTime.IsZero() || elapsedHours < 0 {
+		elapsedHours = 0
+	}
+	maxDelta := math.Max(maxPlausiblePowerKW*elapsedHours*plausibleJumpMargin, minPlausibleJumpKWh)
+	if delta > maxDelta {
+		fields["event"] = counterEventJump
+		fields["delta"] = delta
+		fields["max_plausible_delta"] = maxDelta
+		fields["elapsed_s"] = math.Round(elapsedHours * 3600)
+		logrus.WithFields(fields).Warn(counterEventMessage)
+		return 0, false
+	}
+	return delta, true
+}
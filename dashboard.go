@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"sync"
+	"time"
+
+	"modbus_test/decode"
+	"modbus_test/sinks"
+)
+
+// --- Cấu hình giao diện web (dashboard) ---
+// Dashboard dùng chung HTTP server với REST API (apiListenAddr), nên chỉ chạy khi enableAPI = true.
+const (
+	enableDashboard         = true
+	dashboardHistoryPoints  = 120             // Số điểm gần nhất của mỗi thanh ghi dùng vẽ sparkline
+	dashboardStatusInterval = 2 * time.Second // Chu kỳ gửi trạng thái kết nối qua SSE (kể cả khi không đọc được)
+	dashboardClientBuffer   = 16              // Số sự kiện tối đa chờ gửi cho mỗi trình duyệt; đầy thì bỏ qua sự kiện mới
+	dashboardRetryMs        = 3000            // Thời gian trình duyệt chờ trước khi kết nối lại SSE
+)
+
+//go:embed dashboard
+var dashboardFiles embed.FS
+
+// dashboardEvent là nội dung một sự kiện SSE gửi tới trình duyệt.
+type dashboardEvent struct {
+	Status   PollerStatus         `json:"status"`
+	Readings []Reading            `json:"readings,omitempty"`
+	Alarms   []AlarmStatus        `json:"alarms"`
+	History  map[string][]float64 `json:"history,omitempty"` // Chỉ có trong sự kiện "snapshot"
+}
+
+// dashboardHub giữ lịch sử ngắn cho sparkline và phát sự kiện tới các trình duyệt đang mở.
+type dashboardHub struct {
+	mu      sync.Mutex
+	clients map[chan []byte]struct{}
+	history map[string][]float64
+	closed  bool
+}
+
+var dashboard = &dashboardHub{clients: make(map[chan []byte]struct{}), history: make(map[string][]float64)}
+
+func (h *dashboardHub) subscribe() chan []byte {
+	ch := make(chan []byte, dashboardClientBuffer)
+	h.mu.Lock()
+	if h.closed {
+		close(ch)
+	} else {
+		h.clients[ch] = struct{}{}
+	}
+	h.mu.Unlock()
+	return ch
+}
+
+func (h *dashboardHub) unsubscribe(ch chan []byte) {
+	h.mu.Lock()
+	delete(h.clients, ch)
+	h.mu.Unlock()
+}
+
+// closeAll đóng mọi luồng SSE để HTTP server tắt được ngay (kết nối SSE không bao giờ rảnh).
+func (h *dashboardHub) closeAll() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for ch := range h.clients {
+		close(ch)
+		delete(h.clients, ch)
+	}
+}
+
+func (h *dashboardHub) broadcast(msg []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.clients {
+		select {
+		case ch <- msg:
+		default: // Trình duyệt chậm: bỏ qua sự kiện, lần sau vẫn nhận giá trị mới nhất
+		}
+	}
+}
+
+// snapshot tạo sự kiện đầy đủ (giá trị gần nhất và lịch sử) cho trình duyệt vừa kết nối.
+func (h *dashboardHub) snapshot() dashboardEvent {
+	ev := dashboardEvent{Status: currentStatus(), Alarms: alarmSnapshot(), History: make(map[string][]float64)}
+	for _, name := range outputRegisterNames() {
+		if reading, ok := latestReading(name); ok {
+			ev.Readings = append(ev.Readings, reading)
+		}
+	}
+	h.mu.Lock()
+	for name, points := range h.history {
+		ev.History[name] = append([]float64(nil), points...)
+	}
+	h.mu.Unlock()
+	return ev
+}
+
+// sseMessage định dạng một sự kiện Server-Sent Events.
+func sseMessage(event string, v interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(fmt.Sprintf("event: %s\ndata: %s\n\n", event, data)), nil
+}
+
+// --- Sink dashboard: nhận kết quả mỗi chu kỳ từ vòng lặp đọc và phát tới trình duyệt ---
+type dashboardSink struct{}
+
+func (s *dashboardSink) Open() error { return nil }
+
+func (s *dashboardSink) Write(ctx context.Context, result sinks.CycleResult) error {
+	ev := dashboardEvent{Status: currentStatus(), Alarms: alarmSnapshot()}
+	dashboard.mu.Lock()
+	for _, name := range result.Names {
+		value, ok := result.Data[name]
+		if !ok {
+			continue
+		}
+		ev.Readings = append(ev.Readings, newReading(name, value, result.StartTime))
+		if v, quality := decode.Classify(value); quality == decode.QualityGood {
+			points := append(dashboard.history[name], v)
+			if len(points) > dashboardHistoryPoints {
+				points = points[len(points)-dashboardHistoryPoints:]
+			}
+			dashboard.history[name] = points
+		}
+	}
+	dashboard.mu.Unlock()
+	msg, err := sseMessage("cycle", ev)
+	if err != nil {
+		return err
+	}
+	dashboard.broadcast(msg)
+	return nil
+}
+
+func (s *dashboardSink) Flush(ctx context.Context) error { return nil }
+
+func (s *dashboardSink) Close(ctx context.Context) error { return nil }
+
+// registerDashboard gắn giao diện web (/) và luồng sự kiện SSE vào router của REST API.
+func registerDashboard(mux *http.ServeMux) {
+	static, err := fs.Sub(dashboardFiles, "dashboard")
+	if err != nil {
+		panic(err) // Thư mục được nhúng lúc biên dịch, không thể thiếu
+	}
+	mux.Handle("GET /", http.FileServerFS(static))
+	mux.HandleFunc("GET "+apiPrefix+"/devices/{device}/events", withDevice(handleDashboardEvents))
+}
+
+// handleDashboardEvents gửi sự kiện "snapshot" khi trình duyệt kết nối, sau đó "cycle" sau mỗi
+// chu kỳ đọc và "status" định kỳ để hiển thị tình trạng kết nối khi không đọc được thiết bị.
+func handleDashboardEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeAPIError(w, http.StatusInternalServerError, "server không hỗ trợ streaming")
+		return
+	}
+	ch := dashboard.subscribe()
+	defer dashboard.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	fmt.Fprintf(w, "retry: %d\n\n", dashboardRetryMs)
+	if msg, err := sseMessage("snapshot", dashboard.snapshot()); err == nil {
+		w.Write(msg)
+	}
+	flusher.Flush()
+
+	ticker := time.NewTicker(dashboardStatusInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case msg, ok := <-ch:
+			if !ok {
+				return
+			}
+			if _, err := w.Write(msg); err != nil {
+				return
+			}
+		case <-ticker.C:
+			msg, err := sseMessage("status", currentStatus())
+			if err != nil {
+				continue
+			}
+			if _, err := w.Write(msg); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,183 @@
+// Dashboard Modbus: nhận dữ liệu qua Server-Sent Events từ /api/v1/devices/{device}/events.
+"use strict";
+
+const API = "/api/v1";
+const HISTORY_POINTS = 120;   // Khớp dashboardHistoryPoints phía server
+const STALE_SECONDS = 10;     // Quá thời gian này không có chu kỳ mới thì coi dữ liệu là cũ
+
+const state = { status: null, readings: {}, history: {}, alarms: [], rows: {} };
+
+function $(id) { return document.getElementById(id); }
+
+function el(tag, cls, text) {
+  const e = document.createElement(tag);
+  if (cls) e.className = cls;
+  if (text !== undefined) e.textContent = text;
+  return e;
+}
+
+function formatValue(v) {
+  if (v === null || v === undefined) return "-";
+  if (typeof v === "number") return Number.isInteger(v) ? String(v) : v.toFixed(Math.abs(v) >= 1000 ? 1 : 3);
+  return String(v);
+}
+
+function formatAge(seconds) {
+  if (seconds < 60) return seconds.toFixed(0) + " giây trước";
+  if (seconds < 3600) return (seconds / 60).toFixed(0) + " phút trước";
+  return (seconds / 3600).toFixed(1) + " giờ trước";
+}
+
+function sparkline(points) {
+  const w = 100, h = 22;
+  const svg = document.createElementNS("http://www.w3.org/2000/svg", "svg");
+  svg.setAttribute("class", "spark");
+  svg.setAttribute("width", w);
+  svg.setAttribute("height", h);
+  if (!points || points.length < 2) return svg;
+  let min = Math.min(...points), max = Math.max(...points);
+  if (max === min) { max += 1; min -= 1; }
+  const coords = points.map((v, i) =>
+    (i * w / (points.length - 1)).toFixed(1) + "," + (h - 1 - (v - min) * (h - 2) / (max - min)).toFixed(1));
+  const line = document.createElementNS("http://www.w3.org/2000/svg", "polyline");
+  line.setAttribute("points", coords.join(" "));
+  svg.appendChild(line);
+  return svg;
+}
+
+// Tạo bảng theo nhóm thanh ghi (Voltage, Current...) lần đầu nhận dữ liệu hoặc khi có thanh ghi mới.
+function ensureRow(reading) {
+  if (state.rows[reading.register]) return state.rows[reading.register];
+  const groupId = "group-" + reading.group;
+  let table = document.querySelector("#" + CSS.escape(groupId) + " tbody");
+  if (!table) {
+    const box = el("div", "group");
+    box.id = groupId;
+    box.appendChild(el("h2", "", reading.group));
+    const t = el("table");
+    table = el("tbody");
+    t.appendChild(table);
+    box.appendChild(t);
+    $("groups").appendChild(box);
+  }
+  const tr = el("tr");
+  const row = {
+    tr: tr,
+    name: el("td", "name", reading.register),
+    value: el("td", "value"),
+    unit: el("td", "unit", reading.unit || ""),
+    spark: el("td", "spark"),
+  };
+  tr.append(row.name, row.value, row.unit, row.spark);
+  table.appendChild(tr);
+  state.rows[reading.register] = row;
+  return row;
+}
+
+function renderReading(reading) {
+  const row = ensureRow(reading);
+  row.value.textContent = formatValue(reading.value);
+  row.tr.className = reading.quality === "good" ? "" : reading.quality;
+  row.tr.title = "Cập nhật lúc " + new Date(reading.timestamp).toLocaleString();
+  row.spark.replaceChildren(sparkline(state.history[reading.register]));
+}
+
+function renderAlarms() {
+  const box = $("alarms");
+  box.replaceChildren();
+  const active = new Set();
+  for (const a of state.alarms) {
+    if (a.active) active.add(a.register);
+    const div = el("div", "alarm " + a.severity + (a.active ? "" : " cleared"));
+    div.textContent = (a.active ? "⚠ " : "✓ ") + a.severity + " " + a.id +
+      (a.active ? " (từ " + new Date(a.raised_at).toLocaleTimeString() + ")" : " (đã hết, chưa xác nhận)");
+    box.appendChild(div);
+  }
+  for (const [name, row] of Object.entries(state.rows)) {
+    row.name.classList.toggle("alarm-active", active.has(name));
+    row.tr.classList.toggle("alarm-active", active.has(name));
+  }
+}
+
+function renderStatus() {
+  const s = state.status;
+  if (!s) return;
+  $("device").textContent = s.device + " (" + s.port + ", slave " + s.slave_id + ")";
+  $("cycles").textContent = s.read_cycles;
+  $("duration").textContent = s.last_read_duration_ms + " ms";
+  $("okerr").textContent = s.registers_ok + "/" + s.registers_error;
+  $("reconnects").textContent = s.reconnects;
+  $("connerr").textContent = s.last_connect_error ? "Lỗi kết nối: " + s.last_connect_error : "";
+  renderAge();
+}
+
+// Tuổi dữ liệu và tình trạng kết nối được cập nhật mỗi giây, kể cả khi không có sự kiện mới.
+function renderAge() {
+  const s = state.status;
+  const badge = $("conn");
+  if (!s) return;
+  const age = s.last_cycle_at ? (Date.now() - new Date(s.last_cycle_at).getTime()) / 1000 : null;
+  $("age").textContent = age === null ? "chưa có" : formatAge(Math.max(0, age));
+  if (!s.connected) {
+    badge.className = "badge down";
+    badge.textContent = "Mất kết nối";
+  } else if (age === null || age > STALE_SECONDS) {
+    badge.className = "badge stale";
+    badge.textContent = "Dữ liệu cũ";
+  } else {
+    badge.className = "badge ok";
+    badge.textContent = "Đã kết nối";
+  }
+}
+
+function applyReadings(readings, appendHistory) {
+  for (const r of readings || []) {
+    state.readings[r.register] = r;
+    if (appendHistory && r.quality === "good" && typeof r.value === "number") {
+      const h = state.history[r.register] || (state.history[r.register] = []);
+      h.push(r.value);
+      if (h.length > HISTORY_POINTS) h.splice(0, h.length - HISTORY_POINTS);
+    }
+    renderReading(r);
+  }
+}
+
+function connect(device) {
+  const source = new EventSource(API + "/devices/" + encodeURIComponent(device) + "/events");
+  source.addEventListener("snapshot", (e) => {
+    const ev = JSON.parse(e.data);
+    state.status = ev.status;
+    state.history = ev.history || {};
+    state.alarms = ev.alarms || [];
+    applyReadings(ev.readings, false);
+    renderAlarms();
+    renderStatus();
+  });
+  source.addEventListener("cycle", (e) => {
+    const ev = JSON.parse(e.data);
+    state.status = ev.status;
+    state.alarms = ev.alarms || [];
+    applyReadings(ev.readings, true);
+    renderAlarms();
+    renderStatus();
+  });
+  source.addEventListener("status", (e) => {
+    state.status = JSON.parse(e.data);
+    renderStatus();
+  });
+  source.onerror = () => {
+    const badge = $("conn");
+    badge.className = "badge down";
+    badge.textContent = "Mất kết nối tới server";
+  };
+}
+
+fetch(API + "/devices")
+  .then((r) => r.json())
+  .then((devices) => {
+    if (!devices.length) throw new Error("không có thiết bị");
+    connect(devices[0].id);
+  })
+  .catch((err) => { $("connerr").textContent = "Lỗi tải danh sách thiết bị: " + err.message; });
+
+setInterval(renderAge, 1000);
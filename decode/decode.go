@@ -0,0 +1,340 @@
+// Package decode giải mã bytes thanh ghi Modbus thành giá trị (số, chuỗi, thời gian, Power
+// Factor) và mã hóa ngược cho lệnh ghi. Giá trị lỗi và N/A được biểu diễn bằng chuỗi đánh dấu.
+package decode
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf16"
+
+	"github.com/sirupsen/logrus"
+
+	"modbus_test/registermap"
+)
+
+// Decode giải mã bytes đọc được (Big Endian) theo kiểu của thanh ghi. Giá trị N/A của thiết bị
+// được trả về dạng chuỗi "N/A_<kiểu>", dữ liệu không hợp lệ dạng "INVALID_..."; error chỉ trả
+// về khi độ dài dữ liệu không khớp với kiểu.
+func Decode(data []byte, regInfo registermap.Register) (interface{}, error) {
+	byteOrder := binary.BigEndian
+	logrus.WithFields(logrus.Fields{
+		"register_name": regInfo.Name, "data_type": regInfo.Type,
+		"raw_bytes_hex": fmt.Sprintf("%x", data), "byte_length": len(data),
+	}).Debug("Giải mã dữ liệu thanh ghi")
+
+	switch regInfo.Type {
+	case "FLOAT32":
+		if len(data) != 4 {
+			return nil, fmt.Errorf("FLOAT32 cần 4 bytes, nhận %d", len(data))
+		}
+		bits := byteOrder.Uint32(data)
+		if bits == 0xFFC00000 {
+			return "N/A_FLOAT32", nil
+		}
+		return math.Float32frombits(bits), nil
+	case "INT16U":
+		if len(data) != 2 {
+			return nil, fmt.Errorf("INT16U cần 2 bytes, nhận %d", len(data))
+		}
+		val := byteOrder.Uint16(data)
+		if val == 0xFFFF {
+			return "N/A_INT16U", nil
+		}
+		return val, nil
+	case "INT16":
+		if len(data) != 2 {
+			return nil, fmt.Errorf("INT16 cần 2 bytes, nhận %d", len(data))
+		}
+		val := byteOrder.Uint16(data)
+		if val == 0x8000 {
+			return "N/A_INT16", nil
+		}
+		return int16(val), nil
+	case "INT32U":
+		if len(data) != 4 {
+			return nil, fmt.Errorf("INT32U cần 4 bytes, nhận %d", len(data))
+		}
+		val := byteOrder.Uint32(data)
+		if val == 0xFFFFFFFF {
+			return "N/A_INT32U", nil
+		}
+		return val, nil
+	case "INT32":
+		if len(data) != 4 {
+			return nil, fmt.Errorf("INT32 cần 4 bytes, nhận %d", len(data))
+		}
+		val := byteOrder.Uint32(data)
+		if val == 0x80000000 {
+			return "N/A_INT32", nil
+		}
+		return int32(val), nil
+	case "INT64":
+		if len(data) != 8 {
+			return nil, fmt.Errorf("INT64 cần 8 bytes, nhận %d", len(data))
+		}
+		val := byteOrder.Uint64(data)
+		if val == 0x8000000000000000 {
+			return "N/A_INT64", nil
+		}
+		return int64(val), nil
+	case "INT64U":
+		if len(data) != 8 {
+			return nil, fmt.Errorf("INT64U cần 8 bytes, nhận %d", len(data))
+		}
+		val := byteOrder.Uint64(data)
+		if val == 0xFFFFFFFFFFFFFFFF {
+			return "N/A_INT64U", nil
+		}
+		return val, nil
+	case "INT48", "INT48U": // 3 thanh ghi, word cao trước
+		if len(data) != 6 {
+			return nil, fmt.Errorf("%s cần 6 bytes, nhận %d", regInfo.Type, len(data))
+		}
+		val := uint64(byteOrder.Uint16(data[0:2]))<<32 | uint64(byteOrder.Uint32(data[2:6]))
+		if regInfo.Type == "INT48U" {
+			if val == 0xFFFFFFFFFFFF {
+				return "N/A_INT48U", nil
+			}
+			return val, nil
+		}
+		if val == 0x800000000000 {
+			return "N/A_INT48", nil
+		}
+		return int64(val<<16) >> 16, nil // Mở rộng dấu từ bit 47
+	case "INT8_HI", "INT8_LO", "INT8U_HI", "INT8U_LO": // 2 giá trị 8-bit đóng gói trong 1 thanh ghi
+		if len(data) != 2 {
+			return nil, fmt.Errorf("%s cần 2 bytes, nhận %d", regInfo.Type, len(data))
+		}
+		b := data[1]
+		if strings.HasSuffix(regInfo.Type, "_HI") {
+			b = data[0]
+		}
+		if strings.HasPrefix(regInfo.Type, "INT8U") {
+			if b == 0xFF {
+				return "N/A_" + regInfo.Type, nil
+			}
+			return uint8(b), nil
+		}
+		if b == 0x80 {
+			return "N/A_" + regInfo.Type, nil
+		}
+		return int8(b), nil
+	case "BCD16", "BCD32": // Mỗi nibble là một chữ số thập phân
+		expectedLen := 2
+		if regInfo.Type == "BCD32" {
+			expectedLen = 4
+		}
+		if len(data) != expectedLen {
+			return nil, fmt.Errorf("%s cần %d bytes, nhận %d", regInfo.Type, expectedLen, len(data))
+		}
+		allFF := true
+		for _, b := range data {
+			if b != 0xFF {
+				allFF = false
+				break
+			}
+		}
+		if allFF {
+			return "N/A_" + regInfo.Type, nil
+		}
+		val, ok := decodeBCD(data)
+		if !ok {
+			logrus.WithFields(logrus.Fields{"register_name": regInfo.Name, "raw_bytes_hex": fmt.Sprintf("%x", data)}).Warn("Giá trị BCD chứa nibble không hợp lệ (> 9)")
+			return fmt.Sprintf("INVALID_BCD(%x)", data), nil
+		}
+		return val, nil
+	case "INT32M10", "INT64M10": // Schneider MOD10: mỗi thanh ghi chứa 4 chữ số (-9999..9999), word cao trước
+		expectedLen := 4
+		if regInfo.Type == "INT64M10" {
+			expectedLen = 8
+		}
+		if len(data) != expectedLen {
+			return nil, fmt.Errorf("%s cần %d bytes, nhận %d", regInfo.Type, expectedLen, len(data))
+		}
+		if byteOrder.Uint16(data[0:2]) == 0x8000 {
+			return "N/A_" + regInfo.Type, nil
+		}
+		val, ok := decodeMod10(data)
+		if !ok {
+			logrus.WithFields(logrus.Fields{"register_name": regInfo.Name, "raw_bytes_hex": fmt.Sprintf("%x", data)}).Warn("Giá trị MOD10 có thanh ghi ngoài khoảng -9999..9999")
+			return fmt.Sprintf("INVALID_MOD10(%x)", data), nil
+		}
+		return val, nil
+	case "FLOAT64":
+		if len(data) != 8 {
+			return nil, fmt.Errorf("FLOAT64 cần 8 bytes, nhận %d", len(data))
+		}
+		bits := byteOrder.Uint64(data)
+		if bits == 0xFFF8000000000000 {
+			return "N/A_FLOAT64", nil
+		}
+		return math.Float64frombits(bits), nil
+	case "UTF8", "UTF8_SWAP", "ASCII", "ASCII_SWAP", "LATIN1", "LATIN1_SWAP", "UTF16", "UTF16_SWAP", "UTF16LE":
+		return decodeString(data, regInfo)
+	case "DATETIME": // IEC 870-5-4
+		if len(data) != 8 {
+			return nil, fmt.Errorf("DATETIME IEC 870-5-4 cần 8 bytes, nhận %d", len(data))
+		}
+		if byteOrder.Uint64(data) == 0xFFFFFFFFFFFFFFFF {
+			return "N/A_DATETIME", nil
+		}
+		word1 := byteOrder.Uint16(data[0:2])
+		word2 := byteOrder.Uint16(data[2:4])
+		word3 := byteOrder.Uint16(data[4:6])
+		word4 := byteOrder.Uint16(data[6:8])
+		year7bit := int(word1 & 0x7F)
+		year := 2000 + year7bit
+		day := int((word2 >> 0) & 0x1F)
+		month := int((word2 >> 8) & 0x0F)
+		minute := int((word3 >> 0) & 0x3F)
+		hour := int((word3 >> 8) & 0x1F)
+		millisecond := int(word4)
+		logrus.WithFields(logrus.Fields{"register_name": regInfo.Name, "year": year, "month": month, "day": day, "hour": hour, "minute": minute, "millisecond": millisecond, "raw_bytes_hex": fmt.Sprintf("%x", data)}).Debug("Giải mã DATETIME (IEC 870-5-4)")
+		if month == 0 || month > 12 || day == 0 || day > 31 || hour > 23 || minute > 59 || millisecond > 59999 || year < 1970 || year > 2127 {
+			logrus.WithFields(logrus.Fields{"register_name": regInfo.Name, "year": year, "month": month, "day": day, "hour": hour, "minute": minute, "millisecond": millisecond}).Warn("Giá trị DATETIME (IEC) đọc được không hợp lệ")
+			return fmt.Sprintf("INVALID_IEC_DATE(Y:%d M:%d D:%d)", year, month, day), nil
+		}
+		dt := time.Date(year, time.Month(month), day, hour, minute, 0, millisecond*1000000, time.Local)
+		return dt.Format("2006-01-02 15:04:00.000"), nil
+	case "PF_4Q_F32", "PF_IEC_F32", "PF_IEEE_F32", "PF_IEC_I16", "PF_IEEE_I16":
+		return decodePowerFactor(data, regInfo)
+	case "CUSTOM_PF": // Length=2 (4 bytes)
+		if len(data) != 4 {
+			return nil, fmt.Errorf("CUSTOM_PF cần 4 bytes (Length=2), nhận %d", len(data))
+		}
+		rawValue := byteOrder.Uint16(data[0:2])
+		signedValue := int16(rawValue)
+		scalingFactor := 10000.0 // !!! Giả định !!!
+		regValFloat := float64(signedValue) / scalingFactor
+		logrus.WithFields(logrus.Fields{"register_name": regInfo.Name, "raw_uint16_used": rawValue, "ignored_bytes_hex": fmt.Sprintf("%x", data[2:4]), "scaled_float": regValFloat, "scaling_factor_assumed": scalingFactor}).Debug("Giải mã CUSTOM_PF (Dùng 2 byte đầu / Length=2, Scaling Factor là giả định)")
+		var pfValue float64
+		epsilon := 0.00001
+		if regValFloat > 1.0 {
+			pfValue = 2.0 - regValFloat
+		} else if regValFloat < -1.0 {
+			pfValue = -2.0 - regValFloat
+		} else if math.Abs(regValFloat-1.0) < epsilon || math.Abs(regValFloat-(-1.0)) < epsilon {
+			pfValue = regValFloat
+		} else {
+			pfValue = regValFloat
+		}
+		return pfValue, nil
+	default:
+		logrus.Warnf("Kiểu dữ liệu '%s' cho thanh ghi '%s' chưa được hỗ trợ giải mã.", regInfo.Type, regInfo.Name)
+		return fmt.Sprintf("UNSUPPORTED_TYPE(%s)", regInfo.Type), nil
+	}
+}
+
+// decodeString giải mã các kiểu chuỗi. Tên kiểu gồm bảng mã (UTF8, ASCII, LATIN1, UTF16)
+// và hậu tố "_SWAP" nếu thiết bị lưu 2 byte trong mỗi thanh ghi theo thứ tự đảo ngược
+// ("UTF16LE" tương đương "UTF16_SWAP"). Chuỗi được cắt tại ký tự NUL đầu tiên và bỏ
+// khoảng trắng đệm ở hai đầu.
+func decodeString(data []byte, regInfo registermap.Register) (interface{}, error) {
+	encoding := strings.TrimSuffix(regInfo.Type, "_SWAP")
+	byteSwap := encoding != regInfo.Type
+	if encoding == "UTF16LE" {
+		encoding, byteSwap = "UTF16", true
+	}
+
+	expectedLen := int(regInfo.Length) * 2
+	if len(data) != expectedLen {
+		if len(data) > expectedLen || len(data)%2 != 0 {
+			return nil, fmt.Errorf("%s length %d cần %d bytes (hoặc ít hơn, chẵn), nhận %d", regInfo.Type, regInfo.Length, expectedLen, len(data))
+		}
+		logrus.WithFields(logrus.Fields{"register_name": regInfo.Name, "expected_bytes": expectedLen, "received_bytes": len(data)}).Warnf("%s nhận được ít byte hơn mong đợi", regInfo.Type)
+	}
+	isGarbled := len(data) >= 2
+	for i := 0; i+1 < len(data); i += 2 {
+		if binary.BigEndian.Uint16(data[i:i+2]) != 0x8000 {
+			isGarbled = false
+			break
+		}
+	}
+	if isGarbled {
+		logrus.WithFields(logrus.Fields{"register_name": regInfo.Name, "raw_bytes_hex": fmt.Sprintf("%x", data)}).Warnf("Phát hiện dữ liệu %s không hợp lệ (pattern 0x8000)", encoding)
+		return fmt.Sprintf("INVALID_%s_DATA", encoding), nil
+	}
+
+	raw := data
+	if byteSwap {
+		raw = make([]byte, len(data))
+		for i := 0; i+1 < len(data); i += 2 {
+			raw[i], raw[i+1] = data[i+1], data[i]
+		}
+	}
+
+	var decodedString string
+	switch encoding {
+	case "UTF8":
+		decodedString = string(raw)
+	case "ASCII":
+		runes := make([]rune, len(raw))
+		for i, b := range raw {
+			if b > 0x7F {
+				runes[i] = '\uFFFD'
+			} else {
+				runes[i] = rune(b)
+			}
+		}
+		decodedString = string(runes)
+	case "LATIN1":
+		runes := make([]rune, len(raw))
+		for i, b := range raw {
+			runes[i] = rune(b)
+		}
+		decodedString = string(runes)
+	case "UTF16":
+		words := make([]uint16, len(raw)/2)
+		for i := range words {
+			words[i] = binary.BigEndian.Uint16(raw[2*i : 2*i+2])
+		}
+		decodedString = string(utf16.Decode(words))
+	}
+	if idx := strings.IndexRune(decodedString, 0); idx >= 0 {
+		decodedString = decodedString[:idx]
+	}
+	decodedString = strings.Trim(decodedString, " ")
+
+	invalidCount := 0
+	for _, r := range decodedString {
+		if r == '\uFFFD' || !unicode.IsPrint(r) {
+			invalidCount++
+		}
+	}
+	if invalidCount > 0 {
+		logrus.WithFields(logrus.Fields{"register_name": regInfo.Name, "raw_bytes_hex": fmt.Sprintf("%x", data), "decoded_string": decodedString, "invalid_chars": invalidCount}).Warnf("Chuỗi %s giải mã chứa ký tự không hợp lệ hoặc không in được", regInfo.Type)
+	}
+	return decodedString, nil
+}
+
+// decodeBCD chuyển chuỗi byte BCD (nibble cao trước) thành số nguyên.
+// Trả về false nếu có nibble lớn hơn 9.
+func decodeBCD(data []byte) (uint64, bool) {
+	var val uint64
+	for _, b := range data {
+		hi, lo := b>>4, b&0x0F
+		if hi > 9 || lo > 9 {
+			return 0, false
+		}
+		val = val*100 + uint64(hi)*10 + uint64(lo)
+	}
+	return val, true
+}
+
+// decodeMod10 ghép các thanh ghi MOD10 (mỗi thanh ghi là int16 trong khoảng -9999..9999,
+// thanh ghi đầu là phần cao nhất) thành một số nguyên.
+func decodeMod10(data []byte) (int64, bool) {
+	var val int64
+	for i := 0; i+1 < len(data); i += 2 {
+		word := int64(int16(binary.BigEndian.Uint16(data[i : i+2])))
+		if word > 9999 || word < -9999 {
+			return 0, false
+		}
+		val = val*10000 + word
+	}
+	return val, true
+}
@@ -0,0 +1,258 @@
+package decode
+
+import (
+	"encoding/hex"
+	"math"
+	"reflect"
+	"testing"
+
+	"modbus_test/registermap"
+)
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatalf("hex '%s' không hợp lệ: %v", s, err)
+	}
+	return b
+}
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		typ    string
+		length uint16
+		hex    string
+		want   interface{}
+	}{
+		{"FLOAT32", 2, "3fc00000", float32(1.5)},
+		{"FLOAT32", 2, "ffc00000", "N/A_FLOAT32"},
+		{"FLOAT64", 4, "3ff8000000000000", 1.5},
+		{"FLOAT64", 4, "fff8000000000000", "N/A_FLOAT64"},
+		{"INT16U", 1, "1234", uint16(0x1234)},
+		{"INT16U", 1, "ffff", "N/A_INT16U"},
+		{"INT16", 1, "fffe", int16(-2)},
+		{"INT16", 1, "8000", "N/A_INT16"},
+		{"INT32U", 2, "00010002", uint32(65538)},
+		{"INT32U", 2, "ffffffff", "N/A_INT32U"},
+		{"INT32", 2, "ffffffff", int32(-1)},
+		{"INT32", 2, "80000000", "N/A_INT32"},
+		{"INT64", 4, "fffffffffffffffe", int64(-2)},
+		{"INT64", 4, "8000000000000000", "N/A_INT64"},
+		{"INT64U", 4, "0000000000000100", uint64(256)},
+		{"INT64U", 4, "ffffffffffffffff", "N/A_INT64U"},
+		{"INT48", 3, "ffffffffffff", int64(-1)},
+		{"INT48", 3, "000100000002", int64(1<<32 + 2)},
+		{"INT48", 3, "800000000000", "N/A_INT48"},
+		{"INT48U", 3, "000100000002", uint64(1<<32 + 2)},
+		{"INT48U", 3, "ffffffffffff", "N/A_INT48U"},
+		{"INT8_HI", 1, "fe01", int8(-2)},
+		{"INT8_LO", 1, "fe01", int8(1)},
+		{"INT8_HI", 1, "8001", "N/A_INT8_HI"},
+		{"INT8U_HI", 1, "fe01", uint8(254)},
+		{"INT8U_LO", 1, "01ff", "N/A_INT8U_LO"},
+		{"BCD16", 1, "1234", uint64(1234)},
+		{"BCD16", 1, "ffff", "N/A_BCD16"},
+		{"BCD16", 1, "1a34", "INVALID_BCD(1a34)"},
+		{"BCD32", 2, "12345678", uint64(12345678)},
+		{"INT32M10", 2, "00010002", int64(10002)},
+		{"INT32M10", 2, "80000000", "N/A_INT32M10"},
+		{"INT32M10", 2, "27100000", "INVALID_MOD10(27100000)"},
+		{"INT64M10", 4, "0001000000000005", int64(1000000000005)},
+		{"UTF8", 2, "41420000", "AB"},
+		{"UTF8", 4, "4142", "AB"}, // Thiết bị trả về ít thanh ghi hơn: vẫn giải mã
+		{"UTF8_SWAP", 2, "42410000", "AB"},
+		{"UTF8", 2, "80008000", "INVALID_UTF8_DATA"},
+		{"ASCII", 2, "20486920", "Hi"},
+		{"ASCII_SWAP", 1, "6948", "Hi"},
+		{"LATIN1", 1, "e900", "é"},
+		{"LATIN1_SWAP", 1, "00e9", "é"},
+		{"UTF16", 2, "00410042", "AB"},
+		{"UTF16_SWAP", 2, "41004200", "AB"},
+		{"UTF16LE", 2, "41004200", "AB"},
+		{"DATETIME", 4, "00180a130c1e0000", "2024-10-19 12:30:00.000"},
+		{"DATETIME", 4, "ffffffffffffffff", "N/A_DATETIME"},
+		{"DATETIME", 4, "001800130c1e0000", "INVALID_IEC_DATE(Y:2024 M:0 D:19)"},
+		{"PF_4Q_F32", 2, "3f000000", PowerFactor{Value: 0.5, Magnitude: 0.5, LeadLag: "LAG", Quadrant: 1}},
+		{"PF_4Q_F32", 2, "bf000000", PowerFactor{Value: -0.5, Magnitude: 0.5, LeadLag: "LEAD", Quadrant: 2}},
+		{"PF_4Q_F32", 2, "bfc00000", PowerFactor{Value: -0.5, Magnitude: 0.5, LeadLag: "LAG", Quadrant: 3}},
+		{"PF_4Q_F32", 2, "3fc00000", PowerFactor{Value: 0.5, Magnitude: 0.5, LeadLag: "LEAD", Quadrant: 4}},
+		{"PF_4Q_F32", 2, "40200000", "INVALID_PF(2.5)"},
+		{"PF_4Q_F32", 2, "ffc00000", "N/A_PF_4Q_F32"},
+		{"PF_IEC_F32", 2, "bf000000", PowerFactor{Value: -0.5, Magnitude: 0.5}},
+		{"PF_IEEE_F32", 2, "3f000000", PowerFactor{Value: 0.5, Magnitude: 0.5, LeadLag: "LAG"}},
+		{"PF_IEC_I16", 1, "03b6", PowerFactor{Value: 0.95, Magnitude: 0.95}},
+		{"PF_IEEE_I16", 1, "fc4a", PowerFactor{Value: -0.95, Magnitude: 0.95, LeadLag: "LEAD"}},
+		{"PF_IEEE_I16", 1, "8000", "N/A_PF_IEEE_I16"},
+		{"CUSTOM_PF", 2, "23280000", 0.9},
+		{"CUSTOM_PF", 2, "3a980000", 0.5},
+		{"FOO", 1, "0000", "UNSUPPORTED_TYPE(FOO)"},
+	}
+	for _, tt := range tests {
+		reg := registermap.Register{Name: "R", Address: 1, Type: tt.typ, Length: tt.length}
+		got, err := Decode(mustHex(t, tt.hex), reg)
+		if err != nil {
+			t.Errorf("Decode(%s, %s) lỗi: %v", tt.typ, tt.hex, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Decode(%s, %s) = %#v, cần %#v", tt.typ, tt.hex, got, tt.want)
+		}
+	}
+}
+
+// PF kiểu *_I16 dùng Scale của thanh ghi; Scale = 0 dùng PFInt16Scale.
+func TestPowerFactorScale(t *testing.T) {
+	tests := []struct {
+		typ   string
+		scale float64
+		hex   string
+		want  float64
+	}{
+		{"PF_IEC_I16", 0, "03b6", 0.95},
+		{"PF_IEC_I16", 10000, "251c", 0.95},
+		{"PF_IEEE_I16", 100, "ffa1", -0.95},
+	}
+	for _, tt := range tests {
+		reg := registermap.Register{Name: "R", Address: 1, Type: tt.typ, Length: 1, Scale: tt.scale}
+		got, err := Decode(mustHex(t, tt.hex), reg)
+		if pf, ok := got.(PowerFactor); err != nil || !ok || pf.Value != tt.want {
+			t.Errorf("Decode(%s, %s, scale %v) = %#v, %v; cần PF %v", tt.typ, tt.hex, tt.scale, got, err, tt.want)
+			continue
+		}
+		data, err := EncodeNumber(tt.want, reg)
+		if err != nil || hex.EncodeToString(data) != tt.hex {
+			t.Errorf("EncodeNumber(%v, %s, scale %v) = %x, %v; cần %s", tt.want, tt.typ, tt.scale, data, err, tt.hex)
+		}
+	}
+}
+
+// PF IEC/IEEE được bổ sung lead/lag và góc phần tư từ dấu của P và Q.
+func TestPowerFactorWithPowerSigns(t *testing.T) {
+	nan := math.NaN()
+	tests := []struct {
+		name string
+		pf   PowerFactor
+		p, q float64
+		want PowerFactor
+	}{
+		{"IEC Q1", PowerFactor{Value: 0.9}, 10, 5, PowerFactor{Value: 0.9, LeadLag: "LAG", Quadrant: 1}},
+		{"IEC Q2", PowerFactor{Value: -0.9}, -10, 5, PowerFactor{Value: -0.9, LeadLag: "LEAD", Quadrant: 2}},
+		{"IEC Q3, P lỗi", PowerFactor{Value: -0.9}, nan, -5, PowerFactor{Value: -0.9, LeadLag: "LAG", Quadrant: 3}},
+		{"IEC Q4", PowerFactor{Value: 0.9}, 10, -5, PowerFactor{Value: 0.9, LeadLag: "LEAD", Quadrant: 4}},
+		{"IEC, Q lỗi", PowerFactor{Value: 0.9}, 10, nan, PowerFactor{Value: 0.9}},
+		{"IEEE Q1", PowerFactor{Value: 0.9, LeadLag: "LAG"}, 10, nan, PowerFactor{Value: 0.9, LeadLag: "LAG", Quadrant: 1}},
+		{"IEEE Q2", PowerFactor{Value: -0.9, LeadLag: "LEAD"}, -10, nan, PowerFactor{Value: -0.9, LeadLag: "LEAD", Quadrant: 2}},
+		{"IEEE Q3", PowerFactor{Value: 0.9, LeadLag: "LAG"}, -10, 0, PowerFactor{Value: 0.9, LeadLag: "LAG", Quadrant: 3}},
+		{"IEEE Q4", PowerFactor{Value: -0.9, LeadLag: "LEAD"}, 10, 0, PowerFactor{Value: -0.9, LeadLag: "LEAD", Quadrant: 4}},
+		{"IEEE, P lỗi", PowerFactor{Value: 0.9, LeadLag: "LAG"}, nan, 5, PowerFactor{Value: 0.9, LeadLag: "LAG"}},
+		{"4Q giữ nguyên", PowerFactor{Value: 0.5, LeadLag: "LEAD", Quadrant: 4}, -10, 5, PowerFactor{Value: 0.5, LeadLag: "LEAD", Quadrant: 4}},
+	}
+	for _, tt := range tests {
+		if got := tt.pf.WithPowerSigns(tt.p, tt.q); got != tt.want {
+			t.Errorf("%s: WithPowerSigns(%v, %v) = %#v, cần %#v", tt.name, tt.p, tt.q, got, tt.want)
+		}
+	}
+}
+
+// Độ dài dữ liệu không khớp với kiểu là lỗi (poller ghi DECODE_ERROR).
+func TestDecodeLengthError(t *testing.T) {
+	tests := []struct {
+		typ    string
+		length uint16
+		hex    string
+	}{
+		{"FLOAT32", 1, "3fc0"},
+		{"FLOAT64", 2, "3ff80000"},
+		{"INT16U", 2, "00000000"},
+		{"INT16", 2, "00000000"},
+		{"INT32U", 1, "0000"},
+		{"INT32", 1, "0000"},
+		{"INT64", 2, "00000000"},
+		{"INT64U", 2, "00000000"},
+		{"INT48", 2, "00000000"},
+		{"INT48U", 4, "0000000000000000"},
+		{"INT8_HI", 2, "00000000"},
+		{"INT8U_LO", 0, ""},
+		{"BCD16", 2, "00000000"},
+		{"BCD32", 1, "0000"},
+		{"INT32M10", 1, "0000"},
+		{"INT64M10", 2, "00000000"},
+		{"UTF8", 1, "41424344"}, // Nhiều byte hơn Length
+		{"UTF16", 2, "004100"},  // Số byte lẻ
+		{"DATETIME", 2, "00180a13"},
+		{"PF_4Q_F32", 1, "3f00"},
+		{"PF_IEEE_I16", 2, "00000000"},
+		{"CUSTOM_PF", 1, "2328"},
+	}
+	for _, tt := range tests {
+		reg := registermap.Register{Name: "R", Address: 1, Type: tt.typ, Length: tt.length}
+		if got, err := Decode(mustHex(t, tt.hex), reg); err == nil {
+			t.Errorf("Decode(%s, %s) = %#v, cần lỗi độ dài", tt.typ, tt.hex, got)
+		}
+	}
+}
+
+func TestSentinels(t *testing.T) {
+	tests := []struct {
+		value   interface{}
+		isError bool
+		isNA    bool
+		quality Quality
+	}{
+		{ReadError, true, false, QualityError},
+		{LengthError, true, false, QualityError},
+		{DecodeError, true, false, QualityError},
+		{InvalidAddrCfg, true, false, QualityError},
+		{"INVALID_BCD(1a34)", true, false, QualityError},
+		{"N/A_INT16U", false, true, QualityNA},
+		{"UNSUPPORTED_TYPE(FOO)", false, false, QualityNA},
+		{"Model X", false, false, QualityNA},
+		{nil, false, false, QualityError},
+		{float32(1.5), false, false, QualityGood},
+		{PowerFactor{Value: 0.5}, false, false, QualityGood},
+	}
+	for _, tt := range tests {
+		if got := IsError(tt.value); got != tt.isError {
+			t.Errorf("IsError(%#v) = %v, cần %v", tt.value, got, tt.isError)
+		}
+		if got := IsNA(tt.value); got != tt.isNA {
+			t.Errorf("IsNA(%#v) = %v, cần %v", tt.value, got, tt.isNA)
+		}
+		if _, got := Classify(tt.value); got != tt.quality {
+			t.Errorf("Classify(%#v) = %v, cần %v", tt.value, got, tt.quality)
+		}
+	}
+}
+
+// Giá trị mã hóa bằng Encode phải giải mã lại đúng giá trị ban đầu.
+func TestEncodeRoundTrip(t *testing.T) {
+	tests := []struct {
+		typ    string
+		length uint16
+		text   string
+		want   interface{}
+	}{
+		{"FLOAT32", 2, "230.5", float32(230.5)},
+		{"FLOAT64", 4, "-1.25", -1.25},
+		{"INT16U", 1, "50000", uint16(50000)},
+		{"INT16", 1, "-123", int16(-123)},
+		{"INT32U", 2, "4000000000", uint32(4000000000)},
+		{"INT32", 2, "-70000", int32(-70000)},
+		{"INT64", 4, "-5000000000", int64(-5000000000)},
+		{"INT64U", 4, "5000000000", uint64(5000000000)},
+		{"UTF8", 4, "Meter", "Meter"},
+	}
+	for _, tt := range tests {
+		reg := registermap.Register{Name: "R", Address: 1, Type: tt.typ, Length: tt.length}
+		data, err := Encode(tt.text, reg)
+		if err != nil {
+			t.Errorf("Encode(%s, %s) lỗi: %v", tt.text, tt.typ, err)
+			continue
+		}
+		got, err := Decode(data, reg)
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Decode(Encode(%s, %s)) = %#v, %v; cần %#v", tt.text, tt.typ, got, err, tt.want)
+		}
+	}
+}
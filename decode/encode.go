@@ -0,0 +1,133 @@
+package decode
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"modbus_test/registermap"
+)
+
+// integerTypes: số byte và dấu của các kiểu số nguyên ghi được.
+var integerTypes = map[string]struct {
+	Bytes  int
+	Signed bool
+}{
+	"INT16U": {2, false}, "INT16": {2, true},
+	"INT32U": {4, false}, "INT32": {4, true},
+	"INT64U": {8, false}, "INT64": {8, true},
+}
+
+// Encode mã hóa giá trị dạng chuỗi (ví dụ tham số --value của lệnh write) thành bytes thanh ghi,
+// ngược với Decode. Số nguyên nhận cả dạng 0x...; DATETIME dạng "2006-01-02 15:04".
+func Encode(text string, regInfo registermap.Register) ([]byte, error) {
+	switch regInfo.Type {
+	case "UTF8", "ASCII":
+		return EncodeString(text, regInfo)
+	case "DATETIME":
+		t, err := time.ParseInLocation("2006-01-02 15:04", strings.TrimSpace(text), time.Local)
+		if err != nil {
+			return nil, fmt.Errorf("giá trị DATETIME '%s' không hợp lệ (dùng dạng 2006-01-02 15:04)", text)
+		}
+		return EncodeDateTime(t), nil
+	}
+	if it, ok := integerTypes[regInfo.Type]; ok {
+		var bits uint64
+		var err error
+		if it.Signed {
+			var v int64
+			v, err = strconv.ParseInt(strings.TrimSpace(text), 0, it.Bytes*8)
+			bits = uint64(v)
+		} else {
+			bits, err = strconv.ParseUint(strings.TrimSpace(text), 0, it.Bytes*8)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("giá trị '%s' không hợp lệ cho kiểu %s", text, regInfo.Type)
+		}
+		return checkEncodedLength(putUint(bits, it.Bytes), regInfo)
+	}
+	v, err := strconv.ParseFloat(strings.TrimSpace(text), 64)
+	if err != nil {
+		return nil, fmt.Errorf("giá trị '%s' không phải số", text)
+	}
+	return EncodeNumber(v, regInfo)
+}
+
+// EncodeNumber mã hóa giá trị số theo kiểu của thanh ghi. Kiểu số nguyên được làm tròn và kiểm
+// tra khoảng giá trị; PF kiểu *_I16 được nhân với Scale của thanh ghi như khi giải mã.
+func EncodeNumber(v float64, regInfo registermap.Register) ([]byte, error) {
+	var out []byte
+	switch regInfo.Type {
+	case "FLOAT32", "PF_4Q_F32", "PF_IEC_F32", "PF_IEEE_F32":
+		out = binary.BigEndian.AppendUint32(nil, math.Float32bits(float32(v)))
+	case "FLOAT64":
+		out = binary.BigEndian.AppendUint64(nil, math.Float64bits(v))
+	case "PF_IEC_I16", "PF_IEEE_I16":
+		return EncodeNumber(v*pfScale(regInfo), registermap.Register{Name: regInfo.Name, Type: "INT16", Length: regInfo.Length})
+	default:
+		it, ok := integerTypes[regInfo.Type]
+		if !ok {
+			return nil, fmt.Errorf("chưa hỗ trợ ghi kiểu %s", regInfo.Type)
+		}
+		v = math.Round(v)
+		limit := math.Ldexp(1, it.Bytes*8)
+		low, high := 0.0, limit
+		if it.Signed {
+			low, high = -limit/2, limit/2
+		}
+		if math.IsNaN(v) || v < low || v >= high {
+			return nil, fmt.Errorf("giá trị %g ngoài khoảng của kiểu %s", v, regInfo.Type)
+		}
+		if it.Signed {
+			out = putUint(uint64(int64(v)), it.Bytes)
+		} else {
+			out = putUint(uint64(v), it.Bytes)
+		}
+	}
+	return checkEncodedLength(out, regInfo)
+}
+
+// EncodeString ghi chuỗi vào Length thanh ghi, phần thừa điền NUL.
+func EncodeString(text string, regInfo registermap.Register) ([]byte, error) {
+	if regInfo.Length == 0 {
+		return nil, fmt.Errorf("kiểu %s cần khai báo số thanh ghi", regInfo.Type)
+	}
+	if regInfo.Type == "ASCII" {
+		for _, r := range text {
+			if r > 0x7F {
+				return nil, fmt.Errorf("chuỗi '%s' có ký tự không phải ASCII", text)
+			}
+		}
+	}
+	size := int(regInfo.Length) * 2
+	if len(text) > size {
+		return nil, fmt.Errorf("chuỗi dài %d bytes, vượt quá %d thanh ghi (%d bytes)", len(text), regInfo.Length, size)
+	}
+	out := make([]byte, size)
+	copy(out, text)
+	return out, nil
+}
+
+// EncodeDateTime mã hóa thời gian theo IEC 870-5-4 (4 thanh ghi), ngược với giải mã DATETIME.
+func EncodeDateTime(t time.Time) []byte {
+	out := make([]byte, 8)
+	binary.BigEndian.PutUint16(out[0:2], uint16(t.Year()-2000)&0x7F)
+	binary.BigEndian.PutUint16(out[2:4], uint16(t.Month())<<8|uint16(t.Day()))
+	binary.BigEndian.PutUint16(out[4:6], uint16(t.Hour())<<8|uint16(t.Minute()))
+	binary.BigEndian.PutUint16(out[6:8], uint16(t.Second()*1000+t.Nanosecond()/1e6))
+	return out
+}
+
+func putUint(v uint64, size int) []byte {
+	return binary.BigEndian.AppendUint64(nil, v)[8-size:]
+}
+
+func checkEncodedLength(out []byte, regInfo registermap.Register) ([]byte, error) {
+	if regInfo.Length != 0 && len(out) != int(regInfo.Length)*2 {
+		return nil, fmt.Errorf("kiểu %s cần %d thanh ghi, cấu hình là %d", regInfo.Type, len(out)/2, regInfo.Length)
+	}
+	return out, nil
+}
@@ -0,0 +1,229 @@
+package decode
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"modbus_test/registermap"
+)
+
+// fuzzTypes là mọi kiểu Decode hỗ trợ và số byte cố định của kiểu (0: kiểu chuỗi, độ dài theo Length).
+var fuzzTypes = []struct {
+	Name  string
+	Bytes int
+}{
+	{"FLOAT32", 4}, {"FLOAT64", 8},
+	{"INT16U", 2}, {"INT16", 2}, {"INT32U", 4}, {"INT32", 4}, {"INT64", 8}, {"INT64U", 8},
+	{"INT48", 6}, {"INT48U", 6},
+	{"INT8_HI", 2}, {"INT8_LO", 2}, {"INT8U_HI", 2}, {"INT8U_LO", 2},
+	{"BCD16", 2}, {"BCD32", 4}, {"INT32M10", 4}, {"INT64M10", 8},
+	{"UTF8", 0}, {"UTF8_SWAP", 0}, {"ASCII", 0}, {"ASCII_SWAP", 0}, {"LATIN1", 0}, {"LATIN1_SWAP", 0},
+	{"UTF16", 0}, {"UTF16_SWAP", 0}, {"UTF16LE", 0},
+	{"DATETIME", 8},
+	{"PF_4Q_F32", 4}, {"PF_IEC_F32", 4}, {"PF_IEEE_F32", 4}, {"PF_IEC_I16", 2}, {"PF_IEEE_I16", 2},
+	{"CUSTOM_PF", 4},
+}
+
+func fuzzTypeIndex(name string) uint8 {
+	for i, typ := range fuzzTypes {
+		if typ.Name == name {
+			return uint8(i)
+		}
+	}
+	return 0
+}
+
+// decodeSeed là bytes thanh ghi (hex) kèm kiểu và số thanh ghi.
+type decodeSeed struct {
+	typ    string
+	length uint16
+	hex    string
+}
+
+// Seed viết tay: bytes mã hóa lại từ giá trị đã giải mã của PM5560 (run_modbus_v*.txt chỉ có giá trị,
+// không có bytes thô) và các giá trị biên. Bytes thô thật lấy từ log (logSeeds) và từ corpus
+// testdata/fuzz/FuzzDecode trích từ các log đó.
+var fuzzSeeds = []decodeSeed{
+	{"UTF8", 10, "506f776572204d65746572200000000000000000"}, // "Power Meter "
+	{"UTF8", 10, "5363686e656964657220456c6563747269630000"}, // "Schneider Electric"
+	{"UTF8", 10, "8000800080008000800080008000800080008000"},
+	{"UTF8", 10, "41"}, // Thiếu byte, số byte lẻ
+	{"UTF16LE", 2, "41004200"},
+	{"DATETIME", 4, "0019040b15300000"}, // 2025-04-11 21:48 (Peak_Demand_Date_time)
+	{"DATETIME", 4, "ffffffffffffffff"},
+	{"DATETIME", 4, "007f0c1f173bea5f"},
+	{"DATETIME", 4, "00000000000000ff"},
+	{"FLOAT32", 2, "3a83126f"}, // 0.001 (APE_Delivered)
+	{"FLOAT32", 2, "ffc00000"},
+	{"FLOAT32", 2, "7fc00001"},
+	{"FLOAT64", 4, "fff8000000000000"},
+	{"INT64", 4, "8000000000000000"},
+	{"INT48", 3, "800000000000"},
+	{"BCD32", 2, "1a345678"},
+	{"INT64M10", 4, "270f270fd8f1d8f1"},
+	{"PF_4Q_F32", 2, "3fc00000"},
+	{"PF_4Q_F32", 2, "40200000"},
+	{"PF_IEEE_I16", 1, "fc4a"},
+	{"PF_IEC_I16", 1, "7fff"},
+	{"CUSTOM_PF", 2, "7fff0000"},
+	{"CUSTOM_PF", 2, "80000000"},
+	{"CUSTOM_PF", 2, "27100000"},
+}
+
+// logSeeds đọc các giá trị raw_bytes_hex trong log JSON đã lưu của thiết bị thật (../logs_go_final,
+// kể cả file đã nén .gz). Kiểu lấy từ data_type, hoặc từ bảng thanh ghi mặc định theo register_name.
+// Không tìm thấy seed nào thì test lỗi: các log này là mẫu bytes thô thật duy nhất của repo.
+func logSeeds(tb testing.TB) []decodeSeed {
+	paths, _ := filepath.Glob(filepath.Join("..", "logs_go_final", "*.log*"))
+	var seeds []decodeSeed
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+		var r io.Reader = f
+		if strings.HasSuffix(path, ".gz") {
+			zr, err := gzip.NewReader(f)
+			if err != nil {
+				f.Close()
+				continue
+			}
+			r = zr
+		}
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+		for scanner.Scan() {
+			var entry struct {
+				Hex  string `json:"raw_bytes_hex"`
+				Type string `json:"data_type"`
+				Name string `json:"register_name"`
+			}
+			if json.Unmarshal(scanner.Bytes(), &entry) != nil || entry.Hex == "" {
+				continue
+			}
+			seed := decodeSeed{typ: entry.Type, length: uint16((len(entry.Hex) + 3) / 4), hex: entry.Hex}
+			if reg, ok := registermap.Find(registermap.Default, entry.Name); ok {
+				seed.length = reg.Length
+				if seed.typ == "" {
+					seed.typ = reg.Type
+				}
+			}
+			seeds = append(seeds, seed)
+		}
+		f.Close()
+	}
+	if len(seeds) == 0 {
+		tb.Fatal("không tìm thấy raw_bytes_hex nào trong ../logs_go_final/*.log*")
+	}
+	tb.Logf("%d seed từ log", len(seeds))
+	return seeds
+}
+
+// decodeClass phân loại kết quả Decode thành "error" (lỗi độ dài hoặc chuỗi đánh dấu lỗi),
+// "na" (N/A của thiết bị, NaN/Inf, chuỗi không phải số) hoặc "value".
+func decodeClass(value interface{}, err error) string {
+	if err != nil {
+		return "error"
+	}
+	switch _, q := Classify(value); q {
+	case QualityError:
+		return "error"
+	case QualityNA:
+		return "na"
+	}
+	return "value"
+}
+
+func FuzzDecode(f *testing.F) {
+	logrus.SetOutput(io.Discard) // Decode ghi cảnh báo cho mỗi giá trị không hợp lệ
+	for i, typ := range fuzzTypes {
+		f.Add(uint8(i), uint16(max(typ.Bytes/2, 1)), make([]byte, max(typ.Bytes, 2)))
+	}
+	for _, s := range append(fuzzSeeds, logSeeds(f)...) {
+		if data, err := hex.DecodeString(s.hex); err == nil {
+			f.Add(fuzzTypeIndex(s.typ), s.length, data)
+		}
+	}
+
+	f.Fuzz(func(t *testing.T, typeIndex uint8, length uint16, data []byte) {
+		typ := fuzzTypes[int(typeIndex)%len(fuzzTypes)]
+		reg := registermap.Register{Name: "Fuzz", Address: 1, Type: typ.Name, Length: length % 126}
+		value, err := Decode(data, reg)
+
+		// Kết quả ổn định: giải mã lại cùng bytes cho cùng giá trị và cùng phân loại
+		again, errAgain := Decode(data, reg)
+		class := decodeClass(value, err)
+		if c := decodeClass(again, errAgain); c != class || fmt.Sprintf("%#v", again) != fmt.Sprintf("%#v", value) {
+			t.Fatalf("%s %x: lần 1 %#v (%s), lần 2 %#v (%s)", typ.Name, data, value, class, again, c)
+		}
+
+		// Chỉ độ dài không khớp mới trả về error
+		wantErr := len(data) != typ.Bytes
+		if typ.Bytes == 0 {
+			wantErr = len(data) > int(reg.Length)*2 || len(data)%2 != 0
+		}
+		if (err != nil) != wantErr {
+			t.Fatalf("%s length %d, %d bytes: err = %v, cần lỗi: %v", typ.Name, reg.Length, len(data), err, wantErr)
+		}
+		if err != nil {
+			return
+		}
+
+		if s, ok := value.(string); ok && IsNA(s) && s != "N/A_"+typ.Name {
+			t.Fatalf("%s %x: N/A của kiểu khác: %q", typ.Name, data, s)
+		}
+		switch {
+		case typ.Bytes == 0:
+			s, ok := value.(string)
+			if !ok || strings.ContainsRune(s, 0) {
+				t.Fatalf("%s %x: chuỗi không hợp lệ %#v", typ.Name, data, value)
+			}
+		case typ.Name == "DATETIME":
+			s, _ := value.(string)
+			if IsNA(s) || strings.HasPrefix(s, "INVALID_IEC_DATE(") {
+				return
+			}
+			ts, parseErr := time.ParseInLocation("2006-01-02 15:04:05.000", s, time.Local)
+			if parseErr != nil || ts.Year() < 2000 || ts.Year() > 2127 {
+				t.Fatalf("DATETIME %x: %q không phải thời điểm hợp lệ (%v)", data, s, parseErr)
+			}
+		case strings.HasPrefix(typ.Name, "PF_"):
+			pf, ok := value.(PowerFactor)
+			if !ok {
+				if s, _ := value.(string); !IsNA(s) && !strings.HasPrefix(s, "INVALID_PF(") {
+					t.Fatalf("%s %x: %#v không phải PowerFactor, N/A hay INVALID_PF", typ.Name, data, value)
+				}
+				return
+			}
+			if pf.Magnitude > 1 || pf.Magnitude != math.Abs(pf.Value) {
+				t.Fatalf("%s %x: PF ngoài khoảng %#v", typ.Name, data, pf)
+			}
+			if typ.Name == "PF_4Q_F32" && (pf.Quadrant < 1 || pf.Quadrant > 4) {
+				t.Fatalf("PF_4Q_F32 %x: góc phần tư %d", data, pf.Quadrant)
+			}
+		default:
+			// Kiểu số: giá trị số, N/A hoặc INVALID_...; NaN/Inf chỉ có ở kiểu số thực
+			if _, isString := value.(string); isString {
+				if class == "value" || (!IsNA(value) && !IsError(value)) {
+					t.Fatalf("%s %x: chuỗi không mong đợi %#v", typ.Name, data, value)
+				}
+				return
+			}
+			if _, ok := ToFloat64(value); !ok && typ.Name != "FLOAT32" && typ.Name != "FLOAT64" {
+				t.Fatalf("%s %x: giá trị không phải số %#v", typ.Name, data, value)
+			}
+		}
+	})
+}
@@ -0,0 +1,156 @@
+package decode
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+
+	"github.com/sirupsen/logrus"
+
+	"modbus_test/registermap"
+)
+
+// PFInt16Scale là hệ số chia mặc định cho PF_IEC_I16/PF_IEEE_I16 khi thanh ghi không khai báo Scale.
+const PFInt16Scale = 1000.0
+
+// pfScale trả về hệ số chia của thanh ghi PF kiểu *_I16.
+func pfScale(regInfo registermap.Register) float64 {
+	if regInfo.Scale > 0 {
+		return regInfo.Scale
+	}
+	return PFInt16Scale
+}
+
+// PowerFactor là kết quả giải mã PF theo một quy ước dấu cụ thể.
+// Quadrant = 0 và LeadLag = "" khi quy ước của thanh ghi không đủ thông tin để xác định.
+type PowerFactor struct {
+	Value     float64 `json:"value"`     // Giá trị PF có dấu theo quy ước của thanh ghi
+	Magnitude float64 `json:"magnitude"` // |PF|, trong khoảng 0..1
+	LeadLag   string  `json:"lead_lag,omitempty"`
+	Quadrant  int     `json:"quadrant,omitempty"`
+}
+
+func (pf PowerFactor) String() string {
+	s := fmt.Sprintf("%.4f", pf.Value)
+	if pf.LeadLag != "" {
+		s += " " + pf.LeadLag
+	}
+	if pf.Quadrant != 0 {
+		s += fmt.Sprintf(" Q%d", pf.Quadrant)
+	}
+	return s
+}
+
+// WithPowerSigns bổ sung LeadLag và Quadrant còn thiếu từ dấu của công suất tác dụng P và công suất
+// phản kháng Q đọc cùng chu kỳ (NaN hoặc 0 = không biết dấu). Góc phần tư theo dấu của P và lead/lag:
+// Q1 (P+, lag), Q2 (P-, lead), Q3 (P-, lag), Q4 (P+, lead); lag khi P và Q cùng dấu.
+// PF theo quy ước IEC đã cho biết dấu của P nên chỉ cần Q; PF theo quy ước IEEE đã cho biết lead/lag
+// nên chỉ cần P.
+func (pf PowerFactor) WithPowerSigns(activePower, reactivePower float64) PowerFactor {
+	if pf.Quadrant != 0 {
+		return pf
+	}
+	p := sign(activePower)
+	if p == 0 && pf.LeadLag == "" {
+		p = sign(pf.Value) // Quy ước IEC: dấu của PF là dấu của P
+	}
+	if pf.LeadLag == "" {
+		switch q := sign(reactivePower); {
+		case p == 0 || q == 0: // Không đủ thông tin để xác định lead/lag
+		case p == q:
+			pf.LeadLag = "LAG"
+		default:
+			pf.LeadLag = "LEAD"
+		}
+	}
+	switch {
+	case p > 0 && pf.LeadLag == "LAG":
+		pf.Quadrant = 1
+	case p < 0 && pf.LeadLag == "LEAD":
+		pf.Quadrant = 2
+	case p < 0 && pf.LeadLag == "LAG":
+		pf.Quadrant = 3
+	case p > 0 && pf.LeadLag == "LEAD":
+		pf.Quadrant = 4
+	}
+	return pf
+}
+
+func sign(v float64) int {
+	switch {
+	case v > 0:
+		return 1
+	case v < 0:
+		return -1
+	}
+	return 0 // Kể cả NaN
+}
+
+// decodePowerFactor giải mã các kiểu PF:
+//   - PF_4Q_F32: quy ước 4 góc phần tư của Schneider (FLOAT32 trong khoảng -2..2).
+//     Q1 (lag): 0..1, Q2 (lead): -1..0, Q3 (lag): -2..-1, Q4 (lead): 1..2.
+//   - PF_IEC_F32/PF_IEC_I16: dấu của PF là dấu của công suất tác dụng (nhận/phát).
+//     Không có lead/lag và góc phần tư (cần dấu của Q, xem WithPowerSigns).
+//   - PF_IEEE_F32/PF_IEEE_I16: dấu của PF cho biết lead (âm) hoặc lag (dương).
+//     Không có góc phần tư (cần dấu của P, xem WithPowerSigns).
+//
+// Kiểu *_I16 là số nguyên có dấu chia cho Scale của thanh ghi (mặc định PFInt16Scale).
+func decodePowerFactor(data []byte, regInfo registermap.Register) (interface{}, error) {
+	var raw float64
+	switch regInfo.Type {
+	case "PF_4Q_F32", "PF_IEC_F32", "PF_IEEE_F32":
+		if len(data) != 4 {
+			return nil, fmt.Errorf("%s cần 4 bytes, nhận %d", regInfo.Type, len(data))
+		}
+		bits := binary.BigEndian.Uint32(data)
+		if bits == 0xFFC00000 {
+			return "N/A_" + regInfo.Type, nil
+		}
+		raw = float64(math.Float32frombits(bits))
+	case "PF_IEC_I16", "PF_IEEE_I16":
+		if len(data) != 2 {
+			return nil, fmt.Errorf("%s cần 2 bytes, nhận %d", regInfo.Type, len(data))
+		}
+		val := binary.BigEndian.Uint16(data)
+		if val == 0x8000 {
+			return "N/A_" + regInfo.Type, nil
+		}
+		raw = float64(int16(val)) / pfScale(regInfo)
+	default:
+		return nil, fmt.Errorf("kiểu PF không hỗ trợ: %s", regInfo.Type)
+	}
+
+	limit := 1.0
+	if regInfo.Type == "PF_4Q_F32" {
+		limit = 2.0
+	}
+	if math.IsNaN(raw) || math.Abs(raw) > limit+1e-6 {
+		logrus.WithFields(logrus.Fields{"register_name": regInfo.Name, "data_type": regInfo.Type, "raw_value": raw, "raw_bytes_hex": fmt.Sprintf("%x", data)}).Warn("Giá trị PF ngoài khoảng hợp lệ")
+		return fmt.Sprintf("INVALID_PF(%g)", raw), nil
+	}
+
+	pf := PowerFactor{}
+	switch regInfo.Type {
+	case "PF_4Q_F32":
+		switch {
+		case raw > 1:
+			pf = PowerFactor{Value: 2 - raw, LeadLag: "LEAD", Quadrant: 4}
+		case raw >= 0:
+			pf = PowerFactor{Value: raw, LeadLag: "LAG", Quadrant: 1}
+		case raw >= -1:
+			pf = PowerFactor{Value: raw, LeadLag: "LEAD", Quadrant: 2}
+		default:
+			pf = PowerFactor{Value: -2 - raw, LeadLag: "LAG", Quadrant: 3}
+		}
+	case "PF_IEC_F32", "PF_IEC_I16":
+		pf = PowerFactor{Value: raw}
+	case "PF_IEEE_F32", "PF_IEEE_I16":
+		pf = PowerFactor{Value: raw, LeadLag: "LAG"}
+		if raw < 0 {
+			pf.LeadLag = "LEAD"
+		}
+	}
+	pf.Value = math.Round(pf.Value*1e6) / 1e6
+	pf.Magnitude = math.Abs(pf.Value)
+	return pf, nil
+}
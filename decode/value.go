@@ -0,0 +1,121 @@
+package decode
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Các chuỗi đánh dấu lỗi khi đọc một thanh ghi (thay cho giá trị trong map kết quả).
+const (
+	InvalidAddrCfg = "INVALID_ADDR_CFG" // Địa chỉ cấu hình nhỏ hơn addressBase
+	ReadError      = "READ_ERROR"       // Lỗi giao tiếp: timeout, exception, CRC...
+	LengthError    = "LENGTH_ERROR"     // Số byte nhận được khác số byte cần
+	DecodeError    = "DECODE_ERROR"     // Decode trả về lỗi
+)
+
+// Quality là chất lượng của một giá trị trong map kết quả.
+type Quality int
+
+const (
+	QualityGood Quality = iota
+	QualityNA
+	QualityError
+)
+
+// Classify phân loại giá trị trong map kết quả giống cách console/JSON đánh dấu lỗi và trả về
+// giá trị số (nếu có).
+func Classify(value interface{}) (float64, Quality) {
+	if strVal, ok := value.(string); ok {
+		if strings.Contains(strVal, "ERROR") || strings.Contains(strVal, "INVALID") {
+			return 0, QualityError
+		}
+		return 0, QualityNA
+	}
+	if value == nil {
+		return 0, QualityError
+	}
+	if f, ok := ToFloat64(value); ok {
+		return f, QualityGood
+	}
+	return 0, QualityNA
+}
+
+// IsError cho biết giá trị trong map kết quả có phải là lỗi (READ_ERROR, INVALID_...) hay không.
+func IsError(value interface{}) bool {
+	strVal, ok := value.(string)
+	return ok && (strings.Contains(strVal, "ERROR") || strings.Contains(strVal, "INVALID"))
+}
+
+// IsNA cho biết giá trị có phải là N/A do thiết bị báo (N/A_FLOAT32, N/A_INT16U...) hay không.
+func IsNA(value interface{}) bool {
+	s, ok := value.(string)
+	return ok && len(s) >= 4 && s[:4] == "N/A_"
+}
+
+// ToFloat64 chuyển giá trị số đã giải mã sang float64. Trả về false với chuỗi (lỗi, N/A...),
+// NaN/Inf hoặc kiểu không phải số.
+func ToFloat64(value interface{}) (float64, bool) {
+	var f float64
+	switch v := value.(type) {
+	case float32:
+		f = float64(v)
+	case float64:
+		f = v
+	case int8:
+		f = float64(v)
+	case uint8:
+		f = float64(v)
+	case int16:
+		f = float64(v)
+	case uint16:
+		f = float64(v)
+	case int32:
+		f = float64(v)
+	case uint32:
+		f = float64(v)
+	case int64:
+		f = float64(v)
+	case uint64:
+		f = float64(v)
+	case PowerFactor:
+		f = v.Value
+	default:
+		return 0, false
+	}
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, false
+	}
+	return f, true
+}
+
+// Float32Decimal trả về số float64 có cùng biểu diễn thập phân ngắn nhất với giá trị float32 gốc
+// (230.1 thay vì 230.10000610351562) để lưu trữ/xuất dữ liệu. Giá trị khác được giữ nguyên.
+func Float32Decimal(value interface{}, f float64) float64 {
+	if v, ok := value.(float32); ok {
+		if d, err := strconv.ParseFloat(strconv.FormatFloat(float64(v), 'g', -1, 32), 64); err == nil {
+			return d
+		}
+	}
+	return f
+}
+
+// Sanitize làm tròn số thực tới 4 chữ số thập phân và đổi NaN/Inf thành nil trước khi ghi log
+// JSON. Giá trị khác được giữ nguyên.
+func Sanitize(value interface{}) interface{} {
+	switch v := value.(type) {
+	case float32:
+		fv64 := float64(v)
+		if math.IsNaN(fv64) || math.IsInf(fv64, 0) {
+			return nil
+		}
+		return math.Round(fv64*10000) / 10000
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return nil
+		}
+		return math.Round(v*10000) / 10000
+	default:
+		return v
+	}
+}
@@ -0,0 +1,486 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/sirupsen/logrus"
+
+	"modbus_test/decode"
+)
+
+// --- Định nghĩa thanh ghi ảo (tính từ các thanh ghi khác) ---
+type DerivedRegister struct {
+	Name       string
+	Expression string // Biểu thức trên tên các thanh ghi (vật lý hoặc ảo khác)
+}
+
+// Biểu thức hỗ trợ: + - * / %, so sánh (< <= > >= == !=), && || !, dấu ngoặc,
+// các hàm min(), max(), avg(), abs(), sqrt() và if(điều_kiện, giá_trị_đúng, giá_trị_sai).
+var derivedRegisters = []DerivedRegister{
+	{"ApparentPower_A_Calc", "Voltage_AN * Current_A / 1000"}, // kVA
+	{"ApparentPower_B_Calc", "Voltage_BN * Current_B / 1000"},
+	{"ApparentPower_C_Calc", "Voltage_CN * Current_C / 1000"},
+	{"Current_Unbalance_Calc", "if(Current_Avg > 0, max(abs(Current_A - Current_Avg), abs(Current_B - Current_Avg), abs(Current_C - Current_Avg)) / Current_Avg * 100, 0)"},
+	{"Accum_AE_Del_MWh", "Accum_AE_Del / 1000000"},
+}
+
+// exprNode là một nút trong cây biểu thức đã biên dịch.
+type exprNode interface {
+	eval(values map[string]interface{}) (float64, decode.Quality)
+}
+
+type numberNode float64
+
+func (n numberNode) eval(map[string]interface{}) (float64, decode.Quality) {
+	return float64(n), decode.QualityGood
+}
+
+type refNode string
+
+func (n refNode) eval(values map[string]interface{}) (float64, decode.Quality) {
+	return decode.Classify(values[string(n)])
+}
+
+type unaryNode struct {
+	op      string
+	operand exprNode
+}
+
+func (n unaryNode) eval(values map[string]interface{}) (float64, decode.Quality) {
+	v, q := n.operand.eval(values)
+	if q != decode.QualityGood {
+		return 0, q
+	}
+	if n.op == "!" {
+		return boolToFloat(v == 0), decode.QualityGood
+	}
+	return -v, decode.QualityGood
+}
+
+type binaryNode struct {
+	op          string
+	left, right exprNode
+}
+
+func (n binaryNode) eval(values map[string]interface{}) (float64, decode.Quality) {
+	l, lq := n.left.eval(values)
+	// && và || chỉ tính vế phải khi cần
+	if lq == decode.QualityGood && ((n.op == "&&" && l == 0) || (n.op == "||" && l != 0)) {
+		return boolToFloat(l != 0), decode.QualityGood
+	}
+	r, rq := n.right.eval(values)
+	if q := worstQuality(lq, rq); q != decode.QualityGood {
+		return 0, q
+	}
+	switch n.op {
+	case "+":
+		return l + r, decode.QualityGood
+	case "-":
+		return l - r, decode.QualityGood
+	case "*":
+		return l * r, decode.QualityGood
+	case "/":
+		return l / r, decode.QualityGood
+	case "%":
+		return math.Mod(l, r), decode.QualityGood
+	case "<":
+		return boolToFloat(l < r), decode.QualityGood
+	case "<=":
+		return boolToFloat(l <= r), decode.QualityGood
+	case ">":
+		return boolToFloat(l > r), decode.QualityGood
+	case ">=":
+		return boolToFloat(l >= r), decode.QualityGood
+	case "==":
+		return boolToFloat(l == r), decode.QualityGood
+	case "!=":
+		return boolToFloat(l != r), decode.QualityGood
+	case "&&", "||":
+		return boolToFloat(r != 0), decode.QualityGood
+	}
+	return 0, decode.QualityError
+}
+
+type callNode struct {
+	name string
+	args []exprNode
+}
+
+func (n callNode) eval(values map[string]interface{}) (float64, decode.Quality) {
+	if n.name == "if" {
+		cond, q := n.args[0].eval(values)
+		if q != decode.QualityGood {
+			return 0, q
+		}
+		if cond != 0 {
+			return n.args[1].eval(values)
+		}
+		return n.args[2].eval(values)
+	}
+	args := make([]float64, len(n.args))
+	quality := decode.QualityGood
+	for i, arg := range n.args {
+		var q decode.Quality
+		args[i], q = arg.eval(values)
+		quality = worstQuality(quality, q)
+	}
+	if quality != decode.QualityGood {
+		return 0, quality
+	}
+	switch n.name {
+	case "abs":
+		return math.Abs(args[0]), decode.QualityGood
+	case "sqrt":
+		return math.Sqrt(args[0]), decode.QualityGood
+	case "min", "max", "avg":
+		result := args[0]
+		sum := 0.0
+		for _, a := range args {
+			sum += a
+			if (n.name == "min" && a < result) || (n.name == "max" && a > result) {
+				result = a
+			}
+		}
+		if n.name == "avg" {
+			result = sum / float64(len(args))
+		}
+		return result, decode.QualityGood
+	}
+	return 0, decode.QualityError
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func worstQuality(a, b decode.Quality) decode.Quality {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// --- Bộ phân tích cú pháp biểu thức (recursive descent) ---
+type exprParser struct {
+	tokens []string
+	pos    int
+	refs   map[string]bool
+}
+
+func tokenizeExpression(expr string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(expr); {
+		c := rune(expr[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case unicode.IsDigit(c) || c == '.':
+			j := i
+			for j < len(expr) && (unicode.IsDigit(rune(expr[j])) || expr[j] == '.' || expr[j] == 'e' || expr[j] == 'E' ||
+				((expr[j] == '+' || expr[j] == '-') && (expr[j-1] == 'e' || expr[j-1] == 'E'))) {
+				j++
+			}
+			tokens = append(tokens, expr[i:j])
+			i = j
+		case unicode.IsLetter(c) || c == '_':
+			j := i
+			for j < len(expr) && (unicode.IsLetter(rune(expr[j])) || unicode.IsDigit(rune(expr[j])) || expr[j] == '_') {
+				j++
+			}
+			tokens = append(tokens, expr[i:j])
+			i = j
+		default:
+			if i+1 < len(expr) {
+				switch expr[i : i+2] {
+				case "<=", ">=", "==", "!=", "&&", "||":
+					tokens = append(tokens, expr[i:i+2])
+					i += 2
+					continue
+				}
+			}
+			if !strings.ContainsRune("+-*/%()<>!,", c) {
+				return nil, fmt.Errorf("ký tự không hợp lệ '%c' tại vị trí %d", c, i)
+			}
+			tokens = append(tokens, string(c))
+			i++
+		}
+	}
+	return tokens, nil
+}
+
+// parseExpression biên dịch biểu thức và trả về danh sách tên thanh ghi được tham chiếu.
+func parseExpression(expr string) (exprNode, []string, error) {
+	tokens, err := tokenizeExpression(expr)
+	if err != nil {
+		return nil, nil, err
+	}
+	p := &exprParser{tokens: tokens, refs: make(map[string]bool)}
+	node, err := p.parseBinary(0)
+	if err != nil {
+		return nil, nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, nil, fmt.Errorf("token thừa '%s'", p.tokens[p.pos])
+	}
+	var refs []string
+	for name := range p.refs {
+		refs = append(refs, name)
+	}
+	return node, refs, nil
+}
+
+// Độ ưu tiên toán tử, từ thấp đến cao.
+var exprPrecedence = [][]string{
+	{"||"},
+	{"&&"},
+	{"==", "!="},
+	{"<", "<=", ">", ">="},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+func (p *exprParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *exprParser) parseBinary(level int) (exprNode, error) {
+	if level == len(exprPrecedence) {
+		return p.parseUnary()
+	}
+	left, err := p.parseBinary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.peek()
+		matched := false
+		for _, candidate := range exprPrecedence[level] {
+			if op == candidate {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.parseBinary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		left = binaryNode{op: op, left: left, right: right}
+	}
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+	if op := p.peek(); op == "-" || op == "!" || op == "+" {
+		p.pos++
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		if op == "+" {
+			return operand, nil
+		}
+		return unaryNode{op: op, operand: operand}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *exprParser) parsePrimary() (exprNode, error) {
+	tok := p.peek()
+	if tok == "" {
+		return nil, fmt.Errorf("biểu thức kết thúc đột ngột")
+	}
+	p.pos++
+	if tok == "(" {
+		node, err := p.parseBinary(0)
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ")" {
+			return nil, fmt.Errorf("thiếu ')'")
+		}
+		p.pos++
+		return node, nil
+	}
+	if c := rune(tok[0]); unicode.IsDigit(c) || c == '.' {
+		val, err := strconv.ParseFloat(tok, 64)
+		if err != nil {
+			return nil, fmt.Errorf("số không hợp lệ '%s'", tok)
+		}
+		return numberNode(val), nil
+	}
+	if c := rune(tok[0]); !unicode.IsLetter(c) && c != '_' {
+		return nil, fmt.Errorf("token không mong đợi '%s'", tok)
+	}
+	if p.peek() != "(" {
+		p.refs[tok] = true
+		return refNode(tok), nil
+	}
+	// Gọi hàm
+	p.pos++
+	var args []exprNode
+	for p.peek() != ")" {
+		arg, err := p.parseBinary(0)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+		if p.peek() == "," {
+			p.pos++
+		} else if p.peek() != ")" {
+			return nil, fmt.Errorf("thiếu ',' hoặc ')' trong lời gọi %s()", tok)
+		}
+	}
+	p.pos++
+	switch tok {
+	case "abs", "sqrt":
+		if len(args) != 1 {
+			return nil, fmt.Errorf("%s() cần 1 tham số, nhận %d", tok, len(args))
+		}
+	case "min", "max", "avg":
+		if len(args) == 0 {
+			return nil, fmt.Errorf("%s() cần ít nhất 1 tham số", tok)
+		}
+	case "if":
+		if len(args) != 3 {
+			return nil, fmt.Errorf("if() cần 3 tham số, nhận %d", len(args))
+		}
+	default:
+		return nil, fmt.Errorf("hàm không hỗ trợ '%s'", tok)
+	}
+	return callNode{name: tok, args: args}, nil
+}
+
+// --- Biên dịch và tính toán các thanh ghi ảo ---
+type compiledDerived struct {
+	name string
+	expr exprNode
+	err  error
+}
+
+// Danh sách thanh ghi ảo đã biên dịch, theo thứ tự phụ thuộc.
+var derivedEvaluationOrder []compiledDerived
+
+// prepareDerivedRegisters biên dịch biểu thức và sắp xếp các thanh ghi ảo theo thứ tự phụ thuộc.
+// Thanh ghi có biểu thức lỗi, tham chiếu tên không tồn tại hoặc phụ thuộc vòng sẽ luôn
+// trả về "INVALID_EXPR_CFG".
+func prepareDerivedRegisters() {
+	known := make(map[string]bool)
+	for _, reg := range registersToRead {
+		known[reg.Name] = true
+	}
+	derivedIndex := make(map[string]int)
+	for i, d := range derivedRegisters {
+		derivedIndex[d.Name] = i
+	}
+
+	compiled := make([]compiledDerived, len(derivedRegisters))
+	deps := make([][]string, len(derivedRegisters))
+	for i, d := range derivedRegisters {
+		compiled[i].name = d.Name
+		if known[d.Name] {
+			compiled[i].err = fmt.Errorf("trùng tên với thanh ghi vật lý")
+			continue
+		}
+		node, refs, err := parseExpression(d.Expression)
+		if err != nil {
+			compiled[i].err = err
+			continue
+		}
+		for _, ref := range refs {
+			if _, isDerived := derivedIndex[ref]; isDerived {
+				deps[i] = append(deps[i], ref)
+			} else if !known[ref] {
+				compiled[i].err = fmt.Errorf("tham chiếu thanh ghi không tồn tại '%s'", ref)
+			}
+		}
+		if compiled[i].err == nil {
+			compiled[i].expr = node
+		}
+	}
+
+	// Sắp xếp topo (DFS). Trạng thái: 0 = chưa thăm, 1 = đang thăm, 2 = xong.
+	state := make([]int, len(derivedRegisters))
+	derivedEvaluationOrder = derivedEvaluationOrder[:0]
+	var visit func(i int) error
+	visit = func(i int) error {
+		switch state[i] {
+		case 1:
+			return fmt.Errorf("phụ thuộc vòng tại '%s'", derivedRegisters[i].Name)
+		case 2:
+			return compiled[i].err
+		}
+		state[i] = 1
+		for _, dep := range deps[i] {
+			if err := visit(derivedIndex[dep]); err != nil && compiled[i].err == nil {
+				compiled[i].err = fmt.Errorf("phụ thuộc '%s' không hợp lệ: %w", dep, err)
+			}
+		}
+		state[i] = 2
+		derivedEvaluationOrder = append(derivedEvaluationOrder, compiled[i])
+		return compiled[i].err
+	}
+	for i := range derivedRegisters {
+		visit(i)
+	}
+	for _, c := range derivedEvaluationOrder {
+		if c.err != nil {
+			logrus.WithError(c.err).WithField("register_name", c.name).Error("Cấu hình thanh ghi ảo không hợp lệ")
+		}
+	}
+}
+
+// evaluateDerivedRegisters tính các thanh ghi ảo và ghi kết quả vào map dữ liệu của chu kỳ.
+// Nếu đầu vào bị lỗi, kết quả là "INPUT_ERROR"; nếu đầu vào N/A hoặc phép tính không xác định
+// (chia cho 0, căn số âm), kết quả là "N/A_DERIVED".
+func evaluateDerivedRegisters(data map[string]interface{}) {
+	for _, c := range derivedEvaluationOrder {
+		if c.err != nil {
+			data[c.name] = "INVALID_EXPR_CFG"
+			continue
+		}
+		val, quality := c.expr.eval(data)
+		switch {
+		case quality == decode.QualityError:
+			data[c.name] = "INPUT_ERROR"
+		case quality == decode.QualityNA || math.IsNaN(val) || math.IsInf(val, 0):
+			data[c.name] = "N/A_DERIVED"
+		default:
+			data[c.name] = val
+		}
+	}
+}
+
+// outputRegisterNames trả về tên các thanh ghi xuất ra console/JSON/CSV: thanh ghi vật lý
+// theo thứ tự cấu hình, sau đó là các thanh ghi ảo.
+func outputRegisterNames() []string {
+	names := make([]string, 0, len(registersToRead)+len(derivedRegisters))
+	for _, reg := range registersToRead {
+		names = append(names, reg.Name)
+	}
+	for _, d := range derivedRegisters {
+		names = append(names, d.Name)
+	}
+	return names
+}
+
+func isDerivedRegister(name string) bool {
+	for _, d := range derivedRegisters {
+		if d.Name == name {
+			return true
+		}
+	}
+	return false
+}
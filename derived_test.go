@@ -0,0 +1,192 @@
+package main
+
+import (
+	"io"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+
+	"modbus_test/decode"
+	"modbus_test/registermap"
+)
+
+// evalDerived biên dịch biểu thức và tính như một thanh ghi ảo (cùng quy tắc INPUT_ERROR/N/A_DERIVED).
+func evalDerived(t *testing.T, expr string, values map[string]interface{}) interface{} {
+	t.Helper()
+	node, _, err := parseExpression(expr)
+	if err != nil {
+		t.Fatalf("'%s': %v", expr, err)
+	}
+	oldOrder := derivedEvaluationOrder
+	defer func() { derivedEvaluationOrder = oldOrder }()
+	derivedEvaluationOrder = []compiledDerived{{name: "X", expr: node}}
+	data := make(map[string]interface{}, len(values)+1)
+	for name, v := range values {
+		data[name] = v
+	}
+	evaluateDerivedRegisters(data)
+	return data["X"]
+}
+
+func TestDerivedExpression(t *testing.T) {
+	values := map[string]interface{}{
+		"A": float32(2), "B": uint16(3), "C": int32(4), "Z": 0.0,
+		"E": decode.ReadError, "N": "N/A_FLOAT32",
+	}
+	tests := []struct {
+		expr string
+		want interface{}
+	}{
+		// Độ ưu tiên và kết hợp trái
+		{"A + B * C", 14.0},
+		{"(A + B) * C", 20.0},
+		{"A - B - C", -5.0},
+		{"C / A / A", 1.0},
+		{"C % B + 1", 2.0},
+		{"1 + 2 < 4 && 3 == 3", 1.0},
+		{"A > B || C > B && Z", 0.0},
+		{"A != B == 1", 1.0},
+		{"1.5e2 + 2E-1", 150.2},
+		// Dấu trừ/cộng một ngôi và phủ định
+		{"-A * B", -6.0},
+		{"-(A + B)", -5.0},
+		{"A - -B", 5.0},
+		{"--A", 2.0},
+		{"+A", 2.0},
+		{"!Z + !A", 1.0},
+		// Hàm
+		{"max(A, B, C) - min(A, B, C)", 2.0},
+		{"avg(A, B, C)", 3.0},
+		{"abs(B - C) + sqrt(C)", 3.0},
+		{"if(A < B, 10, 20)", 10.0},
+		{"if(A > B, 10, 20)", 20.0},
+		{"if(Z, 1, if(A, 2, 3))", 2.0},
+		// Chỉ tính nhánh/vế cần thiết: đầu vào lỗi ở nhánh không dùng không ảnh hưởng
+		{"if(A < B, 10, E)", 10.0},
+		{"if(A > B, N, 20)", 20.0},
+		{"Z && E", 0.0},
+		{"A || N", 1.0},
+		// Lan truyền INPUT_ERROR (lỗi mạnh hơn N/A)
+		{"E + 1", "INPUT_ERROR"},
+		{"if(E, 1, 2)", "INPUT_ERROR"},
+		{"A && E", "INPUT_ERROR"},
+		{"N * E", "INPUT_ERROR"},
+		{"max(A, E)", "INPUT_ERROR"},
+		{"-E", "INPUT_ERROR"},
+		{"Missing + 1", "INPUT_ERROR"},
+		// Lan truyền N/A_DERIVED (đầu vào N/A hoặc phép tính không xác định)
+		{"N * 0", "N/A_DERIVED"},
+		{"Z || N", "N/A_DERIVED"},
+		{"if(A < B, N, 1)", "N/A_DERIVED"},
+		{"A / Z", "N/A_DERIVED"},
+		{"sqrt(-A)", "N/A_DERIVED"},
+		{"Z % Z", "N/A_DERIVED"},
+	}
+	for _, tt := range tests {
+		got := evalDerived(t, tt.expr, values)
+		if f, ok := got.(float64); ok {
+			if want, ok := tt.want.(float64); ok && math.Abs(f-want) < 1e-9 {
+				continue
+			}
+		}
+		if got != tt.want {
+			t.Errorf("'%s' = %#v, cần %#v", tt.expr, got, tt.want)
+		}
+	}
+}
+
+func TestParseExpressionErrors(t *testing.T) {
+	tests := []struct {
+		expr    string
+		wantErr string
+	}{
+		{"A +", "kết thúc đột ngột"},
+		{"(A + B", "thiếu ')'"},
+		{"A B", "token thừa 'B'"},
+		{"A + )", "token không mong đợi ')'"},
+		{"A $ B", "ký tự không hợp lệ '$'"},
+		{"1.2.3", "số không hợp lệ '1.2.3'"},
+		{"max(A B)", "thiếu ',' hoặc ')'"},
+		{"foo(A)", "hàm không hỗ trợ 'foo'"},
+		{"abs(A, B)", "abs() cần 1 tham số"},
+		{"min()", "min() cần ít nhất 1 tham số"},
+		{"if(A, B)", "if() cần 3 tham số"},
+	}
+	for _, tt := range tests {
+		_, _, err := parseExpression(tt.expr)
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("'%s': lỗi = %v, cần chứa %q", tt.expr, err, tt.wantErr)
+		}
+	}
+
+	_, refs, err := parseExpression("max(A, B) + if(A, C, abs(A))")
+	if err != nil || len(refs) != 3 {
+		t.Errorf("refs = %v, %v; cần A, B, C (không gồm tên hàm)", refs, err)
+	}
+}
+
+func TestPrepareDerivedRegisters(t *testing.T) {
+	logrus.SetOutput(io.Discard)
+	oldRegs, oldDerived, oldOrder := registersToRead, derivedRegisters, derivedEvaluationOrder
+	defer func() { registersToRead, derivedRegisters, derivedEvaluationOrder = oldRegs, oldDerived, oldOrder }()
+	registersToRead = []registermap.Register{{Name: "A"}, {Name: "B"}}
+	derivedRegisters = []DerivedRegister{
+		{Name: "Double", Expression: "Sum * 2"}, // Phụ thuộc thanh ghi ảo khai báo sau
+		{Name: "Sum", Expression: "A * 3"},
+		{Name: "Loop1", Expression: "Loop2 + 1"},
+		{Name: "Loop2", Expression: "Loop1 + 1"},
+		{Name: "Self", Expression: "Self + A"},
+		{Name: "Bad", Expression: "A + Unknown"},
+		{Name: "UsesBad", Expression: "Bad * 2"},
+		{Name: "Syntax", Expression: "A +"},
+		{Name: "B", Expression: "A"}, // Trùng tên thanh ghi vật lý
+	}
+	prepareDerivedRegisters()
+
+	position := make(map[string]int)
+	errs := make(map[string]string)
+	for i, c := range derivedEvaluationOrder {
+		position[c.name] = i
+		if c.err != nil {
+			errs[c.name] = c.err.Error()
+		}
+	}
+	if len(derivedEvaluationOrder) != len(derivedRegisters) {
+		t.Fatalf("derivedEvaluationOrder có %d thanh ghi, cần %d", len(derivedEvaluationOrder), len(derivedRegisters))
+	}
+	if position["Sum"] > position["Double"] {
+		t.Errorf("Sum phải được tính trước Double, thứ tự: %v", position)
+	}
+	wantErrs := map[string]string{
+		"Loop1":   "phụ thuộc vòng",
+		"Loop2":   "phụ thuộc vòng",
+		"Self":    "phụ thuộc vòng tại 'Self'",
+		"Bad":     "tham chiếu thanh ghi không tồn tại 'Unknown'",
+		"UsesBad": "phụ thuộc 'Bad' không hợp lệ",
+		"Syntax":  "kết thúc đột ngột",
+		"B":       "trùng tên với thanh ghi vật lý",
+	}
+	for name, want := range wantErrs {
+		if !strings.Contains(errs[name], want) {
+			t.Errorf("%s: lỗi = %q, cần chứa %q", name, errs[name], want)
+		}
+	}
+	for _, name := range []string{"Double", "Sum"} {
+		if errs[name] != "" {
+			t.Errorf("%s: lỗi không mong đợi %q", name, errs[name])
+		}
+	}
+
+	data := map[string]interface{}{"A": float32(1), "B": float32(2)}
+	evaluateDerivedRegisters(data)
+	if data["Sum"] != 3.0 || data["Double"] != 6.0 {
+		t.Errorf("Sum = %v, Double = %v; cần 3 và 6", data["Sum"], data["Double"])
+	}
+	for name := range wantErrs {
+		if name != "B" && data[name] != "INVALID_EXPR_CFG" {
+			t.Errorf("%s = %v, cần INVALID_EXPR_CFG", name, data[name])
+		}
+	}
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"modbus_test/decode"
+)
+
+// --- Cấu hình tính điện năng tiêu thụ và công suất yêu cầu (demand) ---
+const (
+	enableEnergy            = true
+	energyCounterScale      = 0.001 // !!! Giả định !!! Accum_* có đơn vị Wh/varh/VAh, nhân 0.001 để ra kWh
+	logEnergyCSVFile        = "modbus_energy_%s.csv"
+	energyStateFile         = "energy_state.json" // Lưu trong logDir, giữ tổng ngày/tháng qua các lần khởi động
+	energyStateSaveInterval = 1 * time.Minute
+	demandSubInterval       = 1 * time.Minute  // Bước trượt của rolling demand
+	defaultDemandInterval   = 15 * time.Minute // Dùng khi không đọc được Pwr_Dem_Interval_Dur
+	demandIntervalRegister  = "Pwr_Dem_Interval_Dur"
+	energyGapThreshold      = 1 * time.Minute // Hai lần đọc bộ đếm cách nhau lâu hơn được coi là khoảng trống (dừng chương trình, mất kết nối)
+)
+
+// Các thanh ghi tích lũy dùng để tính điện năng tiêu thụ.
+var energyCounters = []string{
+	"Accum_AE_Del", "Accum_AE_Rec",
+	"Accum_RE_Del", "Accum_RE_Rec",
+	"Accum_APE_Del", "Accum_APE_Rec",
+}
+
+// Các khoảng thời gian tính điện năng tiêu thụ, căn theo mốc giờ thực.
+var energyIntervals = []time.Duration{15 * time.Minute, 1 * time.Hour, 24 * time.Hour}
+
+// energyState là phần trạng thái được lưu xuống đĩa.
+type energyState struct {
+	Day           string               `json:"day"`   // 2006-01-02
+	Month         string               `json:"month"` // 2006-01
+	LastValues    map[string]float64   `json:"last_values"`
+	LastTimes     map[string]time.Time `json:"last_times"`
+	ResetTime     string               `json:"reset_time"` // Giá trị Accum_Energy_Reset_Time lần đọc trước
+	DailyTotals   map[string]float64   `json:"daily_totals"`
+	MonthlyTotals map[string]float64   `json:"monthly_totals"`
+}
+
+// energyBucket cộng dồn điện năng tiêu thụ trong một khoảng thời gian.
+type energyBucket struct {
+	start, end time.Time
+	sums       map[string]float64
+}
+
+// demandTracker tính block demand và rolling demand cho một khoảng demand.
+type demandTracker struct {
+	interval   time.Duration
+	block      *energyBucket
+	sub        *energyBucket
+	subHistory []map[string]float64 // Tổng điện năng của các bước trượt gần nhất
+}
+
+type energyTracker struct {
+	state     energyState
+	intervals []*energyBucket
+	demand    *demandTracker
+	lastSave  time.Time
+	csvFile   *os.File
+	csvWriter *csv.Writer
+}
+
+var energy *energyTracker
+
+// energyUnit trả về đơn vị điện năng và công suất của một thanh ghi tích lũy.
+func energyUnit(counter string) (string, string) {
+	switch {
+	case strings.Contains(counter, "_APE_"):
+		return "kVAh", "kVA"
+	case strings.Contains(counter, "_RE_"):
+		return "kvarh", "kvar"
+	default:
+		return "kWh", "kW"
+	}
+}
+
+func newEnergyBucket(ts time.Time, interval time.Duration) *energyBucket {
+	start := alignWindow(ts, interval)
+	return &energyBucket{start: start, end: start.Add(interval), sums: make(map[string]float64)}
+}
+
+// --- Hàm khởi tạo module điện năng: nạp trạng thái cũ và mở file CSV ---
+func setupEnergy() {
+	if !enableEnergy {
+		return
+	}
+	energy = &energyTracker{}
+	statePath := filepath.Join(logDir, energyStateFile)
+	if raw, err := os.ReadFile(statePath); err == nil {
+		if err := json.Unmarshal(raw, &energy.state); err != nil {
+			log.Printf("Lỗi đọc trạng thái điện năng '%s': %v. Bắt đầu lại từ đầu.", statePath, err)
+			energy.state = energyState{}
+		} else {
+			log.Printf("Đã nạp trạng thái điện năng từ %s (ngày %s)", statePath, energy.state.Day)
+		}
+	}
+	if energy.state.LastValues == nil {
+		energy.state.LastValues = make(map[string]float64)
+	}
+	if energy.state.LastTimes == nil {
+		energy.state.LastTimes = make(map[string]time.Time)
+	}
+	if energy.state.DailyTotals == nil {
+		energy.state.DailyTotals = make(map[string]float64)
+	}
+	if energy.state.MonthlyTotals == nil {
+		energy.state.MonthlyTotals = make(map[string]float64)
+	}
+
+	csvPath := filepath.Join(logDir, fmt.Sprintf(logEnergyCSVFile, time.Now().Format("20060102_150405")))
+	f, err := os.Create(csvPath)
+	if err != nil {
+		log.Printf("Lỗi tạo file CSV điện năng '%s': %v", csvPath, err)
+		return
+	}
+	energy.csvFile = f
+	energy.csvWriter = csv.NewWriter(f)
+	energy.csvWriter.Write([]string{"PeriodStart", "PeriodEnd", "Kind", "Counter", "Value", "Unit"})
+	energy.csvWriter.Flush()
+	log.Printf("Log CSV điện năng sẽ được ghi tại: %s", csvPath)
+}
+
+// processEnergyCycle tính điện năng tiêu thụ từ các thanh ghi tích lũy của một chu kỳ đọc.
+func processEnergyCycle(ts time.Time, data map[string]interface{}) {
+	if energy == nil {
+		return
+	}
+	e := energy
+	e.rollPeriods(ts)
+
+	e.checkResetTime(data)
+	gaps := make(map[string]float64)
+	var gapStart time.Time
+	for _, counter := range energyCounters {
+		raw, quality := decode.Classify(data[counter])
+		if quality != decode.QualityGood {
+			continue
+		}
+		since := e.state.LastTimes[counter]
+		delta, ok := e.counterDelta(counter, raw, ts)
+		if !ok {
+			continue
+		}
+		if ts.Sub(since) <= energyGapThreshold {
+			e.credit(counter, delta, ts)
+			continue
+		}
+		// Khoảng trống: chỉ cộng vào các khoảng chứa trọn khoảng trống, phần điện năng còn lại
+		// được ghi riêng thành dòng "gap" thay vì dồn hết vào khoảng hiện tại
+		e.credit(counter, delta, since)
+		unit, _ := energyUnit(counter)
+		e.emit(since, ts, "gap", counter, delta, unit)
+		gaps[counter] = delta
+		gapStart = since
+	}
+	if len(gaps) > 0 {
+		logrus.WithFields(logrus.Fields{"gap_start": gapStart.Format(time.RFC3339), "gap_end": ts.Format(time.RFC3339), "consumption": roundMap(gaps)}).Warn("Energy Gap")
+	}
+	e.updateDemandInterval(ts, data)
+
+	if ts.Sub(e.lastSave) >= energyStateSaveInterval {
+		e.saveState()
+		e.lastSave = ts
+	}
+}
+
+// credit cộng điện năng tiêu thụ của một bộ đếm vào các khoảng thời gian đang mở có chứa thời điểm since
+// (tổng ngày/tháng, các interval và demand). Với chu kỳ liên tục, since chính là thời điểm hiện tại.
+func (e *energyTracker) credit(counter string, delta float64, since time.Time) {
+	if since.Format("2006-01-02") == e.state.Day {
+		e.state.DailyTotals[counter] += delta
+	}
+	if since.Format("2006-01") == e.state.Month {
+		e.state.MonthlyTotals[counter] += delta
+	}
+	for _, bucket := range e.intervals {
+		if !since.Before(bucket.start) {
+			bucket.sums[counter] += delta
+		}
+	}
+	if d := e.demand; d != nil {
+		if !since.Before(d.block.start) {
+			d.block.sums[counter] += delta
+		}
+		if !since.Before(d.sub.start) {
+			d.sub.sums[counter] += delta
+		}
+	}
+}
+
+// rollPeriods đóng các khoảng thời gian đã kết thúc trước ts (interval, demand, ngày, tháng).
+func (e *energyTracker) rollPeriods(ts time.Time) {
+	if len(e.intervals) == 0 {
+		for _, interval := range energyIntervals {
+			e.intervals = append(e.intervals, newEnergyBucket(ts, interval))
+		}
+	}
+	for i, bucket := range e.intervals {
+		if !ts.Before(bucket.end) {
+			label := "interval_" + windowLabel(energyIntervals[i])
+			for _, counter := range energyCounters {
+				unit, _ := energyUnit(counter)
+				e.emit(bucket.start, bucket.end, label, counter, bucket.sums[counter], unit)
+			}
+			logrus.WithFields(logrus.Fields{"interval": windowLabel(energyIntervals[i]), "period_start": bucket.start.Format(time.RFC3339), "consumption": roundMap(bucket.sums)}).Info("Energy Interval")
+			e.intervals[i] = newEnergyBucket(ts, energyIntervals[i])
+		}
+	}
+
+	if d := e.demand; d != nil {
+		maxLen := int(d.interval / demandSubInterval)
+		for steps := 0; !ts.Before(d.sub.end); steps++ {
+			// Các bước trượt không có dữ liệu (mất kết nối) được tính là 0 để giữ đúng cửa sổ thời gian
+			if steps < maxLen {
+				d.subHistory = append(d.subHistory, d.sub.sums)
+				if len(d.subHistory) > maxLen {
+					d.subHistory = d.subHistory[len(d.subHistory)-maxLen:]
+				}
+				if len(d.subHistory) == maxLen {
+					e.emitRollingDemand(d)
+				}
+			} else {
+				d.subHistory = d.subHistory[:0]
+			}
+			d.sub = &energyBucket{start: d.sub.end, end: d.sub.end.Add(demandSubInterval), sums: make(map[string]float64)}
+		}
+		if !ts.Before(d.block.end) {
+			block := make(map[string]float64)
+			for _, counter := range energyCounters {
+				_, unit := energyUnit(counter)
+				block[counter] = d.block.sums[counter] / d.interval.Hours()
+				e.emit(d.block.start, d.block.end, "block_demand", counter, block[counter], unit)
+			}
+			logrus.WithFields(logrus.Fields{"demand_interval_min": d.interval.Minutes(), "period_start": d.block.start.Format(time.RFC3339), "demand": roundMap(block)}).Info("Energy Block Demand")
+			d.block = newEnergyBucket(ts, d.interval)
+		}
+	}
+
+	day, month := ts.Format("2006-01-02"), ts.Format("2006-01")
+	if e.state.Day != "" && e.state.Day != day {
+		e.emitTotals("daily", e.state.Day, e.state.DailyTotals)
+		e.state.DailyTotals = make(map[string]float64)
+	}
+	if e.state.Month != "" && e.state.Month != month {
+		e.emitTotals("monthly", e.state.Month, e.state.MonthlyTotals)
+		e.state.MonthlyTotals = make(map[string]float64)
+	}
+	e.state.Day, e.state.Month = day, month
+}
+
+// updateDemandInterval đồng bộ khoảng demand với cấu hình của đồng hồ (thanh ghi Pwr_Dem_Interval_Dur, phút).
+func (e *energyTracker) updateDemandInterval(ts time.Time, data map[string]interface{}) {
+	interval := defaultDemandInterval
+	if minutes, quality := decode.Classify(data[demandIntervalRegister]); quality == decode.QualityGood && minutes > 0 {
+		interval = time.Duration(minutes) * time.Minute
+	}
+	if interval%demandSubInterval != 0 || (24*time.Hour)%interval != 0 {
+		interval = defaultDemandInterval
+	}
+	if e.demand != nil && e.demand.interval == interval {
+		return
+	}
+	if e.demand != nil {
+		logrus.WithFields(logrus.Fields{"old_interval_min": e.demand.interval.Minutes(), "new_interval_min": interval.Minutes()}).Warn("Khoảng demand của đồng hồ thay đổi, bắt đầu tính lại demand")
+	}
+	e.demand = &demandTracker{
+		interval: interval,
+		block:    newEnergyBucket(ts, interval),
+		sub:      newEnergyBucket(ts, demandSubInterval),
+	}
+}
+
+// emitRollingDemand ghi rolling demand của cửa sổ kết thúc tại d.sub.end.
+func (e *energyTracker) emitRollingDemand(d *demandTracker) {
+	rolling := make(map[string]float64)
+	for _, sums := range d.subHistory {
+		for counter, v := range sums {
+			rolling[counter] += v / d.interval.Hours()
+		}
+	}
+	for _, counter := range energyCounters {
+		_, unit := energyUnit(counter)
+		e.emit(d.sub.end.Add(-d.interval), d.sub.end, "rolling_demand", counter, rolling[counter], unit)
+	}
+	logrus.WithFields(logrus.Fields{"demand_interval_min": d.interval.Minutes(), "period_end": d.sub.end.Format(time.RFC3339), "demand": roundMap(rolling)}).Info("Energy Rolling Demand")
+}
+
+func (e *energyTracker) emitTotals(kind, period string, totals map[string]float64) {
+	start, _ := time.ParseInLocation("2006-01-02", period, time.Local)
+	end := start.AddDate(0, 0, 1)
+	if kind == "monthly" {
+		start, _ = time.ParseInLocation("2006-01", period, time.Local)
+		end = start.AddDate(0, 1, 0)
+	}
+	for _, counter := range energyCounters {
+		unit, _ := energyUnit(counter)
+		e.emit(start, end, kind, counter, totals[counter], unit)
+	}
+	logrus.WithFields(logrus.Fields{"kind": kind, "period": period, "consumption": roundMap(totals)}).Info("Energy Total")
+}
+
+func (e *energyTracker) emit(start, end time.Time, kind, counter string, value float64, unit string) {
+	if e.csvWriter == nil {
+		return
+	}
+	row := []string{
+		start.Format("2006-01-02 15:04:05"), end.Format("2006-01-02 15:04:05"), kind, counter,
+		strconv.FormatFloat(math.Round(value*10000)/10000, 'f', -1, 64), unit,
+	}
+	if err := e.csvWriter.Write(row); err != nil {
+		logrus.WithError(err).Error("Lỗi ghi dòng CSV điện năng")
+	}
+	e.csvWriter.Flush()
+}
+
+// saveState ghi trạng thái ra file tạm rồi đổi tên để tránh hỏng file khi mất điện.
+func (e *energyTracker) saveState() {
+	raw, err := json.MarshalIndent(e.state, "", "  ")
+	if err != nil {
+		logrus.WithError(err).Error("Lỗi mã hóa trạng thái điện năng")
+		return
+	}
+	statePath := filepath.Join(logDir, energyStateFile)
+	tmpPath := statePath + ".tmp"
+	if err := os.WriteFile(tmpPath, raw, 0644); err != nil {
+		logrus.WithError(err).Error("Lỗi ghi trạng thái điện năng")
+		return
+	}
+	if err := os.Rename(tmpPath, statePath); err != nil {
+		logrus.WithError(err).Error("Lỗi lưu trạng thái điện năng")
+	}
+}
+
+func roundMap(values map[string]float64) map[string]float64 {
+	rounded := make(map[string]float64, len(values))
+	for k, v := range values {
+		rounded[k] = math.Round(v*10000) / 10000
+	}
+	return rounded
+}
+
+// --- Hàm lưu trạng thái và đóng file CSV điện năng ---
+func closeEnergy() {
+	if energy == nil {
+		return
+	}
+	energy.saveState()
+	if energy.csvFile != nil {
+		energy.csvWriter.Flush()
+		energy.csvFile.Close()
+		log.Println("Đã đóng file log CSV điện năng.")
+	}
+	energy = nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"io"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// TestEnergyGapAfterRestart: điện năng tiêu thụ trong lúc chương trình dừng được ghi thành dòng "gap"
+// và không bị dồn vào interval/demand hiện tại; tổng ngày vẫn nhận vì khoảng trống nằm trọn trong ngày.
+func TestEnergyGapAfterRestart(t *testing.T) {
+	logrus.SetOutput(io.Discard)
+	oldDir := logDir
+	logDir = t.TempDir()
+	defer func() { logDir = oldDir }()
+
+	stopped := time.Date(2026, 10, 19, 10, 0, 0, 0, time.Local)
+	var out bytes.Buffer
+	e := &energyTracker{
+		state: energyState{
+			Day: stopped.Format("2006-01-02"), Month: stopped.Format("2006-01"),
+			LastValues:    map[string]float64{"Accum_AE_Del": 100},
+			LastTimes:     map[string]time.Time{"Accum_AE_Del": stopped},
+			DailyTotals:   map[string]float64{"Accum_AE_Del": 7},
+			MonthlyTotals: map[string]float64{"Accum_AE_Del": 70},
+		},
+		csvWriter: csv.NewWriter(&out),
+	}
+	oldEnergy := energy
+	energy = e
+	defer func() { energy = oldEnergy }()
+
+	restarted := stopped.Add(2*time.Hour + 30*time.Second)
+	processEnergyCycle(restarted, map[string]interface{}{"Accum_AE_Del": 150000.0})                  // 150 kWh: 50 kWh trong lúc dừng
+	processEnergyCycle(restarted.Add(time.Second), map[string]interface{}{"Accum_AE_Del": 150001.0}) // +0.001 kWh
+
+	near := func(got, want float64) bool { return math.Abs(got-want) < 1e-9 }
+	if got := e.intervals[0].sums["Accum_AE_Del"]; !near(got, 0.001) {
+		t.Errorf("interval 15m = %v, cần 0.001 (không tính khoảng trống)", got)
+	}
+	if got := e.demand.block.sums["Accum_AE_Del"]; !near(got, 0.001) {
+		t.Errorf("block demand = %v, cần 0.001 (không tính khoảng trống)", got)
+	}
+	if got := e.state.DailyTotals["Accum_AE_Del"]; !near(got, 57.001) {
+		t.Errorf("tổng ngày = %v, cần 57.001", got)
+	}
+	if got := e.state.MonthlyTotals["Accum_AE_Del"]; !near(got, 120.001) {
+		t.Errorf("tổng tháng = %v, cần 120.001", got)
+	}
+	wantRow := "2026-10-19 10:00:00,2026-10-19 12:00:30,gap,Accum_AE_Del,50,kWh"
+	if !strings.Contains(out.String(), wantRow) {
+		t.Errorf("CSV điện năng thiếu dòng %q:\n%s", wantRow, out.String())
+	}
+}
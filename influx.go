@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"modbus_test/decode"
+	"modbus_test/sinks"
+)
+
+// --- Cấu hình xuất InfluxDB line protocol ---
+const (
+	enableInflux        = false
+	influxOutput        = "file"                // "file": ghi ra logDir/influxFile; "http": gửi tới InfluxDB write API
+	influxFile          = "modbus_influx_%s.lp" // Xoay vòng/nén theo cấu hình log_rotation.go
+	influxWriteURL      = "http://localhost:8086/api/v2/write?org=my-org&bucket=modbus&precision=ns"
+	influxToken         = "" // API token (InfluxDB 2.x); rỗng nếu không cần xác thực
+	influxBatchSize     = 500
+	influxFlushInterval = 10 * time.Second
+	influxMaxRetries    = 3
+	influxRetryBackoff  = time.Second // Tăng gấp đôi sau mỗi lần thử lại
+	influxMaxBuffered   = 50000       // Số dòng tối đa giữ lại khi không gửi được; vượt quá thì bỏ dòng cũ nhất
+	influxPollMeasure   = "modbus_poll"
+)
+
+// Giá trị trường <thanh ghi>_quality khi thanh ghi không có giá trị số hợp lệ.
+const (
+	influxQualityNA    = 1
+	influxQualityError = 2
+)
+
+var (
+	influxMeasurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	influxKeyEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+)
+
+// influxLines chuyển kết quả một chu kỳ thành các dòng line protocol: mỗi nhóm thanh ghi là một
+// measurement, tag gồm thiết bị/slave ID/đường truyền, timestamp là thời điểm bắt đầu chu kỳ.
+// Giá trị lỗi/N/A không ghi dạng chuỗi mà được ghi vào trường <thanh ghi>_quality.
+func influxLines(result sinks.CycleResult) []string {
+	tags := fmt.Sprintf(",device=%s,link=%s,slave_id=%d",
+		influxKeyEscaper.Replace(deviceID), influxKeyEscaper.Replace(portLabel()), result.SlaveID)
+	ts := strconv.FormatInt(result.StartTime.UnixNano(), 10)
+
+	fieldsByGroup := make(map[string][]string)
+	var groups []string
+	for _, name := range result.Names {
+		value, ok := result.Data[name]
+		if !ok || (!influxFullRowMode && !result.Reported[name]) {
+			continue
+		}
+		var field string
+		switch v, quality := decode.Classify(value); {
+		case quality == decode.QualityGood:
+			field = influxKeyEscaper.Replace(name) + "=" + strconv.FormatFloat(decode.Float32Decimal(value, v), 'g', -1, 64)
+		case quality == decode.QualityError:
+			field = fmt.Sprintf("%s_quality=%di", influxKeyEscaper.Replace(name), influxQualityError)
+		default:
+			if str, isString := value.(string); isString && !decode.IsNA(str) {
+				continue // Chuỗi thông thường (Meter_Model, DATETIME...) không ghi vào InfluxDB
+			}
+			field = fmt.Sprintf("%s_quality=%di", influxKeyEscaper.Replace(name), influxQualityNA)
+		}
+		group := registerGroup(name)
+		if _, seen := fieldsByGroup[group]; !seen {
+			groups = append(groups, group)
+		}
+		fieldsByGroup[group] = append(fieldsByGroup[group], field)
+	}
+	sort.Strings(groups)
+
+	lines := make([]string, 0, len(groups)+1)
+	for _, group := range groups {
+		lines = append(lines, influxMeasurementEscaper.Replace(group)+tags+" "+strings.Join(fieldsByGroup[group], ",")+" "+ts)
+	}
+	lines = append(lines, fmt.Sprintf("%s%s read_duration_ms=%di,registers_ok=%di,registers_error=%di,alarms_active=%di %s",
+		influxPollMeasure, tags, result.Duration.Milliseconds(), result.RegistersOK, result.RegistersError, result.AlarmsActive, ts))
+	return lines
+}
+
+// --- Sink InfluxDB: gom dòng theo lô, ghi ra file hoặc gửi qua HTTP có thử lại ---
+type influxSink struct {
+	out       *rotatingFile
+	client    *http.Client
+	pending   []string
+	lastFlush time.Time
+}
+
+func (s *influxSink) Open() error {
+	s.lastFlush = time.Now()
+	switch influxOutput {
+	case "file":
+		out, err := openRotatingFile(influxFile, true)
+		if err != nil {
+			return err
+		}
+		s.out = out
+		log.Printf("InfluxDB line protocol sẽ được ghi tại: %s", out.Path())
+	case "http":
+		s.client = &http.Client{Timeout: 10 * time.Second}
+		log.Printf("InfluxDB line protocol sẽ được gửi tới: %s", influxWriteURL)
+	default:
+		return fmt.Errorf("influxOutput không hỗ trợ: %s", influxOutput)
+	}
+	return nil
+}
+
+func (s *influxSink) Write(ctx context.Context, result sinks.CycleResult) error {
+	s.pending = append(s.pending, influxLines(result)...)
+	if dropped := len(s.pending) - influxMaxBuffered; dropped > 0 {
+		s.pending = s.pending[dropped:]
+		logrus.WithField("dropped_lines", dropped).Warn("Bộ đệm InfluxDB đầy, bỏ các dòng cũ nhất")
+	}
+	return nil
+}
+
+// Flush chỉ gửi khi đủ lô hoặc tới hạn influxFlushInterval để tránh gửi từng chu kỳ.
+func (s *influxSink) Flush(ctx context.Context) error {
+	if len(s.pending) < influxBatchSize && time.Since(s.lastFlush) < influxFlushInterval {
+		return nil
+	}
+	return s.flushAll(ctx)
+}
+
+func (s *influxSink) flushAll(ctx context.Context) error {
+	s.lastFlush = time.Now()
+	for len(s.pending) > 0 {
+		n := len(s.pending)
+		if n > influxBatchSize {
+			n = influxBatchSize
+		}
+		body := strings.Join(s.pending[:n], "\n") + "\n"
+		if err := s.send(ctx, body); err != nil {
+			return err // Giữ lại các dòng chưa gửi cho lần sau
+		}
+		s.pending = s.pending[n:]
+	}
+	s.pending = nil
+	return nil
+}
+
+func (s *influxSink) send(ctx context.Context, body string) error {
+	if s.out != nil {
+		_, err := io.WriteString(s.out, body)
+		return err
+	}
+	backoff := influxRetryBackoff
+	var err error
+	for attempt := 0; attempt <= influxMaxRetries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return err
+			}
+			backoff *= 2
+		}
+		var retry bool
+		if retry, err = s.post(ctx, body); err == nil || !retry {
+			break
+		}
+		logrus.WithError(err).WithField("attempt", attempt+1).Warn("Lỗi gửi dữ liệu tới InfluxDB, sẽ thử lại")
+	}
+	return err
+}
+
+// post gửi một lô tới write API. Trả về retry = false với lỗi không thể khắc phục bằng thử lại
+// (dữ liệu/quyền không hợp lệ); khi đó lô bị bỏ để không chặn các lô sau.
+func (s *influxSink) post(ctx context.Context, body string) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, influxWriteURL, bytes.NewBufferString(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if influxToken != "" {
+		req.Header.Set("Authorization", "Token "+influxToken)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	switch {
+	case resp.StatusCode/100 == 2:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("InfluxDB trả về %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	logrus.WithFields(logrus.Fields{"status": resp.Status, "response": strings.TrimSpace(string(msg))}).Error("InfluxDB từ chối lô dữ liệu, bỏ qua lô này")
+	return false, nil
+}
+
+// Deliver gửi trực tiếp các chu kỳ (dùng cho store-and-forward, thay cho bộ đệm trong bộ nhớ).
+func (s *influxSink) Deliver(ctx context.Context, results []sinks.CycleResult) error {
+	var lines []string
+	for _, result := range results {
+		lines = append(lines, influxLines(result)...)
+	}
+	for start := 0; start < len(lines); start += influxBatchSize {
+		end := start + influxBatchSize
+		if end > len(lines) {
+			end = len(lines)
+		}
+		if err := s.send(ctx, strings.Join(lines[start:end], "\n")+"\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeliveryInterval: gom các chu kỳ trong hàng đợi thành lô mỗi influxFlushInterval.
+func (s *influxSink) DeliveryInterval() time.Duration { return influxFlushInterval }
+
+func (s *influxSink) Close(ctx context.Context) error {
+	err := s.flushAll(ctx)
+	if len(s.pending) > 0 {
+		logrus.WithField("lines", len(s.pending)).Warn("Còn dữ liệu InfluxDB chưa gửi được khi thoát")
+	}
+	if s.out != nil {
+		if closeErr := s.out.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"modbus_test/decode"
+	"modbus_test/sinks"
+)
+
+func TestInfluxLines(t *testing.T) {
+	result := sinks.CycleResult{
+		Cycle: 2, StartTime: time.Unix(1760000000, 5), Duration: 120 * time.Millisecond, SlaveID: 1,
+		Names: []string{"Meter_Model", "AE_Delivered", "AE_Received", "RE_Delivered", "Frequency"},
+		Data: map[string]interface{}{
+			"Meter_Model":  "PM5560",
+			"AE_Delivered": float32(1234.5),
+			"AE_Received":  "N/A_FLOAT32",
+			"RE_Delivered": decode.ReadError,
+			"Frequency":    float32(50.01),
+		},
+		Reported:       map[string]bool{"Meter_Model": true, "AE_Delivered": true, "AE_Received": true, "RE_Delivered": true}, // Frequency không vượt deadband vẫn được ghi (influxFullRowMode)
+		RegistersTotal: 5, RegistersOK: 3, RegistersError: 1, AlarmsActive: 2,
+	}
+	tags := fmt.Sprintf(",device=%s,link=%s,slave_id=1", influxKeyEscaper.Replace(deviceID), influxKeyEscaper.Replace(portLabel()))
+	ts := " 1760000000000000005"
+	want := []string{
+		`Energy(Inst)` + tags + " AE_Delivered=1234.5,AE_Received_quality=1i,RE_Delivered_quality=2i" + ts,
+		"Frequency" + tags + " Frequency=50.01" + ts,
+		// Các trường của modbus_poll đều là số nguyên (hậu tố i)
+		influxPollMeasure + tags + " read_duration_ms=120i,registers_ok=3i,registers_error=1i,alarms_active=2i" + ts,
+	}
+	if got := influxLines(result); !reflect.DeepEqual(got, want) {
+		t.Errorf("influxLines =\n%q\ncần\n%q", got, want)
+	}
+}
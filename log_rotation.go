@@ -0,0 +1,339 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// --- Cấu hình xoay vòng (rotation) và lưu giữ file log ---
+const (
+	logRotateMaxBytes     = 50 << 20            // Xoay vòng khi file vượt quá kích thước này (0 = không giới hạn)
+	logRotateInterval     = "daily"             // "daily" (nửa đêm), "hourly" (đầu mỗi giờ) hoặc "" (không xoay theo thời gian)
+	logCompressRotated    = true                // Nén gzip các file log đã đóng
+	logRetentionMaxAge    = 30 * 24 * time.Hour // Xóa file log cũ hơn khoảng này (0 = không giới hạn)
+	logRetentionMaxBytes  = 2 << 30             // Tổng dung lượng tối đa của logDir; vượt quá thì xóa file log cũ nhất (0 = không giới hạn)
+	logMaintenanceTimeout = 10 * time.Second    // Thời gian chờ nén/dọn dẹp khi thoát chương trình
+)
+
+// logRetentionExclude: mẫu tên file (filepath.Match, so với tên trong logDir, bỏ qua đuôi .gz) không
+// bao giờ bị nén/xóa tự động. Mặc định giữ lại log mẫu của PM5560 thật đã lưu trong logs_go_final
+// (dùng làm seed cho fuzz test).
+var logRetentionExclude = []string{"modbus_data_go_20250411_*"}
+
+// rotatingFile là file log tự xoay vòng theo kích thước và theo mốc thời gian. Tên file được
+// tạo từ pattern (chứa một %s cho timestamp) tại thời điểm mở. File cũ sau khi đóng được nén
+// và áp dụng giới hạn lưu giữ ở goroutine nền.
+type rotatingFile struct {
+	mu         sync.Mutex
+	pattern    string
+	autoRotate bool // true: tự kiểm tra xoay vòng trước mỗi lần Write (mỗi lần Write là một bản ghi trọn vẹn)
+	file       *os.File
+	path       string
+	size       int64
+	period     string
+}
+
+var (
+	activeLogMu    sync.Mutex
+	activeLogFiles = make(map[string]bool) // File đang mở, không được nén/xóa
+
+	logMaintenanceMu sync.Mutex
+	logMaintenanceWG sync.WaitGroup
+)
+
+// openRotatingFile mở file log mới theo pattern. Với autoRotate = false, người gọi phải tự gọi
+// RotateIfDue ở ranh giới bản ghi (ví dụ CSV cần ghi lại header).
+func openRotatingFile(pattern string, autoRotate bool) (*rotatingFile, error) {
+	r := &rotatingFile{pattern: pattern, autoRotate: autoRotate}
+	f, path, err := createLogFile(pattern, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	r.file, r.path, r.period = f, path, rotationPeriod(time.Now())
+	return r, nil
+}
+
+func createLogFile(pattern string, now time.Time) (*os.File, string, error) {
+	name := fmt.Sprintf(pattern, now.Format("20060102_150405"))
+	path := filepath.Join(logDir, name)
+	ext := filepath.Ext(name)
+	for i := 1; ; i++ {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			break
+		}
+		path = filepath.Join(logDir, fmt.Sprintf("%s_%d%s", strings.TrimSuffix(name, ext), i, ext))
+	}
+	setLogFileActive(path, true)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		setLogFileActive(path, false)
+		return nil, "", fmt.Errorf("lỗi mở file log '%s': %w", path, err)
+	}
+	return f, path, nil
+}
+
+func rotationPeriod(t time.Time) string {
+	switch logRotateInterval {
+	case "hourly":
+		return t.Format("2006010215")
+	case "daily":
+		return t.Format("20060102")
+	}
+	return ""
+}
+
+func setLogFileActive(path string, active bool) {
+	activeLogMu.Lock()
+	defer activeLogMu.Unlock()
+	if active {
+		activeLogFiles[path] = true
+	} else {
+		delete(activeLogFiles, path)
+	}
+}
+
+func isLogFileActive(path string) bool {
+	activeLogMu.Lock()
+	defer activeLogMu.Unlock()
+	return activeLogFiles[path]
+}
+
+// isMaintainedLogFile: file được nén và xóa tự động là mọi file log dữ liệu trong logDir (kể cả
+// của các lần chạy trước), trừ các file khớp logRetentionExclude.
+func isMaintainedLogFile(path string) bool {
+	name := filepath.Base(path)
+	if !isManagedLogFile(name) {
+		return false
+	}
+	for _, pattern := range logRetentionExclude {
+		if ok, _ := filepath.Match(pattern, strings.TrimSuffix(name, ".gz")); ok {
+			return false
+		}
+	}
+	return true
+}
+
+// Path trả về đường dẫn file đang ghi.
+func (r *rotatingFile) Path() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.path
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file == nil {
+		return 0, os.ErrClosed
+	}
+	if r.autoRotate {
+		if _, err := r.rotateIfDueLocked(time.Now(), len(p)); err != nil {
+			log.Printf("Lỗi xoay vòng file log '%s': %v. Tiếp tục ghi vào file cũ.", r.path, err)
+		}
+	}
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// RotateIfDue xoay vòng file nếu đã vượt kích thước hoặc sang mốc thời gian mới.
+// Trả về true nếu đã chuyển sang file mới.
+func (r *rotatingFile) RotateIfDue(now time.Time) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file == nil {
+		return false, os.ErrClosed
+	}
+	return r.rotateIfDueLocked(now, 0)
+}
+
+func (r *rotatingFile) rotateIfDueLocked(now time.Time, incoming int) (bool, error) {
+	bySize := logRotateMaxBytes > 0 && r.size > 0 && r.size+int64(incoming) > logRotateMaxBytes
+	byTime := rotationPeriod(now) != r.period
+	if !bySize && !byTime {
+		return false, nil
+	}
+	// Mở file mới trước, nếu lỗi thì vẫn ghi tiếp vào file cũ
+	f, path, err := createLogFile(r.pattern, now)
+	if err != nil {
+		r.period = rotationPeriod(now) // Tránh thử lại liên tục trong cùng mốc thời gian
+		return false, err
+	}
+	oldPath := r.path
+	if err := r.file.Close(); err != nil {
+		log.Printf("Lỗi đóng file log '%s': %v", oldPath, err)
+	}
+	setLogFileActive(oldPath, false)
+	r.file, r.path, r.size, r.period = f, path, 0, rotationPeriod(now)
+	log.Printf("Đã xoay vòng file log: %s -> %s", filepath.Base(oldPath), filepath.Base(path))
+	scheduleLogMaintenance(oldPath)
+	return true, nil
+}
+
+func (r *rotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	setLogFileActive(r.path, false)
+	r.file = nil
+	return err
+}
+
+// scheduleLogMaintenance nén file vừa đóng (nếu có) và áp dụng giới hạn lưu giữ ở goroutine nền.
+// closedPath rỗng: nén mọi file log còn sót lại từ lần chạy trước.
+func scheduleLogMaintenance(closedPath string) {
+	logMaintenanceWG.Add(1)
+	go func() {
+		defer logMaintenanceWG.Done()
+		logMaintenanceMu.Lock()
+		defer logMaintenanceMu.Unlock()
+		if logCompressRotated {
+			paths := []string{closedPath}
+			if closedPath == "" {
+				paths = uncompressedLogFiles()
+			}
+			for _, path := range paths {
+				if err := compressLogFile(path); err != nil && !os.IsNotExist(err) { // Có thể đã được nén bởi tác vụ trước
+					logrus.WithError(err).WithField("file", path).Warn("Lỗi nén file log")
+				}
+			}
+		}
+		enforceLogRetention(time.Now())
+	}()
+}
+
+// waitLogMaintenance chờ các tác vụ nén/dọn dẹp đang chạy, tối đa timeout.
+func waitLogMaintenance(timeout time.Duration) {
+	done := make(chan struct{})
+	go func() { logMaintenanceWG.Wait(); close(done) }()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		log.Printf("Hết thời gian chờ nén/dọn dẹp file log (%v).", timeout)
+	}
+}
+
+// isManagedLogFile: chỉ các file log dữ liệu chính (CSV/JSON) và file line protocol của InfluxDB
+// được nén và xóa tự động.
+func isManagedLogFile(name string) bool {
+	name = strings.TrimSuffix(name, ".gz")
+	for _, pattern := range []string{logCSVFile, logJSONFile, influxFile} {
+		prefix := pattern[:strings.Index(pattern, "%s")]
+		if strings.HasPrefix(name, prefix) && filepath.Ext(name) == filepath.Ext(pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+func uncompressedLogFiles() []string {
+	entries, err := os.ReadDir(logDir)
+	if err != nil {
+		return nil
+	}
+	var paths []string
+	for _, entry := range entries {
+		path := filepath.Join(logDir, entry.Name())
+		if entry.Type().IsRegular() && isMaintainedLogFile(path) && !strings.HasSuffix(entry.Name(), ".gz") && !isLogFileActive(path) {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+func compressLogFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	tmpPath := path + ".gz.tmp"
+	dst, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(dst)
+	zw.Name = filepath.Base(path)
+	zw.ModTime = info.ModTime()
+	_, err = io.Copy(zw, src)
+	if closeErr := zw.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path+".gz")
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	os.Chtimes(path+".gz", info.ModTime(), info.ModTime()) // Giữ thời điểm ghi cuối để tính tuổi file khi dọn dẹp
+	src.Close()
+	return os.Remove(path)
+}
+
+// enforceLogRetention xóa file log quá hạn lưu giữ, sau đó xóa file cũ nhất cho tới khi tổng
+// dung lượng logDir nằm trong giới hạn. Chỉ file log dữ liệu (isMaintainedLogFile) bị xóa; file đang
+// mở, file khớp logRetentionExclude và các file khác không bị xóa nhưng vẫn được tính vào tổng.
+func enforceLogRetention(now time.Time) {
+	entries, err := os.ReadDir(logDir)
+	if err != nil {
+		return
+	}
+	type logFileInfo struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+	var candidates []logFileInfo
+	var total int64
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		total += info.Size()
+		path := filepath.Join(logDir, entry.Name())
+		if isMaintainedLogFile(path) && !isLogFileActive(path) {
+			candidates = append(candidates, logFileInfo{path: path, size: info.Size(), modTime: info.ModTime()})
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].modTime.Before(candidates[j].modTime) })
+
+	for _, c := range candidates {
+		expired := logRetentionMaxAge > 0 && now.Sub(c.modTime) > logRetentionMaxAge
+		overQuota := logRetentionMaxBytes > 0 && total > logRetentionMaxBytes
+		if !expired && !overQuota {
+			continue
+		}
+		if err := os.Remove(c.path); err != nil {
+			logrus.WithError(err).WithField("file", c.path).Warn("Lỗi xóa file log cũ")
+			continue
+		}
+		total -= c.size
+		reason := "max_age"
+		if !expired {
+			reason = "max_total_size"
+		}
+		logrus.WithFields(logrus.Fields{"file": filepath.Base(c.path), "size_bytes": c.size, "reason": reason}).Info("Log Retention")
+	}
+}
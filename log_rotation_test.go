@@ -0,0 +1,55 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// TestLogMaintenanceExistingFiles: file log của lần chạy trước cũng được nén và xóa theo giới hạn
+// lưu giữ; file khớp logRetentionExclude và file không phải log dữ liệu được giữ nguyên.
+func TestLogMaintenanceExistingFiles(t *testing.T) {
+	logrus.SetOutput(io.Discard)
+	oldDir := logDir
+	logDir = t.TempDir()
+	defer func() { logDir = oldDir }()
+
+	now := time.Now()
+	old := now.Add(-logRetentionMaxAge - time.Hour)
+	files := map[string]time.Time{
+		"modbus_data_go_20260101_000000.csv":    old, // Lần chạy trước, quá hạn: bị xóa
+		"modbus_data_go_20260101_000000.log.gz": old,
+		"modbus_data_go_20261018_080000.csv":    now.Add(-time.Hour), // Lần chạy trước, còn hạn: được nén
+		"modbus_influx_20260101_000000.lp":      old,
+		"modbus_data_go_20250411_172328.log":    old, // Log mẫu (logRetentionExclude)
+		"modbus_energy_20260101_000000.csv":     old, // Không phải log dữ liệu
+	}
+	for name, mtime := range files {
+		path := filepath.Join(logDir, name)
+		if err := os.WriteFile(path, []byte("x\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(path, mtime, mtime)
+	}
+
+	scheduleLogMaintenance("")
+	waitLogMaintenance(5 * time.Second)
+
+	for name, wantExist := range map[string]bool{
+		"modbus_data_go_20260101_000000.csv":    false,
+		"modbus_data_go_20260101_000000.log.gz": false,
+		"modbus_data_go_20261018_080000.csv":    false,
+		"modbus_data_go_20261018_080000.csv.gz": true,
+		"modbus_influx_20260101_000000.lp":      false,
+		"modbus_data_go_20250411_172328.log":    true,
+		"modbus_energy_20260101_000000.csv":     true,
+	} {
+		if _, err := os.Stat(filepath.Join(logDir, name)); (err == nil) != wantExist {
+			t.Errorf("%s: tồn tại = %v, cần %v", name, err == nil, wantExist)
+		}
+	}
+}
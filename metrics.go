@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"modbus_test/decode"
+	"modbus_test/registermap"
+	"modbus_test/sinks"
+)
+
+// --- Cấu hình Prometheus exporter ---
+const (
+	enableMetrics     = true
+	metricsListenAddr = ":2112" // Địa chỉ HTTP cho endpoint /metrics
+	metricsPath       = "/metrics"
+	metricsNamespace  = "modbus"
+)
+
+// metricsDevice là giá trị nhãn "device" của thiết bị đang đọc.
+var metricsDevice = fmt.Sprintf("%s:%d", portNameSimple, slaveID)
+
+// Các metric của vòng lặp đọc. Được cập nhật kể cả khi exporter tắt (chi phí không đáng kể).
+var (
+	metricsRegistry = prometheus.NewRegistry()
+
+	metricRegisterValue = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace, Name: "register_value",
+		Help: "Giá trị đọc gần nhất của thanh ghi (chỉ thanh ghi có giá trị số hợp lệ).",
+	}, []string{"device", "register", "group", "unit"})
+	metricReadDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace, Name: "read_cycle_duration_seconds",
+		Help:    "Thời gian đọc toàn bộ thanh ghi trong một chu kỳ.",
+		Buckets: []float64{0.1, 0.25, 0.5, 1, 2, 5, 10, 30},
+	}, []string{"device"})
+	metricReadCycles = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace, Name: "read_cycles_total", Help: "Số chu kỳ đọc đã hoàn thành.",
+	}, []string{"device"})
+	metricRegistersOK = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace, Name: "registers_ok_total", Help: "Số lần đọc thanh ghi thành công.",
+	}, []string{"device"})
+	metricRegistersError = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace, Name: "registers_error_total", Help: "Số lần đọc thanh ghi lỗi.",
+	}, []string{"device"})
+	metricTimeouts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace, Name: "timeouts_total", Help: "Số lần timeout khi chờ phản hồi từ Slave.",
+	}, []string{"device"})
+	metricExceptions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace, Name: "exceptions_total", Help: "Số phản hồi Modbus exception theo mã lỗi.",
+	}, []string{"device", "code"})
+	metricCommErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace, Name: "comm_errors_total", Help: "Số lỗi giao tiếp khác (không phải timeout/exception).",
+	}, []string{"device"})
+	metricReconnects = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace, Name: "reconnects_total", Help: "Số lần kết nối lại thành công sau lần kết nối đầu tiên.",
+	}, []string{"device"})
+	metricConnectErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace, Name: "connect_errors_total", Help: "Số lần kết nối thất bại.",
+	}, []string{"device"})
+	metricConnected = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace, Name: "connected", Help: "1 nếu đang kết nối tới thiết bị, 0 nếu không.",
+	}, []string{"device"})
+	metricActiveAlarms = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace, Name: "active_alarms", Help: "Số cảnh báo đang active.",
+	}, []string{"device"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		metricRegisterValue, metricReadDuration, metricReadCycles, metricRegistersOK, metricRegistersError,
+		metricTimeouts, metricExceptions, metricCommErrors, metricReconnects, metricConnectErrors,
+		metricConnected, metricActiveAlarms,
+	)
+	metricsRegistry.MustRegister(sinks.Collectors()...) // Hàng đợi store-and-forward
+}
+
+// metricsSink cập nhật gauge giá trị thanh ghi và metric của chu kỳ đọc, đồng thời phục vụ
+// endpoint /metrics cho Prometheus.
+type metricsSink struct {
+	server *http.Server
+}
+
+func (s *metricsSink) Open() error {
+	mux := http.NewServeMux()
+	mux.Handle(metricsPath, promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+	s.server = &http.Server{Addr: metricsListenAddr, Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		if err := s.server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("Lỗi Prometheus exporter tại %s: %v", metricsListenAddr, err)
+		}
+	}()
+	log.Printf("Prometheus metrics tại http://%s%s", metricsListenAddr, metricsPath)
+	return nil
+}
+
+func (s *metricsSink) Write(ctx context.Context, result sinks.CycleResult) error {
+	metricReadDuration.WithLabelValues(metricsDevice).Observe(result.Duration.Seconds())
+	metricReadCycles.WithLabelValues(metricsDevice).Inc()
+	metricRegistersOK.WithLabelValues(metricsDevice).Add(float64(result.RegistersOK))
+	metricRegistersError.WithLabelValues(metricsDevice).Add(float64(result.RegistersError))
+	metricActiveAlarms.WithLabelValues(metricsDevice).Set(float64(result.AlarmsActive))
+	for _, name := range result.Names {
+		labels := prometheus.Labels{"device": metricsDevice, "register": name, "group": registerGroup(name), "unit": registermap.Unit(name)}
+		value, quality := decode.Classify(result.Data[name])
+		if quality != decode.QualityGood {
+			metricRegisterValue.Delete(labels) // Không xuất giá trị cũ khi thanh ghi lỗi/N/A
+			continue
+		}
+		metricRegisterValue.With(labels).Set(value)
+	}
+	return nil
+}
+
+func (s *metricsSink) Flush(ctx context.Context) error { return nil }
+
+func (s *metricsSink) Close(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	return s.server.Shutdown(ctx)
+}
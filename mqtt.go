@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/sirupsen/logrus"
+
+	"modbus_test/registermap"
+	"modbus_test/sinks"
+)
+
+// --- Cấu hình MQTT ---
+const (
+	enableMQTT         = false
+	mqttBrokerURL      = "tcp://localhost:1883" // Dùng "ssl://host:8883" khi bật TLS
+	mqttClientID       = "modbus_go_client"
+	mqttUsername       = ""
+	mqttPassword       = ""
+	mqttTopicPrefix    = "modbus"
+	mqttPayloadMode    = "register" // "register": mỗi thanh ghi một topic <prefix>/<device>/<group>/<register>; "cycle": một bản tin JSON mỗi chu kỳ tại <prefix>/<device>/data
+	mqttQoS            = byte(1)
+	mqttRetain         = true // Giữ giá trị cuối trên broker cho client đăng ký sau
+	mqttConnectTimeout = 10 * time.Second
+	mqttPublishTimeout = 5 * time.Second
+
+	// TLS (chỉ dùng khi mqttBrokerURL là ssl:// hoặc tls://)
+	mqttTLSCAFile             = "" // File CA (PEM) để xác thực broker; rỗng = dùng CA của hệ thống
+	mqttTLSCertFile           = "" // Chứng chỉ client (PEM) nếu broker yêu cầu xác thực 2 chiều
+	mqttTLSKeyFile            = ""
+	mqttTLSInsecureSkipVerify = false
+)
+
+// Trạng thái chương trình trên topic <prefix>/<device>/status (retained). Broker tự gửi
+// "offline" qua LWT khi chương trình mất kết nối bất thường.
+const (
+	mqttStatusOnline  = "online"
+	mqttStatusOffline = "offline"
+)
+
+// mqttClient là phần tối thiểu của MQTT client mà sink cần. Có thể thay newMQTTClient bằng
+// client giả lập (broker stand-in) khi kiểm thử không có broker thật.
+type mqttClient interface {
+	Connect(timeout time.Duration) error
+	IsConnected() bool // Kết nối tới broker đang mở (không tính lúc đang kết nối lại)
+	Publish(ctx context.Context, topic string, qos byte, retained bool, payload []byte) error
+	Disconnect(quiesce time.Duration)
+}
+
+// errMQTTNotConnected: Deliver không publish khi chưa có kết nối, để paho không giữ bản tin trong
+// hàng đợi riêng rồi gửi lại sau khi hàng đợi store-and-forward đã coi lô đó là lỗi (trùng lặp,
+// sai thứ tự, giá trị retained cũ ghi đè giá trị mới).
+var errMQTTNotConnected = errors.New("chưa kết nối MQTT broker")
+
+type mqttClientOptions struct {
+	Broker      string
+	ClientID    string
+	Username    string
+	Password    string
+	TLS         *tls.Config
+	WillTopic   string
+	WillPayload string
+	OnConnect   func() // Gọi sau mỗi lần kết nối/kết nối lại thành công
+}
+
+var newMQTTClient = newPahoMQTTClient
+
+type pahoMQTTClient struct {
+	client mqtt.Client
+}
+
+func newPahoMQTTClient(o mqttClientOptions) mqttClient {
+	opts := mqtt.NewClientOptions().AddBroker(o.Broker).SetClientID(o.ClientID)
+	opts.SetUsername(o.Username)
+	opts.SetPassword(o.Password)
+	if o.TLS != nil {
+		opts.SetTLSConfig(o.TLS)
+	}
+	opts.SetWill(o.WillTopic, o.WillPayload, mqttQoS, true)
+	opts.SetCleanSession(true) // Không gửi lại bản tin QoS 1 dở dang sau khi kết nối lại; hàng đợi trên đĩa lo việc gửi lại
+	opts.SetAutoReconnect(true)
+	opts.SetConnectRetry(true) // Broker chưa sẵn sàng lúc khởi động thì tiếp tục thử ở nền
+	opts.SetMaxReconnectInterval(time.Minute)
+	opts.SetOnConnectHandler(func(mqtt.Client) {
+		log.Printf("Đã kết nối MQTT broker %s", o.Broker)
+		if o.OnConnect != nil {
+			go o.OnConnect() // Không publish trực tiếp trong handler của paho
+		}
+	})
+	opts.SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+		logrus.WithError(err).WithField("broker", o.Broker).Warn("Mất kết nối MQTT broker, đang kết nối lại")
+	})
+	opts.SetReconnectingHandler(func(mqtt.Client, *mqtt.ClientOptions) {
+		logrus.WithField("broker", o.Broker).Debug("Đang kết nối lại MQTT broker")
+	})
+	return &pahoMQTTClient{client: mqtt.NewClient(opts)}
+}
+
+func (c *pahoMQTTClient) Connect(timeout time.Duration) error {
+	token := c.client.Connect()
+	if !token.WaitTimeout(timeout) {
+		return nil // ConnectRetry: paho tiếp tục thử ở nền, bản tin QoS > 0 được giữ lại tới khi kết nối
+	}
+	return token.Error()
+}
+
+func (c *pahoMQTTClient) IsConnected() bool { return c.client.IsConnectionOpen() }
+
+func (c *pahoMQTTClient) Publish(ctx context.Context, topic string, qos byte, retained bool, payload []byte) error {
+	token := c.client.Publish(topic, qos, retained, payload)
+	timer := time.NewTimer(mqttPublishTimeout)
+	defer timer.Stop()
+	select {
+	case <-token.Done():
+		return token.Error()
+	case <-ctx.Done():
+		return fmt.Errorf("hủy publish tới '%s': %w", topic, ctx.Err())
+	case <-timer.C:
+		return fmt.Errorf("hết thời gian chờ publish tới '%s'", topic)
+	}
+}
+
+func (c *pahoMQTTClient) Disconnect(quiesce time.Duration) {
+	c.client.Disconnect(uint(quiesce.Milliseconds()))
+}
+
+func mqttTLSConfig() (*tls.Config, error) {
+	if !strings.HasPrefix(mqttBrokerURL, "ssl://") && !strings.HasPrefix(mqttBrokerURL, "tls://") {
+		return nil, nil
+	}
+	cfg := &tls.Config{InsecureSkipVerify: mqttTLSInsecureSkipVerify, MinVersion: tls.VersionTLS12}
+	if mqttTLSCAFile != "" {
+		pem, err := os.ReadFile(mqttTLSCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("lỗi đọc file CA '%s': %w", mqttTLSCAFile, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("file CA '%s' không chứa chứng chỉ hợp lệ", mqttTLSCAFile)
+		}
+		cfg.RootCAs = pool
+	}
+	if mqttTLSCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(mqttTLSCertFile, mqttTLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("lỗi đọc chứng chỉ client: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// mqttTopicSegment thay các ký tự không dùng được trong một cấp topic MQTT.
+func mqttTopicSegment(s string) string {
+	return strings.NewReplacer("/", "_", "+", "_", "#", "_", " ", "_", "(", "", ")", "").Replace(s)
+}
+
+func mqttTopic(parts ...string) string {
+	segments := []string{mqttTopicPrefix, mqttTopicSegment(deviceID)}
+	for _, p := range parts {
+		segments = append(segments, mqttTopicSegment(p))
+	}
+	return strings.Join(segments, "/")
+}
+
+// --- Sink MQTT ---
+type mqttSink struct {
+	mode   string // mqttPayloadMode: "register" hoặc "cycle"
+	client mqttClient
+}
+
+func (s *mqttSink) Open() error {
+	tlsCfg, err := mqttTLSConfig()
+	if err != nil {
+		return err
+	}
+	statusTopic := mqttTopic("status")
+	s.client = newMQTTClient(mqttClientOptions{
+		Broker: mqttBrokerURL, ClientID: mqttClientID, Username: mqttUsername, Password: mqttPassword, TLS: tlsCfg,
+		WillTopic: statusTopic, WillPayload: mqttStatusOffline,
+		OnConnect: func() { s.publishStatus(context.Background(), mqttStatusOnline) },
+	})
+	if err := s.client.Connect(mqttConnectTimeout); err != nil {
+		return fmt.Errorf("lỗi kết nối MQTT broker '%s': %w", mqttBrokerURL, err)
+	}
+	log.Printf("MQTT: publish tới %s, topic gốc %s (chế độ %s)", mqttBrokerURL, mqttTopic(), s.mode)
+	return nil
+}
+
+func (s *mqttSink) publishStatus(ctx context.Context, status string) {
+	if err := s.client.Publish(ctx, mqttTopic("status"), mqttQoS, true, []byte(status)); err != nil {
+		logrus.WithError(err).WithField("status", status).Warn("Lỗi publish trạng thái MQTT")
+	}
+}
+
+// mqttRegisterPayload là nội dung bản tin của một thanh ghi ở chế độ "register".
+type mqttRegisterPayload struct {
+	Timestamp string      `json:"timestamp"`
+	Value     interface{} `json:"value"`
+	Unit      string      `json:"unit,omitempty"`
+	Quality   string      `json:"quality"` // "good", "na", "error"
+}
+
+func (s *mqttSink) Write(ctx context.Context, result sinks.CycleResult) error {
+	ts := result.StartTime.Format(time.RFC3339Nano)
+	if s.mode == "cycle" {
+		data := make(map[string]interface{})
+		for _, name := range result.Names {
+			if value, ok := result.Data[name]; ok && result.Reported[name] {
+				data[name] = outputValue(value)
+			}
+		}
+		if len(data) == 0 {
+			return nil
+		}
+		payload, err := json.Marshal(map[string]interface{}{
+			"timestamp": ts, "read_cycle": result.Cycle, "read_duration_ms": result.Duration.Milliseconds(),
+			"registers_ok": result.RegistersOK, "registers_error": result.RegistersError, "alarms_active": result.AlarmsActive,
+			"data": data,
+		})
+		if err != nil {
+			return err
+		}
+		return s.client.Publish(ctx, mqttTopic("data"), mqttQoS, mqttRetain, payload)
+	}
+
+	for _, name := range result.Names {
+		value, ok := result.Data[name]
+		if !ok || !result.Reported[name] {
+			continue // Không thay đổi vượt deadband
+		}
+		p := mqttRegisterPayload{Timestamp: ts, Value: outputValue(value), Unit: registermap.Unit(name), Quality: qualityLabel(value)}
+		payload, err := json.Marshal(p)
+		if err != nil {
+			return err
+		}
+		if err := s.client.Publish(ctx, mqttTopic(registerGroup(name), name), mqttQoS, mqttRetain, payload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Deliver gửi lần lượt các chu kỳ (dùng cho store-and-forward); dừng ở chu kỳ lỗi đầu tiên.
+// Khi mất kết nối, Deliver báo lỗi ngay thay vì để paho xếp hàng bản tin: hàng đợi trên đĩa là
+// nơi duy nhất gửi lại dữ liệu.
+func (s *mqttSink) Deliver(ctx context.Context, results []sinks.CycleResult) error {
+	for _, result := range results {
+		if !s.client.IsConnected() {
+			return fmt.Errorf("%w '%s'", errMQTTNotConnected, mqttBrokerURL)
+		}
+		if err := s.Write(ctx, result); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *mqttSink) Flush(ctx context.Context) error { return nil }
+
+func (s *mqttSink) Close(ctx context.Context) error {
+	s.publishStatus(ctx, mqttStatusOffline)
+	s.client.Disconnect(250 * time.Millisecond)
+	log.Println("Đã ngắt kết nối MQTT broker.")
+	return nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"modbus_test/decode"
+	"modbus_test/registermap"
+	"modbus_test/sinks"
+)
+
+// mqttMessage là một bản tin fakeMQTTClient đã nhận.
+type mqttMessage struct {
+	Topic    string
+	QoS      byte
+	Retained bool
+	Payload  string
+}
+
+// fakeMQTTClient thay broker thật khi kiểm thử: ghi lại các bản tin, gọi OnConnect khi Connect
+// và trả về failErr cho lần publish thứ failAt (đếm từ 1, 0 = không lỗi). offline giả lập mất kết nối.
+type fakeMQTTClient struct {
+	opts         mqttClientOptions
+	offline      bool
+	messages     []mqttMessage
+	failAt       int
+	failErr      error
+	publishes    int
+	disconnected bool
+}
+
+func (c *fakeMQTTClient) Connect(timeout time.Duration) error {
+	if c.opts.OnConnect != nil {
+		c.opts.OnConnect()
+	}
+	return nil
+}
+
+func (c *fakeMQTTClient) IsConnected() bool { return !c.offline }
+
+func (c *fakeMQTTClient) Publish(ctx context.Context, topic string, qos byte, retained bool, payload []byte) error {
+	c.publishes++
+	if c.publishes == c.failAt {
+		return c.failErr
+	}
+	c.messages = append(c.messages, mqttMessage{Topic: topic, QoS: qos, Retained: retained, Payload: string(payload)})
+	return nil
+}
+
+func (c *fakeMQTTClient) Disconnect(quiesce time.Duration) { c.disconnected = true }
+
+// openFakeMQTTSink mở sink MQTT với client giả; trả về client để kiểm tra các bản tin.
+func openFakeMQTTSink(t *testing.T, mode string) (*mqttSink, *fakeMQTTClient) {
+	t.Helper()
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	client := &fakeMQTTClient{}
+	oldNew := newMQTTClient
+	newMQTTClient = func(o mqttClientOptions) mqttClient {
+		client.opts = o
+		return client
+	}
+	t.Cleanup(func() { newMQTTClient = oldNew })
+	s := &mqttSink{mode: mode}
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	return s, client
+}
+
+func mqttTestCycle() sinks.CycleResult {
+	return sinks.CycleResult{
+		Cycle: 4, StartTime: time.Date(2026, 10, 19, 12, 30, 0, 500e6, time.UTC), Duration: 80 * time.Millisecond,
+		Names: []string{"Meter_Model", "AE_Delivered", "RE_Delivered", "RE_Received"},
+		Data: map[string]interface{}{
+			"Meter_Model":  "PM5560",
+			"AE_Delivered": float32(1234.5),
+			"RE_Delivered": decode.ReadError,
+			"RE_Received":  float32(7), // Không vượt deadband: không publish
+		},
+		Reported:       map[string]bool{"Meter_Model": true, "AE_Delivered": true, "RE_Delivered": true},
+		RegistersTotal: 4, RegistersOK: 3, RegistersError: 1,
+	}
+}
+
+func TestMQTTSinkStatus(t *testing.T) {
+	s, client := openFakeMQTTSink(t, "register")
+	statusTopic := mqttTopic("status")
+	if client.opts.WillTopic != statusTopic || client.opts.WillPayload != mqttStatusOffline {
+		t.Errorf("LWT = %q %q, cần %q %q", client.opts.WillTopic, client.opts.WillPayload, statusTopic, mqttStatusOffline)
+	}
+	if err := s.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	want := []mqttMessage{
+		{Topic: statusTopic, QoS: mqttQoS, Retained: true, Payload: mqttStatusOnline},
+		{Topic: statusTopic, QoS: mqttQoS, Retained: true, Payload: mqttStatusOffline},
+	}
+	if !reflect.DeepEqual(client.messages, want) {
+		t.Errorf("bản tin trạng thái = %+v\ncần %+v", client.messages, want)
+	}
+	if !client.disconnected {
+		t.Error("Close không ngắt kết nối broker")
+	}
+}
+
+func TestMQTTSinkRegisterPayload(t *testing.T) {
+	s, client := openFakeMQTTSink(t, "register")
+	client.messages = nil // Bỏ bản tin "online"
+	if err := s.Write(context.Background(), mqttTestCycle()); err != nil {
+		t.Fatal(err)
+	}
+	ts := "2026-10-19T12:30:00.5Z"
+	want := []mqttMessage{
+		{Topic: mqttTopic("Device_Info", "Meter_Model"), Payload: `{"timestamp":"` + ts + `","value":"PM5560","quality":"good"}`},
+		{Topic: mqttTopic("EnergyInst", "AE_Delivered"), Payload: `{"timestamp":"` + ts + `","value":1234.5,"unit":"` + registermap.Unit("AE_Delivered") + `","quality":"good"}`},
+		{Topic: mqttTopic("EnergyInst", "RE_Delivered"), Payload: `{"timestamp":"` + ts + `","value":"` + decode.ReadError + `","unit":"` + registermap.Unit("RE_Delivered") + `","quality":"error"}`},
+	}
+	for i := range want {
+		want[i].QoS, want[i].Retained = mqttQoS, mqttRetain
+	}
+	if !reflect.DeepEqual(client.messages, want) {
+		t.Errorf("bản tin = %+v\ncần %+v", client.messages, want)
+	}
+}
+
+func TestMQTTSinkCyclePayload(t *testing.T) {
+	s, client := openFakeMQTTSink(t, "cycle")
+	client.messages = nil
+	if err := s.Write(context.Background(), mqttTestCycle()); err != nil {
+		t.Fatal(err)
+	}
+	if len(client.messages) != 1 || client.messages[0].Topic != mqttTopic("data") || client.messages[0].Retained != mqttRetain {
+		t.Fatalf("bản tin = %+v, cần một bản tin tại %s", client.messages, mqttTopic("data"))
+	}
+	var got map[string]interface{}
+	if err := json.Unmarshal([]byte(client.messages[0].Payload), &got); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"timestamp": "2026-10-19T12:30:00.5Z", "read_cycle": 4.0, "read_duration_ms": 80.0,
+		"registers_ok": 3.0, "registers_error": 1.0, "alarms_active": 0.0,
+		"data": map[string]interface{}{"Meter_Model": "PM5560", "AE_Delivered": 1234.5, "RE_Delivered": decode.ReadError},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("payload = %v\ncần %v", got, want)
+	}
+
+	// Chu kỳ không có thanh ghi nào thay đổi: không publish
+	empty := mqttTestCycle()
+	empty.Reported = nil
+	if err := s.Write(context.Background(), empty); err != nil || len(client.messages) != 1 {
+		t.Errorf("chu kỳ không thay đổi: %v, %d bản tin", err, len(client.messages))
+	}
+}
+
+func TestMQTTSinkDeliverError(t *testing.T) {
+	s, client := openFakeMQTTSink(t, "cycle")
+	client.messages = nil
+	errBroker := errors.New("broker không phản hồi")
+	before := client.publishes
+	client.failAt, client.failErr = before+2, errBroker // Lỗi ở chu kỳ thứ hai
+	first, second, third := mqttTestCycle(), mqttTestCycle(), mqttTestCycle()
+	second.Cycle, third.Cycle = 5, 6
+	if err := s.Deliver(context.Background(), []sinks.CycleResult{first, second, third}); !errors.Is(err, errBroker) {
+		t.Fatalf("Deliver = %v, cần %v", err, errBroker)
+	}
+	// Dừng ở chu kỳ lỗi: chu kỳ thứ ba chưa được gửi, store-and-forward sẽ gửi lại cả lô
+	if len(client.messages) != 1 || client.publishes-before != 2 {
+		t.Errorf("đã publish %d lần, %d bản tin thành công; cần dừng sau chu kỳ lỗi", client.publishes-before, len(client.messages))
+	}
+}
+
+func TestMQTTSinkDeliverOffline(t *testing.T) {
+	s, client := openFakeMQTTSink(t, "register")
+	before := client.publishes
+	client.offline = true
+	if err := s.Deliver(context.Background(), []sinks.CycleResult{mqttTestCycle()}); !errors.Is(err, errMQTTNotConnected) {
+		t.Fatalf("Deliver khi mất kết nối = %v, cần %v", err, errMQTTNotConnected)
+	}
+	if client.publishes != before {
+		t.Errorf("Deliver khi mất kết nối vẫn publish %d lần; hàng đợi trên đĩa phải là nơi duy nhất gửi lại", client.publishes-before)
+	}
+	client.offline = false
+	if err := s.Deliver(context.Background(), []sinks.CycleResult{mqttTestCycle()}); err != nil || client.publishes-before != 3 {
+		t.Errorf("Deliver sau khi kết nối lại: %v, %d lần publish", err, client.publishes-before)
+	}
+}
@@ -0,0 +1,273 @@
+// Package poller đọc bảng thanh ghi theo chu kỳ qua transport, giải mã bằng decode và gửi kết quả
+// mỗi chu kỳ (sinks.CycleResult) tới đầu ra. Poller tự kết nối lại khi mất giao tiếp.
+package poller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"modbus_test/decode"
+	"modbus_test/registermap"
+	"modbus_test/sinks"
+	"modbus_test/transport"
+)
+
+// Giá trị mặc định của Options khi để trống.
+const (
+	DefaultInterval       = 1 * time.Second
+	DefaultRequestGap     = 20 * time.Millisecond // Nghỉ giữa hai yêu cầu đọc thành công
+	DefaultErrorGap       = 50 * time.Millisecond // Nghỉ sau một yêu cầu lỗi giao tiếp
+	DefaultReconnectDelay = 5 * time.Second
+)
+
+// Lỗi Run trả về khi chạy với MaxCycles > 0.
+var (
+	ErrConnect = errors.New("không thể kết nối")
+	ErrNoData  = errors.New("không đọc được thanh ghi nào")
+)
+
+// Publisher nhận kết quả mỗi chu kỳ (ví dụ *sinks.FanOut).
+type Publisher interface {
+	Publish(ctx context.Context, result sinks.CycleResult)
+}
+
+// Hooks cho phép chương trình gọi theo dõi và bổ sung dữ liệu của vòng lặp đọc. Hook nil được bỏ qua.
+type Hooks struct {
+	OnConnect    func(client *transport.Client, err error)  // Sau mỗi lần thử kết nối
+	OnDisconnect func()                                     // Sau khi đóng kết nối do mọi thanh ghi lỗi đọc
+	OnReadError  func(reg registermap.Register, err error)  // Lỗi giao tiếp khi đọc thanh ghi (timeout, exception...)
+	OnRaw        func(reg registermap.Register, raw []byte) // Bytes thô đọc được, trước khi giải mã
+	Prepare      func(result *sinks.CycleResult)            // Bổ sung kết quả (thanh ghi ảo, cảnh báo...) trước khi đếm OK/lỗi
+	OnCycle      func(result sinks.CycleResult)             // Kết quả hoàn chỉnh, trước khi gửi tới Output
+	Paused       func() bool                                // true thì tạm dừng đọc
+}
+
+// Options là cấu hình của Poller.
+type Options struct {
+	Transport      transport.Config
+	Conn           transport.Conn // Đường truyền có sẵn (thiết bị giả khi kiểm thử, transport.FaultConn); nil = tạo handler theo Transport
+	Registers      []registermap.Register
+	AddressBase    int           // Địa chỉ của thanh ghi đầu tiên trong bảng (1: 1-based, 0: địa chỉ trên đường truyền)
+	Interval       time.Duration // Thời gian nghỉ giữa hai chu kỳ đọc
+	MaxCycles      uint64        // > 0: dừng sau MaxCycles chu kỳ, không thử kết nối lại khi lỗi
+	RequestGap     time.Duration
+	ErrorGap       time.Duration
+	ReconnectDelay time.Duration
+	Output         Publisher
+	Hooks          Hooks
+}
+
+// Poller đọc thiết bị theo Options.
+type Poller struct {
+	opts Options
+}
+
+// New tạo Poller, điền giá trị mặc định cho các khoảng thời gian để trống.
+func New(opts Options) *Poller {
+	if opts.Interval <= 0 {
+		opts.Interval = DefaultInterval
+	}
+	if opts.RequestGap <= 0 {
+		opts.RequestGap = DefaultRequestGap
+	}
+	if opts.ErrorGap <= 0 {
+		opts.ErrorGap = DefaultErrorGap
+	}
+	if opts.ReconnectDelay <= 0 {
+		opts.ReconnectDelay = DefaultReconnectDelay
+	}
+	return &Poller{opts: opts}
+}
+
+// sleep chờ d hoặc tới khi ctx bị hủy.
+func sleep(ctx context.Context, d time.Duration) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+	case <-t.C:
+	}
+}
+
+// Run đọc thiết bị liên tục cho tới khi ctx bị hủy (hoặc đủ MaxCycles chu kỳ). Hủy ctx dừng ngay
+// lần kết nối, lần đọc hoặc khoảng nghỉ đang chờ; chu kỳ đang đọc dở bị bỏ, không gửi tới Output.
+// Kết nối được đóng trước khi Run trả về. Với MaxCycles > 0, lỗi kết nối trả về ErrConnect và
+// không đọc được thanh ghi nào trả về ErrNoData.
+func (p *Poller) Run(ctx context.Context) error {
+	cfg := p.opts.Transport
+	hooks := p.opts.Hooks
+	client := p.newClient()
+	defer client.Close()
+	log.Printf("Sử dụng đường dẫn cổng: %s", cfg.Describe())
+
+	names := make([]string, len(p.opts.Registers))
+	for i, reg := range p.opts.Registers {
+		names[i] = reg.Name
+	}
+	connected := false
+	var readCycleCount uint64
+	anyRegisterOK := false
+
+	for ctx.Err() == nil {
+		if hooks.Paused != nil && hooks.Paused() {
+			sleep(ctx, 100*time.Millisecond) // Tạm dừng đọc (phím p trên giao diện console)
+			continue
+		}
+		if !connected {
+			log.Printf("Đang thử kết nối tới %s...", cfg.Label())
+			err := client.Connect(ctx)
+			if ctx.Err() != nil {
+				break
+			}
+			if hooks.OnConnect != nil {
+				hooks.OnConnect(client, err)
+			}
+			if err != nil {
+				logrus.WithError(err).WithField("port", cfg.Describe()).Error("Không thể kết nối Modbus")
+				if p.opts.MaxCycles > 0 {
+					return fmt.Errorf("%w %s: %v", ErrConnect, cfg.Describe(), err)
+				}
+				log.Printf("Sẽ thử lại sau %v...", p.opts.ReconnectDelay)
+				sleep(ctx, p.opts.ReconnectDelay)
+				continue
+			}
+			log.Println(">>> Kết nối thành công!")
+			connected = true
+		}
+
+		startTime := time.Now()
+		data := p.ReadAll(ctx, client)
+		if ctx.Err() != nil {
+			break
+		}
+		readCycleCount++
+		result := sinks.CycleResult{
+			Cycle: readCycleCount, StartTime: startTime, Duration: time.Since(startTime), SlaveID: cfg.SlaveID,
+			Names: names, Data: data,
+		}
+		if hooks.Prepare != nil {
+			hooks.Prepare(&result)
+		}
+		for _, name := range result.Names {
+			result.RegistersTotal++
+			if decode.IsError(result.Data[name]) {
+				result.RegistersError++
+			} else {
+				result.RegistersOK++
+			}
+		}
+		if hooks.OnCycle != nil {
+			hooks.OnCycle(result)
+		}
+		if p.opts.Output != nil {
+			p.opts.Output.Publish(ctx, result)
+		}
+		anyRegisterOK = anyRegisterOK || result.RegistersOK > 0
+
+		if p.allReadsFailed(data) {
+			// Mất giao tiếp hoàn toàn: đóng cổng và kết nối lại ở vòng lặp sau
+			logrus.WithField("port", cfg.Describe()).Warn("Mọi thanh ghi đều lỗi đọc, đóng kết nối để kết nối lại")
+			client.Close()
+			connected = false
+			if hooks.OnDisconnect != nil {
+				hooks.OnDisconnect()
+			}
+		}
+		if p.opts.MaxCycles > 0 && readCycleCount >= p.opts.MaxCycles {
+			break
+		}
+		sleep(ctx, p.opts.Interval)
+	}
+	log.Println("Vòng lặp chính kết thúc.")
+	if p.opts.MaxCycles > 0 && !anyRegisterOK {
+		return fmt.Errorf("%w sau %d chu kỳ", ErrNoData, readCycleCount)
+	}
+	return nil
+}
+
+// newClient tạo client trên Options.Conn, hoặc trên handler theo Options.Transport nếu Conn để trống.
+func (p *Poller) newClient() *transport.Client {
+	if p.opts.Conn != nil {
+		return transport.NewClientConn(p.opts.Conn, p.opts.AddressBase)
+	}
+	return transport.NewClient(transport.NewHandler(p.opts.Transport), p.opts.AddressBase)
+}
+
+// allReadsFailed trả về true nếu mọi thanh ghi trong chu kỳ đều lỗi giao tiếp (READ_ERROR).
+func (p *Poller) allReadsFailed(data map[string]interface{}) bool {
+	for _, reg := range p.opts.Registers {
+		if data[reg.Name] != decode.ReadError {
+			return false
+		}
+	}
+	return len(p.opts.Registers) > 0
+}
+
+// ReadAll đọc lần lượt mọi thanh ghi trong bảng, nghỉ RequestGap giữa các yêu cầu (ErrorGap sau
+// lỗi giao tiếp). Map kết quả chứa giá trị đã giải mã hoặc chuỗi đánh dấu lỗi của từng thanh ghi;
+// khi ctx bị hủy, ReadAll dừng và map chỉ có các thanh ghi đã đọc xong.
+func (p *Poller) ReadAll(ctx context.Context, client *transport.Client) map[string]interface{} {
+	results := make(map[string]interface{}, len(p.opts.Registers))
+	for _, regInfo := range p.opts.Registers {
+		value := p.ReadRegister(ctx, client, regInfo)
+		if ctx.Err() != nil {
+			break
+		}
+		results[regInfo.Name] = value
+		switch value {
+		case decode.InvalidAddrCfg:
+			continue
+		case decode.ReadError:
+			sleep(ctx, p.opts.ErrorGap)
+			continue
+		}
+		sleep(ctx, p.opts.RequestGap)
+	}
+	return results
+}
+
+// ReadRegister đọc và giải mã một thanh ghi/cụm thanh ghi. Lỗi được ghi log và trả về dưới dạng
+// chuỗi đánh dấu (decode.InvalidAddrCfg, ReadError, LengthError, DecodeError). Hủy ctx trả về
+// ReadError mà không gọi Hooks.OnReadError.
+func (p *Poller) ReadRegister(ctx context.Context, client *transport.Client, regInfo registermap.Register) interface{} {
+	logrus.WithFields(logrus.Fields{
+		"register_name": regInfo.Name, "address_1based": regInfo.Address,
+		"count_regs": regInfo.Length, "data_type": regInfo.Type,
+	}).Debug("Chuẩn bị đọc thanh ghi/cụm")
+
+	readBytes, err := client.ReadRaw(ctx, regInfo)
+	switch {
+	case ctx.Err() != nil:
+		return decode.ReadError
+	case errors.Is(err, transport.ErrInvalidAddress):
+		logrus.Errorf("Địa chỉ cấu hình %d (%s) nhỏ hơn addressBase %d", regInfo.Address, regInfo.Name, p.opts.AddressBase)
+		return decode.InvalidAddrCfg
+	case errors.Is(err, transport.ErrLengthMismatch):
+		logrus.WithFields(logrus.Fields{
+			"register_name": regInfo.Name, "count_regs": regInfo.Length,
+			"received_bytes": len(readBytes), "expected_bytes": int(regInfo.Length) * 2,
+		}).Error("Lỗi độ dài dữ liệu đọc")
+		return decode.LengthError
+	case err != nil:
+		if p.opts.Hooks.OnReadError != nil {
+			p.opts.Hooks.OnReadError(regInfo, err)
+		}
+		return decode.ReadError
+	}
+	if p.opts.Hooks.OnRaw != nil {
+		p.opts.Hooks.OnRaw(regInfo, readBytes)
+	}
+	decodedValue, decodeErr := decode.Decode(readBytes, regInfo)
+	if decodeErr != nil {
+		logrus.WithError(decodeErr).WithFields(logrus.Fields{
+			"register_name": regInfo.Name, "raw_bytes_hex": fmt.Sprintf("%x", readBytes),
+		}).Error("Lỗi giải mã thanh ghi")
+		return decode.DecodeError
+	}
+	return decodedValue
+}
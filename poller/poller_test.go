@@ -0,0 +1,262 @@
+package poller
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/goburrow/modbus"
+
+	"modbus_test/decode"
+	"modbus_test/registermap"
+	"modbus_test/sinks"
+	"modbus_test/transport"
+	"modbus_test/transport/transporttest"
+)
+
+// Bảng thanh ghi thử (addressBase 1): địa chỉ trên thiết bị giả = Address - 1.
+var testRegisters = []registermap.Register{
+	{Name: "Voltage", Address: 11, Type: "FLOAT32", Length: 2},
+	{Name: "Status", Address: 21, Type: "INT16U", Length: 1},
+	{Name: "Status_NA", Address: 22, Type: "INT16U", Length: 1},
+	{Name: "Exception", Address: 31, Type: "INT16U", Length: 1},
+	{Name: "Timeout", Address: 41, Type: "INT16U", Length: 1},
+	{Name: "Missing", Address: 51, Type: "INT16U", Length: 1},
+	{Name: "Short", Address: 61, Type: "FLOAT32", Length: 2},
+	{Name: "WrongLength", Address: 71, Type: "FLOAT32", Length: 1},
+	{Name: "BadAddress", Address: 0, Type: "INT16U", Length: 1},
+}
+
+func newTestDevice() *transporttest.Device {
+	dev := transporttest.New()
+	dev.Set(10, []byte{0x43, 0x67, 0x00, 0x00}) // 231.0
+	dev.Set(20, []byte{0x00, 0x07})
+	dev.Set(21, []byte{0xFF, 0xFF})
+	dev.Set(30, []byte{0x00, 0x01})
+	dev.SetFault(30, transporttest.Fault{Exception: modbus.ExceptionCodeIllegalDataAddress})
+	dev.Set(40, []byte{0x00, 0x01})
+	dev.SetFault(40, transporttest.Fault{Timeout: true})
+	dev.Set(60, []byte{0x43, 0x67, 0x00, 0x00})
+	dev.SetFault(60, transporttest.Fault{Short: 2})
+	dev.Set(70, []byte{0x43, 0x67})
+	return dev
+}
+
+func newTestPoller(dev *transporttest.Device, hooks Hooks) *Poller {
+	return New(Options{
+		Conn: dev, Registers: testRegisters, AddressBase: 1,
+		Interval: time.Millisecond, RequestGap: time.Microsecond, ErrorGap: time.Microsecond, ReconnectDelay: time.Millisecond,
+		Hooks: hooks,
+	})
+}
+
+func TestReadAll(t *testing.T) {
+	dev := newTestDevice()
+	var readErrors []string
+	p := newTestPoller(dev, Hooks{OnReadError: func(reg registermap.Register, err error) {
+		readErrors = append(readErrors, reg.Name)
+	}})
+	client := transport.NewClientConn(dev, 1)
+	if err := client.Connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	got := p.ReadAll(context.Background(), client)
+	want := map[string]interface{}{
+		"Voltage":     float32(231),
+		"Status":      uint16(7),
+		"Status_NA":   "N/A_INT16U",
+		"Exception":   decode.ReadError,
+		"Timeout":     decode.ReadError,
+		"Missing":     decode.ReadError, // Thiết bị trả về exception Illegal Data Address
+		"Short":       decode.LengthError,
+		"WrongLength": decode.DecodeError,
+		"BadAddress":  decode.InvalidAddrCfg,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ReadAll = %#v\ncần %#v", got, want)
+	}
+	if want := []string{"Exception", "Timeout", "Missing"}; !reflect.DeepEqual(readErrors, want) {
+		t.Errorf("OnReadError gọi cho %v, cần %v", readErrors, want)
+	}
+	if n := dev.Requests(); n != len(testRegisters)-1 {
+		t.Errorf("thiết bị nhận %d yêu cầu, cần %d (địa chỉ sai cấu hình không được gửi)", n, len(testRegisters)-1)
+	}
+}
+
+func TestReadRegisterCanceled(t *testing.T) {
+	dev := newTestDevice()
+	called := false
+	p := newTestPoller(dev, Hooks{OnReadError: func(registermap.Register, error) { called = true }})
+	client := transport.NewClientConn(dev, 1)
+	client.Connect(context.Background())
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if got := p.ReadRegister(ctx, client, testRegisters[0]); got != decode.ReadError {
+		t.Errorf("ReadRegister sau khi hủy ctx = %#v, cần %s", got, decode.ReadError)
+	}
+	if called {
+		t.Error("OnReadError không được gọi khi ctx bị hủy")
+	}
+	if got := p.ReadAll(ctx, client); len(got) != 0 {
+		t.Errorf("ReadAll sau khi hủy ctx = %#v, cần map rỗng", got)
+	}
+}
+
+// publisher lưu lại các chu kỳ nhận được.
+type publisher struct {
+	mu      sync.Mutex
+	results []sinks.CycleResult
+}
+
+func (p *publisher) Publish(ctx context.Context, result sinks.CycleResult) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.results = append(p.results, result)
+}
+
+func TestRunMaxCycles(t *testing.T) {
+	dev := newTestDevice()
+	out := &publisher{}
+	p := newTestPoller(dev, Hooks{})
+	p.opts.MaxCycles = 2
+	p.opts.Output = out
+	if err := p.Run(context.Background()); err != nil {
+		t.Fatalf("Run lỗi: %v", err)
+	}
+	if len(out.results) != 2 {
+		t.Fatalf("nhận %d chu kỳ, cần 2", len(out.results))
+	}
+	for i, r := range out.results {
+		if r.Cycle != uint64(i+1) {
+			t.Errorf("chu kỳ thứ %d có Cycle = %d", i+1, r.Cycle)
+		}
+		// Status_NA (N/A) không phải lỗi; 6 thanh ghi còn lại ngoài Voltage/Status là lỗi
+		if r.RegistersTotal != len(testRegisters) || r.RegistersOK != 3 || r.RegistersError != 6 {
+			t.Errorf("chu kỳ %d: total/ok/error = %d/%d/%d, cần %d/3/6", r.Cycle, r.RegistersTotal, r.RegistersOK, r.RegistersError, len(testRegisters))
+		}
+	}
+}
+
+func TestRunConnectError(t *testing.T) {
+	dev := newTestDevice()
+	dev.SetConnectError(errors.New("cổng bận"))
+	p := newTestPoller(dev, Hooks{})
+	p.opts.MaxCycles = 1
+	if err := p.Run(context.Background()); !errors.Is(err, ErrConnect) {
+		t.Errorf("Run = %v, cần ErrConnect", err)
+	}
+}
+
+func TestRunNoData(t *testing.T) {
+	dev := transporttest.New() // Không có thanh ghi nào: mọi yêu cầu nhận exception
+	disconnects := 0
+	p := newTestPoller(dev, Hooks{OnDisconnect: func() { disconnects++ }})
+	p.opts.Registers = testRegisters[:2]
+	p.opts.MaxCycles = 2
+	if err := p.Run(context.Background()); !errors.Is(err, ErrNoData) {
+		t.Errorf("Run = %v, cần ErrNoData", err)
+	}
+	if disconnects != 2 {
+		t.Errorf("OnDisconnect gọi %d lần, cần 2 (mọi thanh ghi lỗi đọc thì kết nối lại)", disconnects)
+	}
+}
+
+func TestRunCanceled(t *testing.T) {
+	dev := newTestDevice()
+	out := &publisher{}
+	p := newTestPoller(dev, Hooks{})
+	p.opts.Output = out
+	ctx, cancel := context.WithCancel(context.Background())
+	p.opts.Hooks.OnCycle = func(sinks.CycleResult) { cancel() }
+	done := make(chan error, 1)
+	go func() { done <- p.Run(ctx) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Run = %v, cần nil khi ctx bị hủy", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run không dừng sau khi ctx bị hủy")
+	}
+	out.mu.Lock()
+	defer out.mu.Unlock()
+	if len(out.results) != 1 {
+		t.Errorf("nhận %d chu kỳ, cần 1", len(out.results))
+	}
+}
+
+func TestRunReconnectAfterDisconnect(t *testing.T) {
+	dev := newTestDevice()
+	fc := transport.NewFaultConn(dev, transport.FaultConfig{Script: []transport.FaultKind{transport.FaultDisconnect}})
+	out := &publisher{}
+	connects, disconnects := 0, 0
+	p := newTestPoller(dev, Hooks{
+		OnConnect:    func(*transport.Client, error) { connects++ },
+		OnDisconnect: func() { disconnects++ },
+	})
+	p.opts.Conn = fc
+	p.opts.Registers = testRegisters[:2]
+	p.opts.MaxCycles = 2
+	p.opts.Output = out
+	if err := p.Run(context.Background()); err != nil {
+		t.Fatalf("Run lỗi: %v", err)
+	}
+	if connects != 2 || disconnects != 1 {
+		t.Errorf("kết nối %d lần, ngắt %d lần; cần 2 và 1", connects, disconnects)
+	}
+	want := []map[string]interface{}{
+		{"Voltage": decode.ReadError, "Status": decode.ReadError},
+		{"Voltage": float32(231), "Status": uint16(7)},
+	}
+	for i, r := range out.results {
+		if !reflect.DeepEqual(r.Data, want[i]) {
+			t.Errorf("chu kỳ %d: %#v, cần %#v", r.Cycle, r.Data, want[i])
+		}
+	}
+}
+
+// TestRunFlakyBus đọc qua đường truyền gài lỗi ngẫu nhiên: mỗi thanh ghi có giá trị đúng hoặc chuỗi
+// đánh dấu lỗi, không bao giờ là giá trị sai.
+func TestRunFlakyBus(t *testing.T) {
+	dev := newTestDevice()
+	fc := transport.NewFaultConn(dev, transport.FaultConfig{
+		Rates: map[transport.FaultKind]float64{
+			transport.FaultTimeout: 0.1, transport.FaultCRC: 0.1, transport.FaultShort: 0.1,
+			transport.FaultDelay: 0.1, transport.FaultException: 0.1, transport.FaultDisconnect: 0.05,
+		},
+		Delay: time.Millisecond,
+		Seed:  1,
+	})
+	out := &publisher{}
+	p := newTestPoller(dev, Hooks{})
+	p.opts.Conn = fc
+	p.opts.Registers = testRegisters[:2]
+	p.opts.MaxCycles = 50
+	p.opts.Output = out
+	if err := p.Run(context.Background()); err != nil {
+		t.Fatalf("Run lỗi: %v", err)
+	}
+	if len(out.results) != 50 {
+		t.Fatalf("nhận %d chu kỳ, cần 50", len(out.results))
+	}
+	good := map[string]interface{}{"Voltage": float32(231), "Status": uint16(7)}
+	ok := 0
+	for _, r := range out.results {
+		for name, value := range r.Data {
+			switch value {
+			case good[name]:
+				ok++
+			case decode.ReadError, decode.LengthError:
+			default:
+				t.Errorf("chu kỳ %d: %s = %#v", r.Cycle, name, value)
+			}
+		}
+	}
+	counts := fc.Counts()
+	if ok == 0 || counts[transport.FaultDisconnect] == 0 || counts[transport.FaultShort] == 0 {
+		t.Errorf("%d giá trị đúng, lỗi đã gài %v", ok, counts)
+	}
+}
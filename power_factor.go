@@ -0,0 +1,93 @@
+package main
+
+import (
+	"math"
+
+	"github.com/sirupsen/logrus"
+
+	"modbus_test/decode"
+)
+
+// --- Cấu hình giải mã và kiểm tra Power Factor ---
+const (
+	pfConsistencyTolerance = 0.02 // Sai lệch tối đa cho phép giữa PF đọc được và P/S
+	pfMinApparentPower     = 0.01 // Bỏ qua kiểm tra khi công suất biểu kiến quá nhỏ (không tải)
+)
+
+// Các cặp thanh ghi dùng để kiểm tra PF = |P| / S sau mỗi chu kỳ đọc.
+var pfConsistencyChecks = []struct {
+	PFRegister       string
+	ActiveRegister   string
+	ApparentRegister string
+}{
+	{"PF_Total", "ActivePower_Total", "ApparentPower_Total"},
+	{"PF_Total_IEC_F32", "ActivePower_Total", "ApparentPower_Total"},
+	{"PF_Total_IEEE_F32", "ActivePower_Total", "ApparentPower_Total"},
+}
+
+// Các thanh ghi PF theo quy ước IEC/IEEE và các thanh ghi công suất dùng để xác định lead/lag và góc
+// phần tư mà bản thân thanh ghi PF không cung cấp.
+var pfQuadrantSources = []struct {
+	PFRegister       string
+	ActiveRegister   string
+	ReactiveRegister string
+}{
+	{"PF_Total_IEC_F32", "ActivePower_Total", "ReactivePower_Total"},
+	{"PF_Total_IEEE_F32", "ActivePower_Total", "ReactivePower_Total"},
+	{"PF_Total_IEC_I16", "ActivePower_Total", "ReactivePower_Total"},
+	{"PF_Total_IEEE_I16", "ActivePower_Total", "ReactivePower_Total"},
+}
+
+// resolvePowerFactorQuadrants bổ sung lead/lag và góc phần tư cho các thanh ghi PF IEC/IEEE từ dấu
+// của công suất tác dụng/phản kháng đọc cùng chu kỳ. Thanh ghi công suất lỗi thì giữ nguyên PF.
+func resolvePowerFactorQuadrants(data map[string]interface{}) {
+	for _, src := range pfQuadrantSources {
+		pf, ok := data[src.PFRegister].(decode.PowerFactor)
+		if !ok {
+			continue
+		}
+		active, okP := decode.ToFloat64(data[src.ActiveRegister])
+		if !okP {
+			active = math.NaN()
+		}
+		reactive, okQ := decode.ToFloat64(data[src.ReactiveRegister])
+		if !okQ {
+			reactive = math.NaN()
+		}
+		data[src.PFRegister] = pf.WithPowerSigns(active, reactive)
+	}
+}
+
+// checkPowerFactorConsistency so sánh |PF| đọc được với |P| / S tính từ các thanh ghi công suất.
+// Trả về số cặp bị sai lệch vượt quá pfConsistencyTolerance.
+func checkPowerFactorConsistency(data map[string]interface{}) int {
+	mismatches := 0
+	for _, check := range pfConsistencyChecks {
+		pfMagnitude, okPF := pfMagnitudeOf(data[check.PFRegister])
+		active, okP := decode.ToFloat64(data[check.ActiveRegister])
+		apparent, okS := decode.ToFloat64(data[check.ApparentRegister])
+		if !okPF || !okP || !okS || math.Abs(apparent) < pfMinApparentPower {
+			continue
+		}
+		derived := math.Abs(active) / math.Abs(apparent)
+		fields := logrus.Fields{
+			"pf_register": check.PFRegister, "pf_read": pfMagnitude, "pf_derived": math.Round(derived*10000) / 10000,
+			"active_power": active, "apparent_power": apparent,
+		}
+		if math.Abs(derived-pfMagnitude) > pfConsistencyTolerance {
+			mismatches++
+			logrus.WithFields(fields).Warn("PF đọc được không khớp với P/S")
+		} else {
+			logrus.WithFields(fields).Debug("Kiểm tra PF = P/S đạt")
+		}
+	}
+	return mismatches
+}
+
+func pfMagnitudeOf(value interface{}) (float64, bool) {
+	if pf, ok := value.(decode.PowerFactor); ok {
+		return pf.Magnitude, true
+	}
+	v, ok := decode.ToFloat64(value)
+	return math.Abs(v), ok
+}
@@ -0,0 +1,207 @@
+// Package registermap mô tả các thanh ghi Modbus cần đọc: địa chỉ, kiểu dữ liệu, độ dài, nhóm và
+// đơn vị hiển thị.
+package registermap
+
+import "strings"
+
+// Register là thông tin một thanh ghi/cụm thanh ghi cần đọc.
+type Register struct {
+	Name    string
+	Address uint16  // Địa chỉ Modbus (theo addressBase của chương trình, mặc định 1-based)
+	Type    string  // Kiểu dữ liệu ("FLOAT32", "INT16U", "UTF8", "DATETIME", "CUSTOM_PF", "INT32U", "INT16", "INT64", "INT64U", "INT48", "BCD32", "INT64M10", "INT8_HI", "PF_4Q_F32"...)
+	Length  uint16  // Số lượng thanh ghi Modbus
+	Scale   float64 // Hệ số chia của kiểu số nguyên có scale (PF_IEC_I16, PF_IEEE_I16); 0 = mặc định của kiểu
+}
+
+// --- Danh sách các thanh ghi cần đọc ---
+// Default là bảng thanh ghi mặc định; chương trình có thể dùng bảng khác cho thiết bị khác.
+// !!! QUAN TRỌNG: HÃY KIỂM TRA LẠI CÁC ĐỊA CHỈ (1-based) VÀ ĐỘ DÀI (Length) NÀY VỚI TÀI LIỆU THIẾT BỊ !!!
+var Default = []Register{
+	// --- Device Info ---
+	{"Meter_Model", 30, "UTF8", 10, 0},  // !!! Xác nhận lại Address/Length/Type !!!
+	{"Manufacturer", 70, "UTF8", 10, 0}, // !!! Xác nhận lại Address/Length/Type !!!
+	// --- Date/Time ---
+	{"Peak_Demand_Date_time", 3804, "DATETIME", 4, 0}, // !!! Xác nhận lại Address/Length/Format !!!
+	// --- Energy(Inst) --- // Năng lượng tức thời (Float32)
+	{"AE_Delivered", 2700, "FLOAT32", 2, 0},
+	{"AE_Received", 2702, "FLOAT32", 2, 0},
+	{"AE_Del_Plus_Rec", 2704, "FLOAT32", 2, 0},
+	{"AE_Del_Minus_Rec", 2706, "FLOAT32", 2, 0},
+	{"RE_Delivered", 2708, "FLOAT32", 2, 0},
+	{"RE_Received", 2710, "FLOAT32", 2, 0},
+	{"RE_Del_Plus_Rec", 2712, "FLOAT32", 2, 0},
+	{"RE_Del_Minus_Rec", 2714, "FLOAT32", 2, 0},
+	{"APE_Delivered", 2716, "FLOAT32", 2, 0},
+	{"APE_Received", 2718, "FLOAT32", 2, 0},
+	{"APE_Del_Plus_Rec", 2720, "FLOAT32", 2, 0},
+	{"APE_Del_Minus_Rec", 2722, "FLOAT32", 2, 0},
+	// --- Current ---
+	{"Current_A", 3000, "FLOAT32", 2, 0},
+	{"Current_B", 3002, "FLOAT32", 2, 0},
+	{"Current_C", 3004, "FLOAT32", 2, 0},
+	{"Current_N", 3006, "FLOAT32", 2, 0},
+	{"Current_G", 3008, "FLOAT32", 2, 0},
+	{"Current_Avg", 3010, "FLOAT32", 2, 0},
+	{"Current_Unbalance_A", 3012, "FLOAT32", 2, 0},
+	{"Current_Unbalance_B", 3014, "FLOAT32", 2, 0},
+	{"Current_Unbalance_C", 3016, "FLOAT32", 2, 0},
+	{"Current_Unbalance_Worst", 3018, "FLOAT32", 2, 0},
+	// --- Voltage ---
+	{"Voltage_AB", 3020, "FLOAT32", 2, 0},
+	{"Voltage_BC", 3022, "FLOAT32", 2, 0},
+	{"Voltage_CA", 3024, "FLOAT32", 2, 0},
+	{"Voltage_LLAvg", 3026, "FLOAT32", 2, 0},
+	{"Voltage_AN", 3028, "FLOAT32", 2, 0},
+	{"Voltage_BN", 3030, "FLOAT32", 2, 0},
+	{"Voltage_CN", 3032, "FLOAT32", 2, 0},
+	{"Voltage_LNAvg", 3036, "FLOAT32", 2, 0}, // Đã sửa địa chỉ
+	{"Voltage_Unbalance_AB", 3038, "FLOAT32", 2, 0},
+	{"Voltage_Unbalance_BC", 3040, "FLOAT32", 2, 0},
+	{"Voltage_Unbalance_CA", 3042, "FLOAT32", 2, 0},
+	{"Voltage_Unbalance_LL_Worst", 3044, "FLOAT32", 2, 0},
+	{"Voltage_Unbalance_AN", 3046, "FLOAT32", 2, 0},
+	{"Voltage_Unbalance_BN", 3048, "FLOAT32", 2, 0},
+	{"Voltage_Unbalance_CN", 3050, "FLOAT32", 2, 0},
+	{"Voltage_Unbalance_LN_Worst", 3052, "FLOAT32", 2, 0},
+	// --- Power ---
+	{"ActivePower_A", 3054, "FLOAT32", 2, 0},
+	{"ActivePower_B", 3056, "FLOAT32", 2, 0},
+	{"ActivePower_C", 3058, "FLOAT32", 2, 0},
+	{"ActivePower_Total", 3060, "FLOAT32", 2, 0},
+	{"ReactivePower_A", 3062, "FLOAT32", 2, 0},
+	{"ReactivePower_B", 3064, "FLOAT32", 2, 0},
+	{"ReactivePower_C", 3066, "FLOAT32", 2, 0},
+	{"ReactivePower_Total", 3068, "FLOAT32", 2, 0},
+	{"ApparentPower_A", 3070, "FLOAT32", 2, 0},
+	{"ApparentPower_B", 3072, "FLOAT32", 2, 0},
+	{"ApparentPower_C", 3074, "FLOAT32", 2, 0},
+	{"ApparentPower_Total", 3076, "FLOAT32", 2, 0},
+	// --- PowerFactor ---
+	{"PF_A", 3078, "PF_4Q_F32", 2, 0}, // FLOAT32 4 góc phần tư (Schneider)
+	{"PF_B", 3080, "PF_4Q_F32", 2, 0},
+	{"PF_C", 3082, "PF_4Q_F32", 2, 0},
+	{"PF_Total", 3084, "PF_4Q_F32", 2, 0},
+	{"DPF_A", 3086, "PF_4Q_F32", 2, 0}, // Displacement PF
+	{"DPF_B", 3088, "PF_4Q_F32", 2, 0},
+	{"DPF_C", 3090, "PF_4Q_F32", 2, 0},
+	{"DPF_Total", 3092, "PF_4Q_F32", 2, 0},
+	{"PF_Total_IEC_F32", 3192, "PF_IEC_F32", 2, 0}, // Alternate PF
+	{"PF_Total_IEEE_F32", 3194, "PF_IEEE_F32", 2, 0},
+	{"PF_Total_IEC_I16", 3196, "PF_IEC_I16", 1, 1000}, // !!! Giả định !!! PF × 1000
+	{"PF_Total_IEEE_I16", 3197, "PF_IEEE_I16", 1, 1000},
+	// --- Frequency ---
+	{"Frequency", 3110, "FLOAT32", 2, 0},
+	// --- Energy(Accum) --- // Năng lượng Tích lũy (Int64)
+	{"Accum_Energy_Reset_Time", 3200, "DATETIME", 4, 0},
+	{"Accum_AE_Del", 3204, "INT64", 4, 0},
+	{"Accum_AE_Rec", 3208, "INT64", 4, 0},
+	{"Accum_AE_Sum", 3212, "INT64", 4, 0},
+	{"Accum_AE_Net", 3216, "INT64", 4, 0},
+	{"Accum_RE_Del", 3220, "INT64", 4, 0},
+	{"Accum_RE_Rec", 3224, "INT64", 4, 0},
+	{"Accum_RE_Sum", 3228, "INT64", 4, 0},
+	{"Accum_RE_Net", 3232, "INT64", 4, 0},
+	{"Accum_APE_Del", 3236, "INT64", 4, 0},
+	{"Accum_APE_Rec", 3240, "INT64", 4, 0},
+	{"Accum_APE_Sum", 3244, "INT64", 4, 0},
+	{"Accum_APE_Net", 3248, "INT64", 4, 0},
+	// --- Settings ---
+	{"Pwr_Dem_Interval_Dur", 3702, "INT16U", 1, 0},
+	{"Cur_Dem_Interval_Dur", 3712, "INT16U", 1, 0},
+	{"RS485_Proto", 6500, "INT16U", 1, 0},
+	{"RS485_Addr", 6501, "INT16U", 1, 0},
+	{"RS485_Baud", 6502, "INT16U", 1, 0},
+	{"RS485_Parity", 6503, "INT16U", 1, 0},
+}
+
+// Find tìm thanh ghi theo tên trong bảng regs.
+func Find(regs []Register, name string) (Register, bool) {
+	for _, reg := range regs {
+		if reg.Name == name {
+			return reg, true
+		}
+	}
+	return Register{}, false
+}
+
+// TypeRegisterCounts là số thanh ghi Modbus của các kiểu có độ dài cố định (lệnh read/write dùng
+// khi không truyền --count). Kiểu chuỗi (UTF8, ASCII...) phải khai báo độ dài.
+var TypeRegisterCounts = map[string]uint16{
+	"INT16U": 1, "INT16": 1, "INT8_HI": 1, "INT8_LO": 1, "INT8U_HI": 1, "INT8U_LO": 1, "BCD16": 1,
+	"PF_IEC_I16": 1, "PF_IEEE_I16": 1,
+	"FLOAT32": 2, "INT32U": 2, "INT32": 2, "BCD32": 2, "INT32M10": 2, "CUSTOM_PF": 2,
+	"PF_4Q_F32": 2, "PF_IEC_F32": 2, "PF_IEEE_F32": 2,
+	"INT48": 3, "INT48U": 3,
+	"FLOAT64": 4, "INT64": 4, "INT64U": 4, "INT64M10": 4, "DATETIME": 4,
+}
+
+// Group đoán tên nhóm của thanh ghi từ tên (Voltage, Current, PowerFactor, Energy(Inst)...).
+func Group(name string) string {
+	groupGuess := name
+	if idx := strings.Index(name, "_"); idx > 0 {
+		groupGuess = name[:idx]
+		if strings.HasPrefix(name, "PF_") || strings.HasPrefix(name, "DPF_") {
+			groupGuess = "PowerFactor"
+		}
+		if strings.HasPrefix(name, "AE_") || strings.HasPrefix(name, "RE_") || strings.HasPrefix(name, "APE_") {
+			groupGuess = "Energy(Inst)"
+		}
+		if strings.HasPrefix(name, "Accum_") {
+			groupGuess = "Energy(Accum)"
+		}
+		if strings.HasPrefix(name, "RS485_") || strings.HasPrefix(name, "Pwr_Dem_") || strings.HasPrefix(name, "Cur_Dem_") {
+			groupGuess = "Settings"
+		}
+		if strings.HasPrefix(name, "Meter_") || strings.HasPrefix(name, "Manufacturer") {
+			groupGuess = "Device Info"
+		}
+		if strings.HasSuffix(name, "_7reg") || strings.HasPrefix(name, "Peak_Demand_") {
+			groupGuess = "Date/Time"
+		}
+		if strings.HasPrefix(name, "Voltage_Unbalance") {
+			groupGuess = "Voltage Unbalance"
+		} // Nhóm riêng Unbalance
+		if strings.HasPrefix(name, "Current_Unbalance") {
+			groupGuess = "Current Unbalance"
+		} // Nhóm riêng Unbalance
+	} else if name == "Frequency" {
+		groupGuess = "Frequency"
+	}
+	return groupGuess
+}
+
+// units: đơn vị của thanh ghi theo tiền tố tên (so khớp tiền tố dài nhất), dùng làm nhãn "unit".
+var units = []struct {
+	Prefix string
+	Unit   string
+}{
+	{"Voltage_Unbalance", "percent"},
+	{"Current_Unbalance", "percent"},
+	{"Voltage_", "volts"},
+	{"Current_", "amperes"},
+	{"ActivePower_", "kilowatts"},
+	{"ReactivePower_", "kilovars"},
+	{"ApparentPower_", "kilovoltamperes"},
+	{"AE_", "kilowatt_hours"},
+	{"RE_", "kilovar_hours"},
+	{"APE_", "kilovoltampere_hours"},
+	{"Accum_AE_", "watt_hours"},
+	{"Accum_RE_", "var_hours"},
+	{"Accum_APE_", "voltampere_hours"},
+	{"PF_", "ratio"},
+	{"DPF_", "ratio"},
+	{"Frequency", "hertz"},
+	{"Pwr_Dem_Interval_Dur", "minutes"},
+	{"Cur_Dem_Interval_Dur", "minutes"},
+}
+
+// Unit trả về đơn vị của thanh ghi theo tên (rỗng nếu không xác định).
+func Unit(name string) string {
+	unit, best := "", 0
+	for _, u := range units {
+		if strings.HasPrefix(name, u.Prefix) && len(u.Prefix) > best {
+			unit, best = u.Unit, len(u.Prefix)
+		}
+	}
+	return unit
+}
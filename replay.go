@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"modbus_test/decode"
+	"modbus_test/registermap"
+	"modbus_test/sinks"
+)
+
+// replayJSONFields là các trường của bản ghi "Modbus Data Read" không phải thanh ghi.
+var replayJSONFields = map[string]bool{
+	"level": true, "msg": true, "time": true, "timestamp_rfc3339": true, "read_duration_ms": true, "slave_id": true,
+	"read_cycle": true, "pf_consistency_errors": true, "alarm_events": true, "alarms_active": true,
+	"registers_total_attempted": true, "registers_ok": true, "registers_error": true, "registers_reported": true,
+}
+
+// --- Lệnh replay: phát lại log CSV/JSON (có thể nén .gz) tới các sink ---
+func runReplayCommand(args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	conn := addConnectionFlags(fs)
+	fs.StringVar(&conn.values.LogDir, "log-dir", conn.values.LogDir, "thư mục log của các sink ghi file")
+	sinkList := fs.String("sinks", "", "các sink nhận dữ liệu phát lại, cách nhau bởi dấu phẩy (bắt buộc)")
+	speed := fs.Float64("speed", 0, "tốc độ phát lại so với thời gian thực (1 = như lúc ghi, 0 = nhanh nhất có thể)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Cách dùng: %s replay --sinks influx,sqlite [tham số] file.csv|file.log[.gz]...\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := parseFlags(fs, args, -1); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return usageErrorf("thiếu file log cần phát lại")
+	}
+	if *sinkList == "" {
+		return usageErrorf("thiếu --sinks")
+	}
+	if *speed < 0 {
+		return usageErrorf("--speed không được âm")
+	}
+	if err := conn.apply(fs); err != nil {
+		return err
+	}
+	if err := selectSinks(*sinkList); err != nil {
+		return err
+	}
+	ctx, cancel := signalContext()
+	defer cancel()
+	if err := setupLogging(); err != nil {
+		return err
+	}
+	defer closeLogs()
+	prepareDerivedRegisters()
+	fanOut.Wait = true // Phát lại không được bỏ chu kỳ khi hàng đợi sink đầy
+	setupSinks()
+	defer fanOut.Close(time.Minute)
+	if fanOut.Len() == 0 {
+		return fmt.Errorf("không mở được sink nào trong '%s'", *sinkList)
+	}
+
+	p := &replayer{ctx: ctx, speed: *speed}
+	for _, path := range fs.Args() {
+		if ctx.Err() != nil {
+			break
+		}
+		if err := p.replayFile(path); err != nil {
+			return err
+		}
+	}
+	log.Printf("Đã phát lại %d chu kỳ từ %d file.", p.cycle, fs.NArg())
+	return nil
+}
+
+type replayer struct {
+	ctx    context.Context // Bị hủy khi nhấn Ctrl+C: dừng đọc file và bỏ chờ
+	speed  float64
+	cycle  uint64
+	lastTS time.Time
+}
+
+func (p *replayer) replayFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("lỗi mở file '%s': %w", path, err)
+	}
+	defer f.Close()
+	var r io.Reader = f
+	name := path
+	if strings.HasSuffix(name, ".gz") {
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			return fmt.Errorf("file '%s' không phải gzip hợp lệ: %w", path, err)
+		}
+		defer zr.Close()
+		r, name = zr, strings.TrimSuffix(name, ".gz")
+	}
+	log.Printf("Đang phát lại %s...", path)
+	if strings.HasSuffix(name, ".csv") {
+		err = p.replayCSV(r)
+	} else {
+		err = p.replayJSON(r)
+	}
+	if err != nil {
+		return fmt.Errorf("lỗi phát lại '%s': %w", path, err)
+	}
+	return nil
+}
+
+// replayCSV đọc log CSV; mỗi file (hoặc mỗi lần xoay vòng) bắt đầu bằng dòng header "Timestamp,...".
+func (p *replayer) replayCSV(r io.Reader) error {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	var header []string
+	for p.ctx.Err() == nil {
+		row, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if len(row) > 0 && row[0] == "Timestamp" {
+			header = row
+			continue
+		}
+		if header == nil {
+			return fmt.Errorf("thiếu dòng header CSV")
+		}
+		ts, err := time.ParseInLocation("2006-01-02 15:04:05.000", row[0], time.Local)
+		if err != nil {
+			return fmt.Errorf("thời điểm '%s' không hợp lệ: %w", row[0], err)
+		}
+		data := make(map[string]interface{})
+		for i := 1; i < len(row) && i < len(header); i++ {
+			if row[i] != "" { // Ô trống: không thay đổi trong chu kỳ này (report-by-exception)
+				data[header[i]] = parseLoggedValue(header[i], row[i])
+			}
+		}
+		p.publish(ts, slaveID, data)
+	}
+	return nil
+}
+
+// replayJSON đọc log JSON của logrus, chỉ lấy các bản ghi "Modbus Data Read".
+func (p *replayer) replayJSON(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for p.ctx.Err() == nil && scanner.Scan() {
+		var entry map[string]json.RawMessage
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil || string(entry["msg"]) != `"Modbus Data Read"` {
+			continue
+		}
+		var tsText string
+		json.Unmarshal(entry["timestamp_rfc3339"], &tsText)
+		ts, err := time.Parse(time.RFC3339Nano, tsText)
+		if err != nil {
+			return fmt.Errorf("timestamp_rfc3339 '%s' không hợp lệ: %w", tsText, err)
+		}
+		id := slaveID
+		if raw, ok := entry["slave_id"]; ok {
+			var v int
+			if json.Unmarshal(raw, &v) == nil {
+				id = byte(v)
+			}
+		}
+		data := make(map[string]interface{})
+		for name, raw := range entry {
+			if replayJSONFields[name] {
+				continue
+			}
+			if raw[0] == '{' {
+				var pf decode.PowerFactor
+				if json.Unmarshal(raw, &pf) == nil {
+					data[name] = pf
+				}
+				continue
+			}
+			var text string
+			if json.Unmarshal(raw, &text) != nil {
+				text = string(raw) // Số hoặc null
+			}
+			if text != "null" {
+				data[name] = parseLoggedValue(name, text)
+			}
+		}
+		p.publish(ts, id, data)
+	}
+	return scanner.Err()
+}
+
+// parseLoggedValue chuyển giá trị dạng chuỗi trong log về kiểu mà decode.Decode trả về cho thanh
+// ghi đó. Chuỗi lỗi/N/A và giá trị không phân tích được giữ nguyên dạng chuỗi.
+func parseLoggedValue(name, text string) interface{} {
+	if decode.IsError(text) || decode.IsNA(text) {
+		return text
+	}
+	reg, ok := registermap.Find(registersToRead, name)
+	if !ok { // Thanh ghi ảo (derived) hoặc thanh ghi đã bỏ khỏi cấu hình
+		if v, err := strconv.ParseFloat(text, 64); err == nil {
+			return v
+		}
+		return text
+	}
+	switch reg.Type {
+	case "FLOAT32":
+		if v, err := strconv.ParseFloat(text, 32); err == nil {
+			return float32(v)
+		}
+	case "FLOAT64":
+		if v, err := strconv.ParseFloat(text, 64); err == nil {
+			return v
+		}
+	case "PF_4Q_F32", "PF_IEC_F32", "PF_IEEE_F32", "PF_IEC_I16", "PF_IEEE_I16":
+		return parseLoggedPowerFactor(text)
+	case "UTF8", "UTF8_SWAP", "ASCII", "ASCII_SWAP", "LATIN1", "LATIN1_SWAP", "UTF16", "UTF16_SWAP", "UTF16LE", "DATETIME":
+		return text
+	default:
+		if v, err := strconv.ParseInt(text, 10, 64); err == nil {
+			return v
+		}
+		if v, err := strconv.ParseUint(text, 10, 64); err == nil {
+			return v
+		}
+	}
+	return text
+}
+
+// parseLoggedPowerFactor phân tích PF dạng decode.PowerFactor.String(), ví dụ "0.9500 LAG Q1".
+func parseLoggedPowerFactor(text string) interface{} {
+	fields := strings.Fields(text)
+	if len(fields) == 0 {
+		return text
+	}
+	v, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return text
+	}
+	pf := decode.PowerFactor{Value: v, Magnitude: math.Abs(v)}
+	for _, f := range fields[1:] {
+		if q, err := strconv.Atoi(strings.TrimPrefix(f, "Q")); err == nil && strings.HasPrefix(f, "Q") {
+			pf.Quadrant = q
+		} else {
+			pf.LeadLag = f
+		}
+	}
+	return pf
+}
+
+// publish gửi một chu kỳ phát lại tới các sink, chờ theo khoảng cách thời gian gốc nếu speed > 0.
+func (p *replayer) publish(ts time.Time, id byte, data map[string]interface{}) {
+	if p.speed > 0 && !p.lastTS.IsZero() && ts.After(p.lastTS) {
+		timer := time.NewTimer(time.Duration(float64(ts.Sub(p.lastTS)) / p.speed))
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-p.ctx.Done():
+			return
+		}
+	}
+	p.lastTS = ts
+	p.cycle++
+	result := sinks.CycleResult{Cycle: p.cycle, StartTime: ts, SlaveID: id, Names: outputRegisterNames(), Data: data, Reported: make(map[string]bool, len(data))}
+	for _, name := range result.Names {
+		value, ok := data[name]
+		if !ok {
+			continue
+		}
+		result.Reported[name] = true
+		result.RegistersTotal++
+		if decode.IsError(value) {
+			result.RegistersError++
+		} else {
+			result.RegistersOK++
+		}
+	}
+	fanOut.Publish(p.ctx, result)
+}
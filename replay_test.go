@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"modbus_test/decode"
+)
+
+// FuzzParseLoggedValue kiểm tra bộ phân tích giá trị trong log CSV/JSON (lệnh replay): không panic,
+// chuỗi lỗi/N/A giữ nguyên, và ghi lại giá trị đã phân tích rồi phân tích lần nữa cho cùng kết quả.
+func FuzzParseLoggedValue(f *testing.F) {
+	names := []string{"Unknown_Derived"}
+	for _, reg := range registersToRead {
+		names = append(names, reg.Name)
+	}
+	for i, reg := range registersToRead {
+		f.Add(uint8(i+1), "0")
+		switch reg.Type {
+		case "PF_4Q_F32", "PF_IEC_F32", "PF_IEEE_F32", "PF_IEC_I16", "PF_IEEE_I16":
+			f.Add(uint8(i+1), "-0.9500 LEAD Q2")
+		case "DATETIME":
+			f.Add(uint8(i+1), "2025-04-11 21:48:00.000")
+		}
+	}
+	for _, text := range []string{"231.0738", "1e+06", "NaN", "-Inf", "18446744073709551615", "-9223372036854775808",
+		"Power Meter ", "", decode.ReadError, decode.LengthError, "N/A_FLOAT32", "INVALID_BCD(1a34)", "0x10", "0.95 Q1 Q-3 LAG"} {
+		f.Add(uint8(0), text)
+		f.Add(uint8(1), text)
+	}
+	f.Fuzz(func(t *testing.T, index uint8, text string) {
+		name := names[int(index)%len(names)]
+		value := parseLoggedValue(name, text)
+		if (decode.IsError(text) || decode.IsNA(text)) && value != text {
+			t.Fatalf("%s: chuỗi đánh dấu %q bị đổi thành %#v", name, text, value)
+		}
+		logged := fmt.Sprint(value)
+		again := parseLoggedValue(name, logged)
+		if fmt.Sprintf("%T", again) != fmt.Sprintf("%T", value) || fmt.Sprint(again) != logged {
+			t.Fatalf("%s: %q → %#v → %q → %#v", name, text, value, logged, again)
+		}
+	})
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"modbus_test/decode"
+)
+
+// --- Cấu hình báo cáo theo thay đổi (report-by-exception) ---
+const (
+	enableReportByException = true
+	reportMaxSilence        = 5 * time.Minute // Thanh ghi không thay đổi vẫn được ghi lại sau khoảng này (heartbeat)
+	csvFullRowMode          = true            // true: CSV luôn ghi đủ các cột; false: chỉ ghi giá trị thay đổi, cột khác để trống
+	sqliteFullRowMode       = true            // true: SQLite lưu mọi thanh ghi mỗi chu kỳ; false: chỉ lưu giá trị thay đổi (chuỗi thời gian thưa)
+	influxFullRowMode       = true            // true: InfluxDB nhận mọi thanh ghi mỗi chu kỳ; false: chỉ giá trị thay đổi
+)
+
+// ReportDeadband: chỉ báo cáo khi giá trị thay đổi vượt quá Absolute (đơn vị của thanh ghi)
+// hoặc Percent (% so với giá trị báo cáo lần trước). Thanh ghi không khai báo sẽ được báo cáo
+// khi có bất kỳ thay đổi nào.
+type ReportDeadband struct {
+	Register string
+	Absolute float64
+	Percent  float64
+}
+
+var reportDeadbands = []ReportDeadband{
+	{Register: "Voltage_AN", Absolute: 0.5},
+	{Register: "Voltage_BN", Absolute: 0.5},
+	{Register: "Voltage_CN", Absolute: 0.5},
+	{Register: "Voltage_LNAvg", Absolute: 0.5},
+	{Register: "Current_A", Percent: 1},
+	{Register: "Current_B", Percent: 1},
+	{Register: "Current_C", Percent: 1},
+	{Register: "Current_Avg", Percent: 1},
+	{Register: "ActivePower_Total", Percent: 1},
+	{Register: "Frequency", Absolute: 0.02},
+}
+
+type reportedValue struct {
+	value interface{}
+	time  time.Time
+}
+
+var lastReported = make(map[string]reportedValue)
+
+// changedRegisters trả về tập các thanh ghi cần báo cáo trong chu kỳ này và cập nhật giá trị
+// báo cáo gần nhất. Khi report-by-exception tắt, mọi thanh ghi đều được báo cáo.
+func changedRegisters(ts time.Time, data map[string]interface{}) map[string]bool {
+	changed := make(map[string]bool)
+	deadbands := make(map[string]ReportDeadband, len(reportDeadbands))
+	for _, db := range reportDeadbands {
+		deadbands[db.Register] = db
+	}
+	for _, name := range outputRegisterNames() {
+		value, ok := data[name]
+		if !ok {
+			continue
+		}
+		last, seen := lastReported[name]
+		if enableReportByException && seen && ts.Sub(last.time) < reportMaxSilence && !valueChanged(last.value, value, deadbands[name]) {
+			continue
+		}
+		changed[name] = true
+		lastReported[name] = reportedValue{value: value, time: ts}
+	}
+	return changed
+}
+
+// valueChanged so sánh giá trị mới với giá trị báo cáo lần trước theo deadband.
+// Chuyển đổi giữa số và chuỗi (lỗi, N/A) luôn được coi là thay đổi.
+func valueChanged(previous, current interface{}, db ReportDeadband) bool {
+	prev, prevQuality := decode.Classify(previous)
+	cur, curQuality := decode.Classify(current)
+	if prevQuality != decode.QualityGood || curQuality != decode.QualityGood {
+		return fmt.Sprint(previous) != fmt.Sprint(current)
+	}
+	diff := math.Abs(cur - prev)
+	if db.Absolute <= 0 && db.Percent <= 0 {
+		return diff != 0
+	}
+	if db.Absolute > 0 && diff > db.Absolute {
+		return true
+	}
+	return db.Percent > 0 && diff > math.Abs(prev)*db.Percent/100
+}
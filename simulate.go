@@ -0,0 +1,430 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/goburrow/modbus"
+	"github.com/goburrow/serial"
+	"github.com/sirupsen/logrus"
+
+	"modbus_test/decode"
+	"modbus_test/registermap"
+	"modbus_test/transport"
+)
+
+// --- Bộ mô phỏng slave (lệnh simulate) ---
+// Trả lời các thanh ghi khai báo trong registersToRead với giá trị hợp lý và nhất quán giữa các
+// pha (P = V·I·PF, Q, S, năng lượng tăng dần), dùng để thử chương trình khi không có thiết bị thật.
+const (
+	simVoltageLN   = 230.0 // V pha - trung tính
+	simCurrent     = 12.0  // A mỗi pha
+	simPowerFactor = 0.95
+	simFrequency   = 50.0
+	simModel       = "PM5560 SIM"
+	simVendor      = "Schneider Electric"
+	simMaxPDU      = 253 // Kích thước PDU tối đa của Modbus
+	simRTUSilence  = 20 * time.Millisecond
+)
+
+// simulator giữ bộ nhớ thanh ghi (địa chỉ 0-based trên đường truyền).
+type simulator struct {
+	mu       sync.Mutex
+	regs     map[uint16]uint16
+	written  map[uint16]bool // Thanh ghi đã được ghi qua Modbus, bộ cập nhật không ghi đè
+	start    time.Time
+	last     time.Time
+	energyWh float64 // Năng lượng tác dụng tích lũy (Wh)
+}
+
+func newSimulator() *simulator {
+	now := time.Now()
+	s := &simulator{regs: make(map[uint16]uint16), written: make(map[uint16]bool), start: now, last: now, energyWh: 1234567}
+	s.update(now)
+	return s
+}
+
+// simValue trả về giá trị mô phỏng của thanh ghi theo tên tại thời điểm t.
+func (s *simulator) simValue(name string, t time.Time) (float64, bool) {
+	phase := map[byte]float64{'A': 0, 'B': 1, 'C': 2}
+	elapsed := t.Sub(s.start).Seconds()
+	voltage := func(p float64) float64 { return simVoltageLN + 2*math.Sin(elapsed/30+p) }
+	current := func(p float64) float64 { return simCurrent + 1.5*math.Sin(elapsed/20+p*2) }
+	sinPhi := math.Sqrt(1 - simPowerFactor*simPowerFactor)
+	perPhase := func(suffix string, f func(v, i float64) float64) (float64, bool) {
+		if p, ok := phase[suffix[0]]; ok && len(suffix) == 1 {
+			return f(voltage(p), current(p)), true
+		}
+		if suffix == "Total" {
+			return f(voltage(0), current(0)) + f(voltage(1), current(1)) + f(voltage(2), current(2)), true
+		}
+		return 0, false
+	}
+	energyKWh := s.energyWh / 1000
+	switch {
+	case strings.HasPrefix(name, "Voltage_Unbalance"), strings.HasPrefix(name, "Current_Unbalance"):
+		return 0.4, true
+	case name == "Voltage_AN", name == "Voltage_BN", name == "Voltage_CN":
+		return voltage(phase[name[8]]), true
+	case name == "Voltage_LNAvg":
+		return (voltage(0) + voltage(1) + voltage(2)) / 3, true
+	case name == "Voltage_AB", name == "Voltage_BC", name == "Voltage_CA":
+		return voltage(phase[name[8]]) * math.Sqrt(3), true
+	case name == "Voltage_LLAvg":
+		return (voltage(0) + voltage(1) + voltage(2)) / 3 * math.Sqrt(3), true
+	case name == "Current_N":
+		return 0.6, true
+	case name == "Current_G":
+		return 0, true
+	case name == "Current_Avg":
+		return (current(0) + current(1) + current(2)) / 3, true
+	case strings.HasPrefix(name, "Current_"):
+		return perPhase(strings.TrimPrefix(name, "Current_"), func(v, i float64) float64 { return i })
+	case strings.HasPrefix(name, "ActivePower_"):
+		return perPhase(strings.TrimPrefix(name, "ActivePower_"), func(v, i float64) float64 { return v * i * simPowerFactor / 1000 })
+	case strings.HasPrefix(name, "ReactivePower_"):
+		return perPhase(strings.TrimPrefix(name, "ReactivePower_"), func(v, i float64) float64 { return v * i * sinPhi / 1000 })
+	case strings.HasPrefix(name, "ApparentPower_"):
+		return perPhase(strings.TrimPrefix(name, "ApparentPower_"), func(v, i float64) float64 { return v * i / 1000 })
+	case strings.HasPrefix(name, "PF_"), strings.HasPrefix(name, "DPF_"):
+		return simPowerFactor, true
+	case name == "Frequency":
+		return simFrequency + 0.02*math.Sin(elapsed/10), true
+	case name == "AE_Delivered", name == "AE_Del_Plus_Rec", name == "AE_Del_Minus_Rec":
+		return energyKWh, true
+	case name == "RE_Delivered", name == "RE_Del_Plus_Rec", name == "RE_Del_Minus_Rec":
+		return energyKWh * sinPhi / simPowerFactor, true
+	case name == "APE_Delivered", name == "APE_Del_Plus_Rec", name == "APE_Del_Minus_Rec":
+		return energyKWh / simPowerFactor, true
+	case strings.HasSuffix(name, "_Received"):
+		return 0, true
+	case name == "Accum_AE_Del", name == "Accum_AE_Sum", name == "Accum_AE_Net":
+		return math.Floor(s.energyWh), true
+	case name == "Accum_RE_Del", name == "Accum_RE_Sum", name == "Accum_RE_Net":
+		return math.Floor(s.energyWh * sinPhi / simPowerFactor), true
+	case name == "Accum_APE_Del", name == "Accum_APE_Sum", name == "Accum_APE_Net":
+		return math.Floor(s.energyWh / simPowerFactor), true
+	case strings.HasPrefix(name, "Accum_") && strings.HasSuffix(name, "_Rec"):
+		return 0, true
+	case name == "Pwr_Dem_Interval_Dur", name == "Cur_Dem_Interval_Dur":
+		return 15, true
+	case name == "RS485_Addr":
+		return float64(slaveID), true
+	}
+	return 0, false
+}
+
+// update tính lại giá trị các thanh ghi tại thời điểm t.
+func (s *simulator) update(t time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var totalKW float64
+	if v, ok := s.simValue("ActivePower_Total", t); ok {
+		totalKW = v
+	}
+	s.energyWh += totalKW * 1000 * t.Sub(s.last).Hours()
+	s.last = t
+	for _, reg := range registersToRead {
+		var payload []byte
+		var err error
+		switch reg.Type {
+		case "UTF8", "ASCII":
+			text := simModel
+			if reg.Name == "Manufacturer" {
+				text = simVendor
+			}
+			if len(text) > int(reg.Length)*2 {
+				text = text[:reg.Length*2]
+			}
+			payload, err = decode.EncodeString(text, reg)
+		case "DATETIME":
+			payload = decode.EncodeDateTime(s.start)
+		default:
+			v, _ := s.simValue(reg.Name, t) // Thanh ghi không có mô hình: giá trị 0
+			payload, err = decode.EncodeNumber(v, reg)
+		}
+		if err != nil {
+			// Kiểu chưa mã hóa được (CUSTOM_PF, BCD...): thanh ghi vẫn tồn tại với giá trị 0
+			logrus.WithError(err).WithField("register_name", reg.Name).Debug("Không mô phỏng được giá trị thanh ghi")
+			payload = nil
+		}
+		s.store(reg, payload)
+	}
+}
+
+// store ghi payload vào bộ nhớ (bỏ qua các thanh ghi đã được ghi từ master); phần còn thiếu
+// của thanh ghi được điền 0.
+func (s *simulator) store(reg registermap.Register, payload []byte) {
+	if reg.Address < uint16(addressBase) {
+		return
+	}
+	base := reg.Address - uint16(addressBase)
+	for i := 0; i+1 < len(payload); i += 2 {
+		addr := base + uint16(i/2)
+		if !s.written[addr] {
+			s.regs[addr] = binary.BigEndian.Uint16(payload[i:])
+		}
+	}
+	for i := uint16(len(payload) / 2); i < reg.Length; i++ {
+		if _, ok := s.regs[base+i]; !ok {
+			s.regs[base+i] = 0
+		}
+	}
+}
+
+// handlePDU xử lý một yêu cầu (function code + dữ liệu) và trả về PDU phản hồi.
+func (s *simulator) handlePDU(pdu []byte) []byte {
+	if len(pdu) == 0 {
+		return nil
+	}
+	fc := pdu[0]
+	exception := func(code byte) []byte { return []byte{fc | 0x80, code} }
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch fc {
+	case modbus.FuncCodeReadHoldingRegisters, modbus.FuncCodeReadInputRegisters:
+		if len(pdu) != 5 {
+			return exception(modbus.ExceptionCodeIllegalDataValue)
+		}
+		addr, qty := binary.BigEndian.Uint16(pdu[1:]), binary.BigEndian.Uint16(pdu[3:])
+		if qty == 0 || qty > 125 {
+			return exception(modbus.ExceptionCodeIllegalDataValue)
+		}
+		resp := []byte{fc, byte(qty * 2)}
+		for i := uint16(0); i < qty; i++ {
+			v, ok := s.regs[addr+i]
+			if !ok {
+				return exception(modbus.ExceptionCodeIllegalDataAddress)
+			}
+			resp = binary.BigEndian.AppendUint16(resp, v)
+		}
+		return resp
+	case modbus.FuncCodeWriteSingleRegister:
+		if len(pdu) != 5 {
+			return exception(modbus.ExceptionCodeIllegalDataValue)
+		}
+		addr := binary.BigEndian.Uint16(pdu[1:])
+		if _, ok := s.regs[addr]; !ok {
+			return exception(modbus.ExceptionCodeIllegalDataAddress)
+		}
+		s.regs[addr], s.written[addr] = binary.BigEndian.Uint16(pdu[3:]), true
+		return append([]byte(nil), pdu...)
+	case modbus.FuncCodeWriteMultipleRegisters:
+		if len(pdu) < 6 {
+			return exception(modbus.ExceptionCodeIllegalDataValue)
+		}
+		addr, qty, count := binary.BigEndian.Uint16(pdu[1:]), binary.BigEndian.Uint16(pdu[3:]), int(pdu[5])
+		if qty == 0 || qty > 123 || count != int(qty)*2 || len(pdu) != 6+count {
+			return exception(modbus.ExceptionCodeIllegalDataValue)
+		}
+		for i := uint16(0); i < qty; i++ {
+			if _, ok := s.regs[addr+i]; !ok {
+				return exception(modbus.ExceptionCodeIllegalDataAddress)
+			}
+		}
+		for i := uint16(0); i < qty; i++ {
+			s.regs[addr+i], s.written[addr+i] = binary.BigEndian.Uint16(pdu[6+2*i:]), true
+		}
+		return append([]byte(nil), pdu[:5]...)
+	}
+	return exception(modbus.ExceptionCodeIllegalFunction)
+}
+
+// --- Lệnh simulate ---
+func runSimulateCommand(args []string) error {
+	fs := flag.NewFlagSet("simulate", flag.ContinueOnError)
+	conn := addConnectionFlags(fs)
+	listen := fs.String("listen", "", "chạy Modbus TCP server tại địa chỉ này (ví dụ :5020); mặc định: RTU trên --port")
+	interval := fs.Duration("update", time.Second, "chu kỳ cập nhật giá trị mô phỏng")
+	if err := parseFlags(fs, args, 0); err != nil {
+		return err
+	}
+	if err := conn.apply(fs); err != nil {
+		return err
+	}
+	if *interval <= 0 {
+		return usageErrorf("--update phải lớn hơn 0")
+	}
+	if *listen == "" && transportType == "tcp" {
+		*listen = tcpAddress
+	}
+	ctx, cancel := signalContext()
+	defer cancel()
+	sim := newSimulator()
+	go func() {
+		ticker := time.NewTicker(*interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				sim.update(now)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	if *listen != "" {
+		return sim.serveTCP(ctx, *listen)
+	}
+	return sim.serveRTU(ctx)
+}
+
+// serveTCP trả lời yêu cầu Modbus TCP (MBAP). Unit ID khác slaveID nhận exception 0x0B như một
+// gateway không có thiết bị đích; unit 0 và 255 được coi là slave mô phỏng.
+func (s *simulator) serveTCP(ctx context.Context, address string) error {
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		return &cliError{code: exitCommError, err: fmt.Errorf("không thể mở %s: %w", address, err)}
+	}
+	log.Printf("Bộ mô phỏng Modbus TCP đang chạy tại %s (slave %d, %d thanh ghi). Nhấn Ctrl+C để dừng.", ln.Addr(), slaveID, len(registersToRead))
+	stop := context.AfterFunc(ctx, func() { ln.Close() })
+	defer stop()
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				log.Println("Đã dừng bộ mô phỏng.")
+				return nil
+			}
+			return err
+		}
+		go s.serveTCPConn(ctx, c)
+	}
+}
+
+func (s *simulator) serveTCPConn(ctx context.Context, c net.Conn) {
+	defer c.Close()
+	stop := context.AfterFunc(ctx, func() { c.Close() }) // Đóng kết nối để bỏ chặn ReadFull khi dừng
+	defer stop()
+	header := make([]byte, 7)
+	for {
+		if _, err := io.ReadFull(c, header); err != nil {
+			return
+		}
+		length := int(binary.BigEndian.Uint16(header[4:]))
+		if length < 2 || length > simMaxPDU+1 {
+			logrus.WithField("remote", c.RemoteAddr().String()).Warn("Khung Modbus TCP có độ dài không hợp lệ, đóng kết nối")
+			return
+		}
+		pdu := make([]byte, length-1)
+		if _, err := io.ReadFull(c, pdu); err != nil {
+			return
+		}
+		var resp []byte
+		if unit := header[6]; unit != slaveID && unit != 0 && unit != 0xFF {
+			resp = []byte{pdu[0] | 0x80, modbus.ExceptionCodeGatewayTargetDeviceFailedToRespond}
+		} else {
+			resp = s.handlePDU(pdu)
+		}
+		out := append(append([]byte(nil), header[:4]...), 0, 0, header[6])
+		binary.BigEndian.PutUint16(out[4:], uint16(len(resp)+1))
+		if _, err := c.Write(append(out, resp...)); err != nil {
+			return
+		}
+	}
+}
+
+// serveRTU trả lời yêu cầu Modbus RTU trên cổng COM. Khung gửi tới slave khác bị bỏ qua; khung
+// broadcast (địa chỉ 0) được thực hiện nhưng không trả lời.
+func (s *simulator) serveRTU(ctx context.Context) error {
+	port, err := serial.Open(&serial.Config{
+		Address: transport.SerialPortPath(portNameSimple), BaudRate: baudRate, DataBits: dataBits,
+		StopBits: stopBits, Parity: parity, Timeout: simRTUSilence,
+	})
+	if err != nil {
+		return &cliError{code: exitCommError, err: fmt.Errorf("không thể mở %s: %w", transportDescription(), err)}
+	}
+	defer port.Close()
+	log.Printf("Bộ mô phỏng Modbus RTU đang chạy trên %s (%d thanh ghi). Nhấn Ctrl+C để dừng.", transportDescription(), len(registersToRead))
+
+	var frame []byte
+	buf := make([]byte, simMaxPDU+3)
+	for ctx.Err() == nil {
+		n, err := port.Read(buf)
+		if n > 0 {
+			frame = append(frame, buf[:n]...)
+		}
+		if err != nil && !errors.Is(err, serial.ErrTimeout) {
+			return &cliError{code: exitCommError, err: err}
+		}
+		size := rtuFrameSize(frame)
+		switch {
+		case size > 0 && len(frame) >= size:
+			s.handleRTUFrame(port, frame[:size])
+			frame = frame[size:]
+		case err != nil && len(frame) > 0:
+			// Khoảng lặng trên đường truyền: khung có function code khác (trả lời exception 1 nếu
+			// CRC đúng) hoặc khung chưa đủ (bỏ qua)
+			if len(frame) >= 4 {
+				s.handleRTUFrame(port, frame)
+			}
+			frame = nil
+		}
+	}
+	log.Println("Đã dừng bộ mô phỏng.")
+	return nil
+}
+
+// rtuFrameSize trả về độ dài khung yêu cầu RTU (kể cả CRC), 0 nếu chưa đủ dữ liệu để xác định.
+func rtuFrameSize(frame []byte) int {
+	if len(frame) < 2 {
+		return 0
+	}
+	switch frame[1] {
+	case modbus.FuncCodeWriteMultipleRegisters:
+		if len(frame) < 7 {
+			return 0
+		}
+		return 9 + int(frame[6])
+	case modbus.FuncCodeReadHoldingRegisters, modbus.FuncCodeReadInputRegisters, modbus.FuncCodeWriteSingleRegister:
+		return 8
+	}
+	return 0 // Function code khác: chờ khoảng lặng
+}
+
+func (s *simulator) handleRTUFrame(w io.Writer, frame []byte) {
+	n := len(frame)
+	if modbusCRC16(frame[:n-2]) != binary.LittleEndian.Uint16(frame[n-2:]) {
+		logrus.WithField("raw_bytes_hex", fmt.Sprintf("%x", frame)).Warn("Sai CRC khung RTU, bỏ qua")
+		return
+	}
+	unit := frame[0]
+	if unit != slaveID && unit != 0 {
+		return
+	}
+	resp := s.handlePDU(frame[1 : n-2])
+	if unit == 0 {
+		return
+	}
+	out := append([]byte{unit}, resp...)
+	out = binary.LittleEndian.AppendUint16(out, modbusCRC16(out))
+	if _, err := w.Write(out); err != nil {
+		logrus.WithError(err).Warn("Lỗi gửi phản hồi RTU")
+	}
+}
+
+// modbusCRC16 tính CRC-16/MODBUS (đa thức 0xA001, giá trị đầu 0xFFFF).
+func modbusCRC16(data []byte) uint16 {
+	crc := uint16(0xFFFF)
+	for _, b := range data {
+		crc ^= uint16(b)
+		for i := 0; i < 8; i++ {
+			if crc&1 != 0 {
+				crc = crc>>1 ^ 0xA001
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return crc
+}
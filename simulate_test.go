@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/goburrow/modbus"
+	"github.com/sirupsen/logrus"
+)
+
+// rtuFrame thêm địa chỉ slave và CRC vào PDU.
+func rtuFrame(unit byte, pdu ...byte) []byte {
+	frame := append([]byte{unit}, pdu...)
+	return binary.LittleEndian.AppendUint16(frame, modbusCRC16(frame))
+}
+
+// mbapFrame thêm header Modbus TCP (MBAP) vào PDU.
+func mbapFrame(transaction uint16, unit byte, pdu ...byte) []byte {
+	frame := binary.BigEndian.AppendUint16(nil, transaction)
+	frame = append(frame, 0, 0)
+	frame = binary.BigEndian.AppendUint16(frame, uint16(len(pdu)+1))
+	return append(append(frame, unit), pdu...)
+}
+
+// Các PDU yêu cầu dùng làm seed: đọc thanh ghi đầu tiên của bảng, ghi 1 và nhiều thanh ghi, các
+// trường hợp sai độ dài/số lượng và function code không hỗ trợ.
+func seedPDUs() [][]byte {
+	addr := registersToRead[0].Address - uint16(addressBase)
+	hi, lo := byte(addr>>8), byte(addr)
+	return [][]byte{
+		{modbus.FuncCodeReadHoldingRegisters, hi, lo, 0, 2},
+		{modbus.FuncCodeReadInputRegisters, hi, lo, 0, 125},
+		{modbus.FuncCodeReadHoldingRegisters, 0xFF, 0xFF, 0, 2},
+		{modbus.FuncCodeReadHoldingRegisters, hi, lo, 0, 0},
+		{modbus.FuncCodeWriteSingleRegister, hi, lo, 0x12, 0x34},
+		{modbus.FuncCodeWriteMultipleRegisters, hi, lo, 0, 2, 4, 0x41, 0x42, 0x43, 0x44},
+		{modbus.FuncCodeWriteMultipleRegisters, hi, lo, 0, 2, 5, 0x41},
+		{modbus.FuncCodeReadCoils, 0, 0, 0, 1},
+	}
+}
+
+func FuzzRTUFrameSize(f *testing.F) {
+	for _, pdu := range seedPDUs() {
+		f.Add(rtuFrame(slaveID, pdu...))
+	}
+	f.Add([]byte{})
+	f.Add([]byte{1, modbus.FuncCodeWriteMultipleRegisters, 0, 0, 0, 0x7B, 0xFF})
+	f.Fuzz(func(t *testing.T, frame []byte) {
+		size := rtuFrameSize(frame)
+		if size != 0 && (size < 8 || size > 9+255) {
+			t.Fatalf("rtuFrameSize(%x) = %d", frame, size)
+		}
+		// Kích thước xác định được từ một phần khung không đổi khi nhận thêm byte
+		known := 0
+		for k := 0; k <= len(frame); k++ {
+			s := rtuFrameSize(frame[:k])
+			switch {
+			case s == 0 && known == 0:
+			case known == 0:
+				known = s
+			case s != known:
+				t.Fatalf("rtuFrameSize(%x): %d byte đầu cho %d, trước đó %d", frame, k, s, known)
+			}
+		}
+		if known != size {
+			t.Fatalf("rtuFrameSize(%x) = %d, từ các phần khung: %d", frame, size, known)
+		}
+	})
+}
+
+func FuzzHandleRTUFrame(f *testing.F) {
+	logrus.SetOutput(io.Discard)
+	for _, pdu := range seedPDUs() {
+		f.Add(rtuFrame(slaveID, pdu...))
+		f.Add(rtuFrame(0, pdu...))
+		f.Add(rtuFrame(slaveID+1, pdu...))
+	}
+	bad := rtuFrame(slaveID, seedPDUs()[0]...)
+	bad[len(bad)-1] ^= 0xFF
+	f.Add(bad)
+	sim := newSimulator() // Thanh ghi ghi qua Modbus giữ lại giữa các lần chạy, không ảnh hưởng tới kiểm tra
+	f.Fuzz(func(t *testing.T, frame []byte) {
+		if len(frame) < 4 { // serveRTU chỉ xử lý khung từ 4 byte (địa chỉ, function code, CRC)
+			return
+		}
+		var out bytes.Buffer
+		sim.handleRTUFrame(&out, frame)
+		resp := out.Bytes()
+		if len(resp) == 0 {
+			return
+		}
+		n := len(frame)
+		switch {
+		case modbusCRC16(frame[:n-2]) != binary.LittleEndian.Uint16(frame[n-2:]):
+			t.Fatalf("khung sai CRC %x vẫn được trả lời %x", frame, resp)
+		case frame[0] != slaveID:
+			t.Fatalf("khung gửi tới slave %d (broadcast hoặc slave khác) được trả lời %x", frame[0], resp)
+		case len(resp) < 5 || modbusCRC16(resp[:len(resp)-2]) != binary.LittleEndian.Uint16(resp[len(resp)-2:]):
+			t.Fatalf("phản hồi %x cho %x không hợp lệ", resp, frame)
+		case resp[0] != slaveID || resp[1]&0x7F != frame[1]:
+			t.Fatalf("phản hồi %x không khớp yêu cầu %x", resp, frame)
+		}
+		checkResponsePDU(t, frame[1:n-2], resp[1:len(resp)-2])
+	})
+}
+
+// checkResponsePDU kiểm tra PDU phản hồi: exception 2 byte, hoặc phản hồi đọc có byte count
+// khớp số thanh ghi yêu cầu.
+func checkResponsePDU(t *testing.T, req, resp []byte) {
+	t.Helper()
+	if resp[0]&0x80 != 0 {
+		if len(resp) != 2 || resp[1] == 0 {
+			t.Fatalf("exception không hợp lệ %x cho %x", resp, req)
+		}
+		return
+	}
+	switch req[0] {
+	case modbus.FuncCodeReadHoldingRegisters, modbus.FuncCodeReadInputRegisters:
+		qty := int(binary.BigEndian.Uint16(req[3:]))
+		if len(resp) != 2+2*qty || int(resp[1]) != 2*qty {
+			t.Fatalf("phản hồi đọc %x không khớp %d thanh ghi yêu cầu", resp, qty)
+		}
+	case modbus.FuncCodeWriteSingleRegister:
+		if !bytes.Equal(resp, req) {
+			t.Fatalf("phản hồi ghi %x khác yêu cầu %x", resp, req)
+		}
+	case modbus.FuncCodeWriteMultipleRegisters:
+		if !bytes.Equal(resp, req[:5]) {
+			t.Fatalf("phản hồi ghi nhiều thanh ghi %x khác %x", resp, req[:5])
+		}
+	default:
+		t.Fatalf("function code %d không hỗ trợ nhưng không trả về exception: %x", req[0], resp)
+	}
+}
+
+// FuzzServeTCPConn gửi luồng bytes bất kỳ tới một kết nối Modbus TCP của bộ mô phỏng và kiểm tra
+// các khung phản hồi nhận được trọn vẹn.
+func FuzzServeTCPConn(f *testing.F) {
+	logrus.SetOutput(io.Discard)
+	var stream []byte
+	for i, pdu := range seedPDUs() {
+		frame := mbapFrame(uint16(i), slaveID, pdu...)
+		f.Add(frame)
+		stream = append(stream, frame...)
+	}
+	f.Add(stream)
+	f.Add(mbapFrame(1, slaveID+1, seedPDUs()[0]...))
+	f.Add([]byte{0, 1, 0, 0, 0xFF, 0xFF, 1})
+	f.Add([]byte{0, 1, 0, 0, 0, 1, 1})
+	sim := newSimulator()
+	f.Fuzz(func(t *testing.T, stream []byte) {
+		ctx, cancel := context.WithCancel(context.Background())
+		client, server := net.Pipe()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			sim.serveTCPConn(ctx, server)
+		}()
+		go func() {
+			client.Write(stream)
+			cancel() // Đã gửi hết: đóng kết nối phía bộ mô phỏng
+		}()
+		out, _ := io.ReadAll(client)
+		cancel()
+		<-done
+		client.Close()
+
+		for len(out) >= 7 {
+			length := int(binary.BigEndian.Uint16(out[4:]))
+			if length < 2 || len(out) < 6+length {
+				break // Phản hồi cuối có thể bị cắt khi đóng kết nối
+			}
+			resp := out[7 : 6+length]
+			if resp[0]&0x80 != 0 && (len(resp) != 2 || resp[1] == 0) {
+				t.Fatalf("exception không hợp lệ %x", resp)
+			}
+			out = out[6+length:]
+		}
+	})
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"modbus_test/decode"
+	"modbus_test/sinks"
+)
+
+// --- Cấu hình các đầu ra dữ liệu (sink) ---
+var sinkConfigs = []sinks.Config{
+	{Name: "console", Enabled: true, Level: logrus.InfoLevel, BufferSize: 5},
+	{Name: "json", Enabled: enableJSONData, Level: logrus.InfoLevel, BufferSize: 100},
+	{Name: "csv", Enabled: enableCSVLogging, Level: logrus.InfoLevel, BufferSize: 100},
+	{Name: "prometheus", Enabled: enableMetrics, Level: logrus.InfoLevel, BufferSize: 10},
+	{Name: "mqtt", Enabled: enableMQTT, Level: logrus.InfoLevel, BufferSize: 100, StoreForward: true},
+	{Name: "influx", Enabled: enableInflux, Level: logrus.InfoLevel, BufferSize: 1000, StoreForward: true},
+	{Name: "sqlite", Enabled: enableSQLite, Level: logrus.InfoLevel, BufferSize: 100},
+	{Name: "dashboard", Enabled: enableAPI && enableDashboard, Level: logrus.InfoLevel, BufferSize: 10},
+}
+
+// newSink tạo sink theo tên cấu hình.
+func newSink(cfg sinks.Config) (sinks.Sink, error) {
+	switch cfg.Name {
+	case "console":
+		if useTUI() {
+			return &tuiSink{}, nil
+		}
+		return &consoleSink{}, nil
+	case "json":
+		return sinks.NewJSON(logrus.StandardLogger()), nil
+	case "csv":
+		return &csvSink{names: sinks.FilterNames(outputRegisterNames(), cfg.Filter)}, nil
+	case "prometheus":
+		return &metricsSink{}, nil
+	case "mqtt":
+		return &mqttSink{mode: mqttPayloadMode}, nil
+	case "influx":
+		return &influxSink{}, nil
+	case "sqlite":
+		return &sqliteSink{}, nil
+	case "dashboard":
+		return &dashboardSink{}, nil
+	}
+	return nil, fmt.Errorf("sink không hỗ trợ: %s", cfg.Name)
+}
+
+// fanOut phân phối kết quả mỗi chu kỳ tới các sink đang chạy.
+var fanOut = &sinks.FanOut{}
+
+// setupSinks mở các sink được bật. Sink không mở được sẽ bị bỏ qua, không ảnh hưởng sink khác.
+func setupSinks() {
+	fanOut.QueueDir = filepath.Join(logDir, "queue")
+	for _, cfg := range sinkConfigs {
+		if !cfg.Enabled {
+			continue
+		}
+		sink, err := newSink(cfg)
+		if err == nil {
+			err = sink.Open()
+		}
+		if err != nil {
+			log.Printf("Lỗi khởi tạo sink '%s': %v. Sink này sẽ bị bỏ qua.", cfg.Name, err)
+			continue
+		}
+		fanOut.Add(cfg, sink)
+	}
+}
+
+// --- Sink Console: in bảng giá trị theo nhóm ---
+type consoleSink struct{}
+
+func (s *consoleSink) Open() error                     { return nil }
+func (s *consoleSink) Flush(ctx context.Context) error { return nil }
+func (s *consoleSink) Close(ctx context.Context) error { return nil }
+
+func (s *consoleSink) Write(ctx context.Context, result sinks.CycleResult) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "\n==================== Lần đọc thứ %d (%s) ====================\n", result.Cycle, result.StartTime.Format("15:04:05"))
+	currentGroup := ""
+	for _, name := range result.Names {
+		groupGuess := registerGroup(name)
+		// In header nhóm nếu thay đổi
+		if groupGuess != currentGroup {
+			// In dòng phân cách nếu không phải nhóm đầu tiên
+			if currentGroup != "" {
+				b.WriteString("------------------------------------------\n")
+			}
+			fmt.Fprintf(&b, "--- %s ---\n", groupGuess)
+			currentGroup = groupGuess
+		}
+		prefix, displayValue := formatConsoleValue(result.Data, name)
+		fmt.Fprintf(&b, "%-30s: %s%s\n", name, prefix, displayValue) // Tăng độ rộng tên
+	}
+	for _, ev := range result.Alarms {
+		fmt.Fprintf(&b, "[CẢNH BÁO] %-7s %-10s %s (giá trị: %v, ngưỡng: %g)\n", ev.Event, ev.Severity, ev.ID, ev.Value, ev.Limit)
+	}
+	b.WriteString("==================================================================\n")
+	_, err := os.Stdout.WriteString(b.String())
+	return err
+}
+
+// formatConsoleValue trả về tiền tố ([LỖI], [NaN]) và chuỗi hiển thị của một thanh ghi.
+func formatConsoleValue(data map[string]interface{}, name string) (string, string) {
+	value, ok := data[name]
+	if !ok {
+		return "[LỖI] ", "NOT_IN_RESULT"
+	}
+	prefix := ""
+	if decode.IsError(value) {
+		prefix = "[LỖI] "
+	}
+	switch v := value.(type) {
+	case float32:
+		fv64 := float64(v)
+		if math.IsNaN(fv64) || math.IsInf(fv64, 0) {
+			return "[NaN] ", fmt.Sprintf("%v", v)
+		}
+		return prefix, fmt.Sprintf("%.4f", v)
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return "[NaN] ", fmt.Sprintf("%v", v)
+		}
+		return prefix, fmt.Sprintf("%.4f", v)
+	case string:
+		return prefix, fmt.Sprintf("%q", v)
+	default:
+		return prefix, fmt.Sprintf("%v", v)
+	}
+}
+
+// --- Sink CSV: một dòng cho mỗi chu kỳ ---
+type csvSink struct {
+	names  []string
+	out    *rotatingFile
+	writer *csv.Writer
+}
+
+func (s *csvSink) Open() error {
+	out, err := openRotatingFile(logCSVFile, false)
+	if err != nil {
+		return fmt.Errorf("lỗi tạo file log CSV: %w", err)
+	}
+	s.out = out
+	s.writer = csv.NewWriter(out)
+	if err := s.writeHeader(); err != nil {
+		return err
+	}
+	log.Printf("Log CSV sẽ được ghi tại: %s", out.Path())
+	return nil
+}
+
+func (s *csvSink) writeHeader() error {
+	if err := s.writer.Write(append([]string{"Timestamp"}, s.names...)); err != nil {
+		return fmt.Errorf("lỗi ghi CSV header: %w", err)
+	}
+	s.writer.Flush()
+	return s.writer.Error()
+}
+
+// rotate chuyển sang file CSV mới khi tới hạn xoay vòng; mỗi file mới đều có header riêng.
+func (s *csvSink) rotate(ts time.Time) error {
+	s.writer.Flush()
+	rotated, err := s.out.RotateIfDue(ts)
+	if err != nil {
+		log.Printf("Lỗi xoay vòng file log CSV: %v. Tiếp tục ghi vào file cũ.", err)
+	}
+	if !rotated {
+		return nil
+	}
+	return s.writeHeader()
+}
+
+func (s *csvSink) Write(ctx context.Context, result sinks.CycleResult) error {
+	if !csvFullRowMode {
+		changed := false
+		for _, name := range s.names {
+			changed = changed || result.Reported[name]
+		}
+		if !changed {
+			return nil
+		}
+	}
+	if err := s.rotate(result.StartTime); err != nil {
+		return err
+	}
+	row := []string{result.StartTime.Format("2006-01-02 15:04:05.000")}
+	for _, name := range s.names {
+		val, ok := result.Data[name]
+		if !ok || (!csvFullRowMode && !result.Reported[name]) {
+			row = append(row, "")
+			continue
+		}
+		row = append(row, fmt.Sprintf("%v", val))
+	}
+	return s.writer.Write(row)
+}
+
+func (s *csvSink) Flush(ctx context.Context) error {
+	s.writer.Flush()
+	return s.writer.Error()
+}
+
+func (s *csvSink) Close(ctx context.Context) error {
+	s.writer.Flush()
+	log.Println("Đã đóng file log CSV.")
+	return s.out.Close()
+}
@@ -0,0 +1,57 @@
+package sinks
+
+import (
+	"context"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"modbus_test/decode"
+)
+
+// JSON ghi bản ghi "Modbus Data Read" qua logrus (file JSON lines + console). Chỉ các thanh ghi
+// được báo cáo (Reported) trong chu kỳ mới được ghi.
+type JSON struct {
+	logger *logrus.Logger
+}
+
+// NewJSON tạo sink JSON ghi qua logger.
+func NewJSON(logger *logrus.Logger) *JSON {
+	return &JSON{logger: logger}
+}
+
+func (s *JSON) Open() error                     { return nil }
+func (s *JSON) Flush(ctx context.Context) error { return nil }
+func (s *JSON) Close(ctx context.Context) error { return nil }
+
+func (s *JSON) Write(ctx context.Context, result CycleResult) error {
+	logFields := logrus.Fields{
+		"timestamp_rfc3339": result.StartTime.Format(time.RFC3339Nano), "read_duration_ms": result.Duration.Milliseconds(),
+		"slave_id": int(result.SlaveID), "read_cycle": result.Cycle,
+	}
+	reportedCount := 0
+	for _, name := range result.Names {
+		value, ok := result.Data[name]
+		if !ok || !result.Reported[name] {
+			continue // Không thay đổi vượt deadband, không ghi vào log
+		}
+		reportedCount++
+		if decode.IsError(value) {
+			logFields[name] = value
+		} else {
+			logFields[name] = decode.Sanitize(value)
+		}
+	}
+	if reportedCount == 0 {
+		return nil
+	}
+	logFields["pf_consistency_errors"] = result.PFConsistencyErrors
+	logFields["alarm_events"] = len(result.Alarms)
+	logFields["alarms_active"] = result.AlarmsActive
+	logFields["registers_total_attempted"] = result.RegistersTotal
+	logFields["registers_ok"] = result.RegistersOK
+	logFields["registers_error"] = result.RegistersError
+	logFields["registers_reported"] = reportedCount
+	s.logger.WithFields(logFields).Info("Modbus Data Read")
+	return nil
+}
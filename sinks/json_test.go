@@ -0,0 +1,80 @@
+package sinks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"modbus_test/decode"
+)
+
+func testCycle() CycleResult {
+	return CycleResult{
+		Cycle: 3, StartTime: time.Date(2026, 10, 19, 12, 30, 0, 500e6, time.UTC), Duration: 120 * time.Millisecond, SlaveID: 1,
+		Names: []string{"Voltage", "Status", "Model", "PF", "Current", "Power", "Unchanged"},
+		Data: map[string]interface{}{
+			"Voltage":   float32(231.123456),
+			"Status":    uint16(7),
+			"Model":     "PM5560",
+			"PF":        decode.PowerFactor{Value: -0.95, Magnitude: 0.95, LeadLag: "LEAD", Quadrant: 2},
+			"Current":   decode.ReadError,
+			"Power":     math.NaN(),
+			"Unchanged": int16(5),
+		},
+		Reported: map[string]bool{
+			"Voltage": true, "Status": true, "Model": true, "PF": true, "Current": true, "Power": true,
+		},
+		RegistersTotal: 7, RegistersOK: 6, RegistersError: 1,
+	}
+}
+
+func TestJSONWrite(t *testing.T) {
+	var buf bytes.Buffer
+	logger := logrus.New()
+	logger.SetOutput(&buf)
+	logger.SetFormatter(&logrus.JSONFormatter{DisableTimestamp: true})
+	if err := NewJSON(logger).Write(context.Background(), testCycle()); err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("bản ghi không phải JSON: %v\n%s", err, buf.String())
+	}
+	want := map[string]interface{}{
+		"level": "info", "msg": "Modbus Data Read",
+		"timestamp_rfc3339": "2026-10-19T12:30:00.5Z", "read_duration_ms": 120.0, "slave_id": 1.0, "read_cycle": 3.0,
+		"Voltage": 231.1235, // Làm tròn 4 chữ số
+		"Status":  7.0,
+		"Model":   "PM5560",
+		"PF":      map[string]interface{}{"value": -0.95, "magnitude": 0.95, "lead_lag": "LEAD", "quadrant": 2.0},
+		"Current": decode.ReadError,
+		"Power":   nil, // NaN không biểu diễn được trong JSON
+
+		"pf_consistency_errors": 0.0, "alarm_events": 0.0, "alarms_active": 0.0,
+		"registers_total_attempted": 7.0, "registers_ok": 6.0, "registers_error": 1.0, "registers_reported": 6.0,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("bản ghi JSON = %v\ncần %v", got, want)
+	}
+}
+
+// Chu kỳ không có thanh ghi nào thay đổi (report-by-exception) không được ghi.
+func TestJSONWriteNothingReported(t *testing.T) {
+	var buf bytes.Buffer
+	logger := logrus.New()
+	logger.SetOutput(&buf)
+	result := testCycle()
+	result.Reported = nil
+	if err := NewJSON(logger).Write(context.Background(), result); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("không cần ghi gì, nhận %q", buf.String())
+	}
+}
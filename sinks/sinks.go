@@ -0,0 +1,265 @@
+// Package sinks định nghĩa kết quả một chu kỳ đọc (CycleResult), giao diện đầu ra dữ liệu (Sink)
+// và bộ phân phối tới nhiều sink, mỗi sink chạy trong goroutine riêng với hàng đợi có giới hạn
+// hoặc hàng đợi lưu trên đĩa (store-and-forward) cho sink mạng.
+package sinks
+
+import (
+	"context"
+	"log"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Config là cấu hình một sink.
+type Config struct {
+	Name         string       // "console", "json", "csv", "prometheus", "mqtt", "influx", "sqlite", "dashboard"
+	Enabled      bool         // Bật/tắt sink
+	Level        logrus.Level // Chỉ nhận chu kỳ có mức độ nghiêm trọng >= Level (InfoLevel: mọi chu kỳ, WarnLevel: chu kỳ có lỗi/cảnh báo)
+	Filter       []string     // Mẫu tên thanh ghi (glob, ví dụ "Voltage_*"); rỗng = tất cả
+	BufferSize   int          // Số chu kỳ tối đa chờ trong hàng đợi; đầy thì chu kỳ mới bị bỏ qua
+	StoreForward bool         // Lưu chu kỳ vào hàng đợi trên đĩa và gửi lại khi sink mạng kết nối lại (store_forward.go)
+}
+
+// Các loại sự kiện cảnh báo.
+const (
+	AlarmEventRaise = "RAISE"
+	AlarmEventClear = "CLEAR"
+	AlarmEventAck   = "ACK"
+)
+
+// AlarmEvent được ghi vào log JSON và gửi tới các sink.
+type AlarmEvent struct {
+	Time     time.Time   `json:"time"`
+	ID       string      `json:"id"`
+	Register string      `json:"register"`
+	Kind     string      `json:"kind"`
+	Severity string      `json:"severity"`
+	Event    string      `json:"event"`
+	Value    interface{} `json:"value,omitempty"`
+	Limit    float64     `json:"limit"`
+	AckBy    string      `json:"ack_by,omitempty"`
+}
+
+// CycleResult là kết quả của một chu kỳ đọc, được gửi tới từng sink.
+type CycleResult struct {
+	Cycle               uint64
+	StartTime           time.Time
+	Duration            time.Duration
+	SlaveID             byte
+	Names               []string               // Tên thanh ghi theo thứ tự hiển thị (đã lọc theo sink)
+	Data                map[string]interface{} // Giá trị đã giải mã, lỗi hoặc N/A
+	Reported            map[string]bool        // Thanh ghi thay đổi vượt deadband (report-by-exception)
+	Alarms              []AlarmEvent           // Sự kiện cảnh báo phát sinh trong chu kỳ
+	AlarmsActive        int
+	PFConsistencyErrors int
+	RegistersTotal      int
+	RegistersOK         int
+	RegistersError      int
+}
+
+// Level trả về mức độ nghiêm trọng của chu kỳ: Error nếu mọi thanh ghi lỗi, Warn nếu có lỗi
+// hoặc cảnh báo được phát, ngược lại Info.
+func (r CycleResult) Level() logrus.Level {
+	switch {
+	case r.RegistersTotal > 0 && r.RegistersError == r.RegistersTotal:
+		return logrus.ErrorLevel
+	case r.RegistersError > 0:
+		return logrus.WarnLevel
+	}
+	for _, ev := range r.Alarms {
+		if ev.Event == AlarmEventRaise {
+			return logrus.WarnLevel
+		}
+	}
+	return logrus.InfoLevel
+}
+
+// Sink là một đầu ra dữ liệu. Write/Flush/Close được gọi tuần tự từ một goroutine riêng của sink;
+// ctx bị hủy khi chương trình dừng mà sink chưa ghi xong trong thời hạn của FanOut.Close.
+type Sink interface {
+	Open() error
+	Write(ctx context.Context, result CycleResult) error
+	Flush(ctx context.Context) error
+	Close(ctx context.Context) error
+}
+
+// FilterNames giữ lại các tên khớp ít nhất một mẫu glob. Không có mẫu nào thì giữ tất cả.
+func FilterNames(names []string, patterns []string) []string {
+	if len(patterns) == 0 {
+		return names
+	}
+	var filtered []string
+	for _, name := range names {
+		for _, pattern := range patterns {
+			if ok, _ := path.Match(pattern, name); ok {
+				filtered = append(filtered, name)
+				break
+			}
+		}
+	}
+	return filtered
+}
+
+// --- Fan-out: mỗi sink chạy trong goroutine riêng với hàng đợi có giới hạn ---
+type runner struct {
+	ctx      context.Context
+	cfg      Config
+	sink     Sink
+	ch       chan CycleResult
+	done     chan struct{}
+	dropped  uint64
+	failures uint64
+}
+
+// FanOut gửi kết quả mỗi chu kỳ tới các sink đã thêm bằng Add.
+type FanOut struct {
+	QueueDir string // Thư mục hàng đợi store-and-forward, mỗi sink một thư mục con
+	Wait     bool   // Chờ khi hàng đợi sink đầy thay vì bỏ qua chu kỳ (phát lại log)
+
+	mu      sync.Mutex
+	runners []*runner
+	ctx     context.Context
+	cancel  context.CancelFunc
+}
+
+// Add chạy sink đã mở trong goroutine riêng.
+func (f *FanOut) Add(cfg Config, sink Sink) {
+	if cfg.BufferSize <= 0 {
+		cfg.BufferSize = 1
+	}
+	f.mu.Lock()
+	if f.ctx == nil {
+		f.ctx, f.cancel = context.WithCancel(context.Background())
+	}
+	r := &runner{ctx: f.ctx, cfg: cfg, sink: sink, ch: make(chan CycleResult, cfg.BufferSize), done: make(chan struct{})}
+	f.runners = append(f.runners, r)
+	f.mu.Unlock()
+	if cfg.StoreForward {
+		d, ok := sink.(BatchDeliverer)
+		if !ok {
+			log.Printf("Sink '%s' không hỗ trợ store-and-forward, dùng hàng đợi trong bộ nhớ.", cfg.Name)
+		} else if q, err := openDiskQueue(cfg.Name, filepath.Join(f.QueueDir, cfg.Name)); err != nil {
+			log.Printf("Lỗi mở hàng đợi trên đĩa cho sink '%s': %v. Dùng hàng đợi trong bộ nhớ.", cfg.Name, err)
+		} else {
+			if q.Len() > 0 {
+				log.Printf("Sink '%s': còn %d chu kỳ chờ gửi từ lần chạy trước.", cfg.Name, q.Len())
+			}
+			go r.runStoreForward(d, q)
+			return
+		}
+	}
+	go r.run()
+}
+
+// Len trả về số sink đang chạy.
+func (f *FanOut) Len() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.runners)
+}
+
+func (r *runner) run() {
+	defer close(r.done)
+	defer r.close()
+	for result := range r.ch {
+		if err := r.sink.Write(r.ctx, result); err != nil {
+			r.failures++
+			if r.failures == 1 || r.failures%100 == 0 {
+				logrus.WithError(err).WithFields(logrus.Fields{"sink": r.cfg.Name, "failures": r.failures}).Error("Lỗi ghi dữ liệu ra sink")
+			}
+		}
+		if len(r.ch) == 0 {
+			if err := r.sink.Flush(r.ctx); err != nil {
+				logrus.WithError(err).WithField("sink", r.cfg.Name).Error("Lỗi flush sink")
+			}
+		}
+	}
+}
+
+// close ghi nốt dữ liệu còn trong bộ đệm của sink rồi đóng sink (sau khi hàng đợi đã đóng).
+func (r *runner) close() {
+	r.sink.Flush(r.ctx)
+	if err := r.sink.Close(r.ctx); err != nil {
+		log.Printf("Lỗi đóng sink '%s': %v", r.cfg.Name, err)
+	}
+}
+
+// Publish gửi kết quả chu kỳ tới các sink mà không chờ: sink chậm hoặc lỗi chỉ làm mất dữ liệu
+// của chính nó, vòng lặp đọc không bị chặn. Với Wait, Publish chờ hàng đợi sink cho tới khi ctx bị hủy.
+func (f *FanOut) Publish(ctx context.Context, result CycleResult) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	level := result.Level()
+	for _, r := range f.runners {
+		if level > r.cfg.Level {
+			continue
+		}
+		filtered := result
+		if len(r.cfg.Filter) > 0 {
+			filtered.Names = FilterNames(result.Names, r.cfg.Filter)
+			filtered.Data = make(map[string]interface{}, len(filtered.Names))
+			for _, name := range filtered.Names {
+				filtered.Data[name] = result.Data[name]
+			}
+		}
+		if f.Wait {
+			select {
+			case r.ch <- filtered:
+			case <-ctx.Done():
+			}
+			continue
+		}
+		select {
+		case r.ch <- filtered:
+		default:
+			r.dropped++
+			if r.dropped == 1 || r.dropped%100 == 0 {
+				logrus.WithFields(logrus.Fields{"sink": r.cfg.Name, "dropped": r.dropped, "buffer_size": r.cfg.BufferSize}).Warn("Hàng đợi sink đầy, bỏ qua chu kỳ")
+			}
+		}
+	}
+}
+
+// Close đóng hàng đợi và chờ các sink ghi hết dữ liệu còn lại rồi đóng sink. Quá timeout thì
+// context của các sink bị hủy để dừng các thao tác ghi đang chờ (mạng, thử lại).
+func (f *FanOut) Close(timeout time.Duration) {
+	f.mu.Lock()
+	runners := f.runners
+	f.runners = nil
+	cancel := f.cancel
+	f.ctx, f.cancel = nil, nil
+	f.mu.Unlock()
+	if cancel == nil {
+		return
+	}
+	defer cancel()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for _, r := range runners {
+		close(r.ch)
+	}
+	// Chờ tới hạn chung; hết hạn thì hủy context một lần và chờ mọi runner kết thúc (context đã
+	// hủy nên các thao tác ghi đang chờ trả về ngay).
+	timedOut := false
+	for _, r := range runners {
+		if !timedOut {
+			select {
+			case <-r.done:
+				continue
+			case <-timer.C:
+				timedOut = true
+				cancel()
+			}
+		}
+		select {
+		case <-r.done:
+		default:
+			log.Printf("Sink '%s' không ghi xong trong %v, bỏ qua dữ liệu còn lại.", r.cfg.Name, timeout)
+			<-r.done
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package sinks
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// stuckSink là sink treo khi ghi cho tới khi ctx bị hủy (giống sink mạng đang thử lại).
+type stuckSink struct {
+	closed *int32
+}
+
+func (s *stuckSink) Open() error { return nil }
+func (s *stuckSink) Write(ctx context.Context, _ CycleResult) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+func (s *stuckSink) Flush(ctx context.Context) error { return nil }
+func (s *stuckSink) Close(ctx context.Context) error {
+	time.Sleep(10 * time.Millisecond) // Đóng kết nối sau khi bị hủy vẫn mất một chút thời gian
+	atomic.AddInt32(s.closed, 1)
+	return nil
+}
+
+// TestFanOutCloseTimeout: nhiều sink cùng treo thì Close trả về ngay sau timeout (hủy context
+// một lần), nhưng chỉ sau khi mọi sink đã đóng xong.
+func TestFanOutCloseTimeout(t *testing.T) {
+	var closed int32
+	f := &FanOut{}
+	const sinkCount = 3
+	for _, name := range []string{"a", "b", "c"} {
+		f.Add(Config{Name: name, Level: logrus.DebugLevel, BufferSize: 1}, &stuckSink{closed: &closed})
+	}
+	f.Publish(context.Background(), CycleResult{Cycle: 1})
+
+	const timeout = 50 * time.Millisecond
+	done := make(chan time.Duration)
+	go func() {
+		start := time.Now()
+		f.Close(timeout)
+		done <- time.Since(start)
+	}()
+	select {
+	case elapsed := <-done:
+		if elapsed < timeout {
+			t.Errorf("Close trả về sau %v, trước timeout %v", elapsed, timeout)
+		}
+		if n := atomic.LoadInt32(&closed); n != sinkCount {
+			t.Errorf("Close trả về khi mới có %d/%d sink đóng xong", n, sinkCount)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Close bị treo khi nhiều sink không ghi xong")
+	}
+}
@@ -0,0 +1,459 @@
+package sinks
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+
+	"modbus_test/decode"
+)
+
+// --- Cấu hình hàng đợi lưu tạm trên đĩa (store-and-forward) cho sink mạng ---
+const (
+	metricsNamespace = "modbus"
+
+	sfMaxBytes      = 200 << 20          // Dung lượng tối đa của hàng đợi mỗi sink; vượt quá thì bỏ dữ liệu cũ nhất
+	sfMaxAge        = 7 * 24 * time.Hour // Chu kỳ cũ hơn khoảng này bị bỏ, không gửi lại
+	sfSegmentBytes  = 4 << 20            // Kích thước mỗi file segment
+	sfRetryInterval = 10 * time.Second   // Thời gian chờ trước khi thử gửi lại sau lỗi
+	sfReplayBatch   = 100                // Số chu kỳ tối đa gửi trong một lần
+	sfPollInterval  = 1 * time.Second    // Chu kỳ kiểm tra hàng đợi khi không có dữ liệu mới
+	sfCursorFile    = "cursor.json"      // Vị trí đã gửi thành công, giữ qua các lần khởi động
+	sfSegmentSuffix = ".jsonl"
+)
+
+// BatchDeliverer được các sink mạng (MQTT, InfluxDB) cài đặt để dùng với store-and-forward:
+// Deliver chỉ trả về nil khi toàn bộ lô đã được gửi thành công.
+type BatchDeliverer interface {
+	Deliver(ctx context.Context, results []CycleResult) error
+}
+
+// DeliveryPacer (tùy chọn): khoảng thời gian tối thiểu giữa 2 lần gửi khi kết nối bình thường,
+// dùng để gom lô (ví dụ InfluxDB).
+type DeliveryPacer interface {
+	DeliveryInterval() time.Duration
+}
+
+var (
+	metricQueueDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace, Name: "store_forward_queue_depth", Help: "Số chu kỳ đang chờ gửi trong hàng đợi trên đĩa.",
+	}, []string{"sink"})
+	metricQueueBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace, Name: "store_forward_queue_bytes", Help: "Dung lượng hàng đợi trên đĩa.",
+	}, []string{"sink"})
+	metricQueueDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace, Name: "store_forward_dropped_total", Help: "Số chu kỳ bị bỏ khỏi hàng đợi theo lý do (size, age, corrupt).",
+	}, []string{"sink", "reason"})
+	metricQueueReplayed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace, Name: "store_forward_delivered_total", Help: "Số chu kỳ đã gửi thành công từ hàng đợi.",
+	}, []string{"sink"})
+)
+
+// Collectors trả về các metric của hàng đợi store-and-forward để đăng ký vào registry Prometheus.
+func Collectors() []prometheus.Collector {
+	return []prometheus.Collector{metricQueueDepth, metricQueueBytes, metricQueueDropped, metricQueueReplayed}
+}
+
+// diskQueue là hàng đợi FIFO lưu trên đĩa dạng các file segment JSON lines. Chỉ được dùng từ
+// một goroutine (runner của sink).
+type diskQueue struct {
+	name       string
+	dir        string
+	segments   []uint64 // Số thứ tự các segment còn tồn tại, tăng dần
+	sizes      map[uint64]int64
+	readOffset int64 // Vị trí đọc trong segment đầu tiên
+	writer     *os.File
+	count      int // Số bản ghi chưa gửi
+	peekBytes  int64
+	peekCount  int
+}
+
+type diskQueueCursor struct {
+	Segment uint64 `json:"segment"`
+	Offset  int64  `json:"offset"`
+}
+
+func openDiskQueue(name, dir string) (*diskQueue, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	q := &diskQueue{name: name, dir: dir, sizes: make(map[uint64]int64)}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		seq, err := strconv.ParseUint(strings.TrimSuffix(entry.Name(), sfSegmentSuffix), 10, 64)
+		if err != nil || !strings.HasSuffix(entry.Name(), sfSegmentSuffix) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		q.segments = append(q.segments, seq)
+		q.sizes[seq] = info.Size()
+	}
+	sort.Slice(q.segments, func(i, j int) bool { return q.segments[i] < q.segments[j] })
+
+	var cursor diskQueueCursor
+	if b, err := os.ReadFile(filepath.Join(dir, sfCursorFile)); err == nil {
+		json.Unmarshal(b, &cursor)
+	}
+	for len(q.segments) > 0 && q.segments[0] < cursor.Segment {
+		os.Remove(q.segmentPath(q.segments[0])) // Đã gửi xong từ lần chạy trước
+		delete(q.sizes, q.segments[0])
+		q.segments = q.segments[1:]
+	}
+	if len(q.segments) > 0 && q.segments[0] == cursor.Segment && cursor.Offset <= q.sizes[cursor.Segment] {
+		q.readOffset = cursor.Offset
+	}
+	for i, seq := range q.segments {
+		offset := int64(0)
+		if i == 0 {
+			offset = q.readOffset
+		}
+		n, err := countLines(q.segmentPath(seq), offset)
+		if err != nil {
+			return nil, err
+		}
+		q.count += n
+	}
+
+	next := uint64(1)
+	if len(q.segments) > 0 {
+		next = q.segments[len(q.segments)-1]
+		if q.sizes[next] >= sfSegmentBytes {
+			next++
+		}
+	}
+	if err := q.openWriter(next); err != nil {
+		return nil, err
+	}
+	q.updateMetrics()
+	return q, nil
+}
+
+func countLines(path string, offset int64) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+	count := 0
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := f.Read(buf)
+		count += bytes.Count(buf[:n], []byte{'\n'})
+		if err == io.EOF {
+			return count, nil
+		}
+		if err != nil {
+			return count, err
+		}
+	}
+}
+
+func (q *diskQueue) segmentPath(seq uint64) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%010d%s", seq, sfSegmentSuffix))
+}
+
+func (q *diskQueue) openWriter(seq uint64) error {
+	f, err := os.OpenFile(q.segmentPath(seq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("lỗi mở segment hàng đợi: %w", err)
+	}
+	if q.writer != nil {
+		q.writer.Close()
+	}
+	q.writer = f
+	if len(q.segments) == 0 || q.segments[len(q.segments)-1] != seq {
+		q.segments = append(q.segments, seq)
+		q.sizes[seq] = 0
+	}
+	return nil
+}
+
+func (q *diskQueue) writeSeq() uint64 { return q.segments[len(q.segments)-1] }
+
+func (q *diskQueue) totalBytes() int64 {
+	var total int64
+	for _, size := range q.sizes {
+		total += size
+	}
+	return total - q.readOffset
+}
+
+// Append thêm một bản ghi vào cuối hàng đợi, sau đó áp dụng giới hạn dung lượng/tuổi.
+func (q *diskQueue) Append(entry []byte) error {
+	if q.sizes[q.writeSeq()] >= sfSegmentBytes {
+		if err := q.openWriter(q.writeSeq() + 1); err != nil {
+			return err
+		}
+	}
+	n, err := q.writer.Write(append(entry, '\n'))
+	q.sizes[q.writeSeq()] += int64(n)
+	if err != nil {
+		return err
+	}
+	q.count++
+	q.enforceLimits()
+	q.updateMetrics()
+	return nil
+}
+
+// enforceLimits bỏ segment cũ nhất khi vượt dung lượng hoặc khi segment quá cũ (không bỏ
+// segment đang ghi).
+func (q *diskQueue) enforceLimits() {
+	for len(q.segments) > 1 {
+		reason := ""
+		if q.totalBytes() > sfMaxBytes {
+			reason = "size"
+		} else if info, err := os.Stat(q.segmentPath(q.segments[0])); err == nil && time.Since(info.ModTime()) > sfMaxAge {
+			reason = "age"
+		}
+		if reason == "" {
+			return
+		}
+		q.dropHead(reason)
+	}
+}
+
+func (q *diskQueue) dropHead(reason string) {
+	seq := q.segments[0]
+	dropped, _ := countLines(q.segmentPath(seq), q.readOffset)
+	os.Remove(q.segmentPath(seq))
+	delete(q.sizes, seq)
+	q.segments = q.segments[1:]
+	q.readOffset, q.peekBytes, q.peekCount = 0, 0, 0
+	q.count -= dropped
+	q.saveCursor()
+	metricQueueDropped.WithLabelValues(q.name, reason).Add(float64(dropped))
+	logrus.WithFields(logrus.Fields{"sink": q.name, "dropped": dropped, "reason": reason}).Warn("Hàng đợi store-and-forward bỏ dữ liệu cũ")
+}
+
+// Peek đọc tối đa n bản ghi đầu hàng đợi (không xóa). Gọi Ack sau khi gửi thành công.
+func (q *diskQueue) Peek(n int) ([][]byte, error) {
+	q.peekBytes, q.peekCount = 0, 0
+	for len(q.segments) > 1 && q.readOffset >= q.sizes[q.segments[0]] {
+		q.advanceSegment()
+	}
+	f, err := os.Open(q.segmentPath(q.segments[0]))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if _, err := f.Seek(q.readOffset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(f)
+	var entries [][]byte
+	for len(entries) < n {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			break // Hết segment hoặc dòng chưa ghi xong
+		}
+		q.peekBytes += int64(len(line))
+		q.peekCount++
+		entries = append(entries, bytes.TrimSuffix(line, []byte{'\n'}))
+	}
+	return entries, nil
+}
+
+// Ack xóa các bản ghi đã Peek khỏi hàng đợi và lưu vị trí đã gửi.
+func (q *diskQueue) Ack() {
+	q.readOffset += q.peekBytes
+	q.count -= q.peekCount
+	q.peekBytes, q.peekCount = 0, 0
+	if len(q.segments) > 1 && q.readOffset >= q.sizes[q.segments[0]] {
+		q.advanceSegment()
+	}
+	q.saveCursor()
+	q.updateMetrics()
+}
+
+func (q *diskQueue) advanceSegment() {
+	seq := q.segments[0]
+	if q.readOffset < q.sizes[seq] {
+		// Phần cuối segment là dòng dở dang (ví dụ chương trình bị tắt khi đang ghi)
+		metricQueueDropped.WithLabelValues(q.name, "corrupt").Inc()
+	}
+	os.Remove(q.segmentPath(seq))
+	delete(q.sizes, seq)
+	q.segments = q.segments[1:]
+	q.readOffset = 0
+}
+
+func (q *diskQueue) saveCursor() {
+	b, _ := json.Marshal(diskQueueCursor{Segment: q.segments[0], Offset: q.readOffset})
+	tmp := filepath.Join(q.dir, sfCursorFile+".tmp")
+	if err := os.WriteFile(tmp, b, 0644); err == nil {
+		os.Rename(tmp, filepath.Join(q.dir, sfCursorFile))
+	}
+}
+
+func (q *diskQueue) Len() int { return q.count }
+
+func (q *diskQueue) updateMetrics() {
+	metricQueueDepth.WithLabelValues(q.name).Set(float64(q.count))
+	metricQueueBytes.WithLabelValues(q.name).Set(float64(q.totalBytes()))
+}
+
+func (q *diskQueue) Close() error {
+	q.saveCursor()
+	return q.writer.Close()
+}
+
+// encodeQueuedResult chuyển kết quả chu kỳ sang JSON để lưu vào hàng đợi. Giá trị số được chuẩn
+// hóa thành float64 (PowerFactor lấy giá trị PF) để đọc lại đúng kiểu; chuỗi giữ nguyên.
+func encodeQueuedResult(result CycleResult) ([]byte, error) {
+	data := make(map[string]interface{}, len(result.Data))
+	for name, value := range result.Data {
+		if v, quality := decode.Classify(value); quality == decode.QualityGood {
+			data[name] = decode.Float32Decimal(value, v)
+		} else if _, isString := value.(string); isString {
+			data[name] = value
+		}
+	}
+	result.Data = data
+	return json.Marshal(result)
+}
+
+// runStoreForward: mọi chu kỳ được ghi vào hàng đợi trên đĩa trước, sau đó gửi theo thứ tự.
+// Khi sink lỗi (mất kết nối), dữ liệu nằm lại trong hàng đợi và được gửi lại với timestamp gốc.
+// Mỗi vòng lặp chỉ gửi một lô (tối đa sfReplayBatch chu kỳ) để giữa các lô vẫn đọc r.ch và ghi
+// chu kỳ mới vào hàng đợi; nếu không, FanOut sẽ bỏ chu kỳ mới trong khi đang gửi lại hàng đợi dài.
+func (r *runner) runStoreForward(d BatchDeliverer, q *diskQueue) {
+	defer close(r.done)
+	defer r.close()
+	defer q.Close()
+	var pace time.Duration
+	if p, ok := d.(DeliveryPacer); ok {
+		pace = p.DeliveryInterval()
+	}
+	ticker := time.NewTicker(sfPollInterval)
+	defer ticker.Stop()
+	var nextAttempt time.Time
+	outage := false
+	for {
+		// Còn hàng đợi và đã tới lúc gửi: không chờ ticker
+		var ready <-chan struct{}
+		if q.Len() > 0 && !time.Now().Before(nextAttempt) {
+			ready = sfReady
+		}
+		// Ưu tiên ghi chu kỳ mới vào hàng đợi trước khi gửi lô tiếp theo
+		closing := false
+		select {
+		case result, ok := <-r.ch:
+			closing = r.enqueue(q, result, ok)
+		default:
+			select {
+			case result, ok := <-r.ch:
+				closing = r.enqueue(q, result, ok)
+			case <-ready:
+			case <-ticker.C:
+			}
+		}
+		for q.Len() > 0 && (closing || !time.Now().Before(nextAttempt)) {
+			queued := q.Len()
+			if err := r.replayBatch(d, q); err != nil {
+				nextAttempt = time.Now().Add(sfRetryInterval)
+				if !outage {
+					logrus.WithError(err).WithFields(logrus.Fields{"sink": r.cfg.Name, "queued": q.Len()}).Warn("Sink không gửi được, dữ liệu được lưu vào hàng đợi trên đĩa")
+				}
+				outage = true
+				break
+			}
+			if outage {
+				logrus.WithFields(logrus.Fields{"sink": r.cfg.Name, "queued": q.Len()}).Info("Sink đã gửi lại được, tiếp tục gửi hàng đợi trên đĩa")
+			}
+			outage = false
+			if q.Len() == queued {
+				nextAttempt = time.Now().Add(sfPollInterval) // Dòng cuối chưa ghi xong, chờ rồi thử lại
+				break
+			}
+			if q.Len() == 0 {
+				// Đã gửi hết: chờ pace trước lần gửi sau để gom lô
+				nextAttempt = time.Now().Add(pace)
+			}
+			if !closing {
+				break // Một lô mỗi vòng lặp; khi đóng thì gửi tiếp cho tới khi hết hoặc lỗi
+			}
+		}
+		if closing {
+			if q.Len() > 0 {
+				logrus.WithFields(logrus.Fields{"sink": r.cfg.Name, "queued": q.Len()}).Warn("Còn dữ liệu trong hàng đợi, sẽ gửi ở lần chạy sau")
+			}
+			return
+		}
+	}
+}
+
+// enqueue ghi chu kỳ nhận từ r.ch vào hàng đợi trên đĩa; trả về true khi r.ch đã đóng.
+func (r *runner) enqueue(q *diskQueue, result CycleResult, ok bool) (closing bool) {
+	if !ok {
+		return true
+	}
+	entry, err := encodeQueuedResult(result)
+	if err == nil {
+		err = q.Append(entry)
+	}
+	if err != nil {
+		logrus.WithError(err).WithField("sink", r.cfg.Name).Error("Lỗi ghi hàng đợi store-and-forward, bỏ qua chu kỳ")
+	}
+	return false
+}
+
+// sfReady là channel đã đóng, dùng trong select khi hàng đợi còn dữ liệu cần gửi ngay.
+var sfReady = func() chan struct{} {
+	ch := make(chan struct{})
+	close(ch)
+	return ch
+}()
+
+// replayBatch gửi một lô (tối đa sfReplayBatch chu kỳ) ở đầu hàng đợi.
+func (r *runner) replayBatch(d BatchDeliverer, q *diskQueue) error {
+	entries, err := q.Peek(sfReplayBatch)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return nil // Dòng cuối chưa ghi xong
+	}
+	batch := make([]CycleResult, 0, len(entries))
+	for _, entry := range entries {
+		var result CycleResult
+		if err := json.Unmarshal(entry, &result); err != nil {
+			metricQueueDropped.WithLabelValues(r.cfg.Name, "corrupt").Inc()
+			continue
+		}
+		if time.Since(result.StartTime) > sfMaxAge {
+			metricQueueDropped.WithLabelValues(r.cfg.Name, "age").Inc()
+			continue
+		}
+		batch = append(batch, result)
+	}
+	if len(batch) > 0 {
+		if err := d.Deliver(r.ctx, batch); err != nil {
+			return err
+		}
+	}
+	q.Ack()
+	metricQueueReplayed.WithLabelValues(r.cfg.Name).Add(float64(len(batch)))
+	return nil
+}
@@ -0,0 +1,82 @@
+package sinks
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// gatedDeliverer là sink mạng giả: mỗi lần Deliver gửi lô vào calls rồi chờ release.
+type gatedDeliverer struct {
+	calls   chan []CycleResult
+	release chan struct{}
+}
+
+func (d *gatedDeliverer) Open() error                                    { return nil }
+func (d *gatedDeliverer) Write(ctx context.Context, _ CycleResult) error { return nil }
+func (d *gatedDeliverer) Flush(ctx context.Context) error                { return nil }
+func (d *gatedDeliverer) Close(ctx context.Context) error                { return nil }
+
+func (d *gatedDeliverer) Deliver(ctx context.Context, results []CycleResult) error {
+	d.calls <- results
+	<-d.release
+	return nil
+}
+
+// TestStoreForwardPersistsDuringReplay: khi đang gửi lại hàng đợi dài, chu kỳ mới vẫn được ghi vào
+// hàng đợi giữa các lô (không bị FanOut bỏ vì bộ đệm đầy) và được gửi sau dữ liệu cũ.
+func TestStoreForwardPersistsDuringReplay(t *testing.T) {
+	logrus.SetOutput(io.Discard)
+	dir := t.TempDir()
+	const backlog = 3 * sfReplayBatch
+	q, err := openDiskQueue("sf", dir+"/sf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	for i := 0; i < backlog; i++ {
+		entry, _ := encodeQueuedResult(CycleResult{Cycle: uint64(i + 1), StartTime: start})
+		if err := q.Append(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	q.Close()
+
+	d := &gatedDeliverer{calls: make(chan []CycleResult), release: make(chan struct{})}
+	f := &FanOut{QueueDir: dir}
+	f.Add(Config{Name: "sf", Level: logrus.DebugLevel, StoreForward: true, BufferSize: 1}, d)
+	r := f.runners[0]
+
+	var delivered []uint64
+	for published := 0; len(delivered) < backlog+published; {
+		select {
+		case batch := <-d.calls:
+			for _, result := range batch {
+				delivered = append(delivered, result.Cycle)
+			}
+			// Sink đang bận gửi lô: chu kỳ mới chỉ vừa bộ đệm nếu chu kỳ trước đã được ghi vào hàng đợi
+			if published < 3 {
+				published++
+				f.Publish(context.Background(), CycleResult{Cycle: uint64(backlog + published), StartTime: time.Now()})
+			}
+			d.release <- struct{}{}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("hết thời gian chờ, đã gửi %d chu kỳ", len(delivered))
+		}
+	}
+	if r.dropped != 0 {
+		t.Errorf("FanOut bỏ %d chu kỳ trong khi gửi lại hàng đợi", r.dropped)
+	}
+	for i, cycle := range delivered {
+		if cycle != uint64(i+1) {
+			t.Fatalf("thứ tự gửi sai tại vị trí %d: cycle %d (tất cả: %v)", i, cycle, delivered)
+		}
+	}
+	if len(delivered) != backlog+3 {
+		t.Errorf("đã gửi %d chu kỳ, cần %d", len(delivered), backlog+3)
+	}
+	f.Close(time.Second)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"modbus_test/decode"
+	"modbus_test/sinks"
+)
+
+func TestCSVSinkRows(t *testing.T) {
+	oldDir := logDir
+	logDir = t.TempDir()
+	defer func() { logDir = oldDir }()
+
+	s := &csvSink{names: []string{"Voltage", "Status", "Model", "PF", "Current", "Missing"}}
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	path := s.out.Path()
+	ts := time.Date(2026, 10, 19, 12, 30, 0, 500e6, time.Local)
+	result := sinks.CycleResult{
+		Cycle: 1, StartTime: ts, Names: s.names,
+		Data: map[string]interface{}{
+			"Voltage": float32(231.5),
+			"Status":  uint16(7),
+			"Model":   "PM5560",
+			"PF":      decode.PowerFactor{Value: -0.95, Magnitude: 0.95, LeadLag: "LEAD", Quadrant: 2},
+			"Current": decode.LengthError,
+		},
+		Reported: map[string]bool{"Voltage": true, "Status": true, "Model": true, "PF": true, "Current": true},
+	}
+	ctx := context.Background()
+	if err := s.Write(ctx, result); err != nil {
+		t.Fatal(err)
+	}
+	result.Data["Voltage"] = decode.ReadError
+	result.StartTime = ts.Add(time.Second)
+	if err := s.Write(ctx, result); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	rows, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{
+		{"Timestamp", "Voltage", "Status", "Model", "PF", "Current", "Missing"},
+		{"2026-10-19 12:30:00.500", "231.5", "7", "PM5560", "-0.9500 LEAD Q2", "LENGTH_ERROR", ""},
+		{"2026-10-19 12:30:01.500", "READ_ERROR", "7", "PM5560", "-0.9500 LEAD Q2", "LENGTH_ERROR", ""},
+	}
+	if !reflect.DeepEqual(rows, want) {
+		t.Errorf("file CSV = %q\ncần %q", rows, want)
+	}
+}
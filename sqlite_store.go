@@ -0,0 +1,376 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite" // Driver SQLite thuần Go (không cần CGO)
+
+	"modbus_test/decode"
+	"modbus_test/registermap"
+	"modbus_test/sinks"
+)
+
+// --- Cấu hình lưu trữ SQLite ---
+const (
+	enableSQLite      = false
+	sqliteFile        = "modbus_data.db" // Lưu trong logDir
+	sqliteBusyTimeout = 5000             // ms chờ khi database đang bị khóa bởi tiến trình khác (ví dụ lệnh query)
+)
+
+// Chất lượng mẫu trong bảng samples.
+const (
+	sampleQualityGood  = 0
+	sampleQualityNA    = 1
+	sampleQualityError = 2
+)
+
+// sqliteMigrations: mỗi phần tử nâng schema lên một phiên bản (PRAGMA user_version).
+// Chỉ thêm phần tử mới vào cuối, không sửa các phần tử đã phát hành.
+var sqliteMigrations = []string{
+	// v1: schema chuẩn hóa thiết bị / thanh ghi / mẫu
+	`CREATE TABLE devices (
+		id       INTEGER PRIMARY KEY,
+		name     TEXT NOT NULL UNIQUE,
+		port     TEXT NOT NULL,
+		slave_id INTEGER NOT NULL
+	);
+	CREATE TABLE registers (
+		id        INTEGER PRIMARY KEY,
+		device_id INTEGER NOT NULL REFERENCES devices(id),
+		name      TEXT NOT NULL,
+		grp       TEXT NOT NULL,
+		unit      TEXT NOT NULL,
+		data_type TEXT NOT NULL,
+		UNIQUE (device_id, name)
+	);
+	CREATE TABLE samples (
+		register_id INTEGER NOT NULL REFERENCES registers(id),
+		ts          INTEGER NOT NULL, -- Unix milliseconds (thời điểm bắt đầu chu kỳ)
+		value       REAL,             -- Giá trị số; NULL nếu không có
+		text_value  TEXT,             -- Giá trị chuỗi hoặc mã lỗi (READ_ERROR, N/A_...)
+		quality     INTEGER NOT NULL, -- 0 = tốt, 1 = N/A, 2 = lỗi
+		PRIMARY KEY (register_id, ts)
+	) WITHOUT ROWID;
+	CREATE INDEX samples_ts ON samples(ts);`,
+	// v2: thông tin từng chu kỳ đọc
+	`CREATE TABLE cycles (
+		device_id        INTEGER NOT NULL REFERENCES devices(id),
+		ts               INTEGER NOT NULL,
+		read_cycle       INTEGER NOT NULL,
+		read_duration_ms INTEGER NOT NULL,
+		registers_ok     INTEGER NOT NULL,
+		registers_error  INTEGER NOT NULL,
+		PRIMARY KEY (device_id, ts)
+	) WITHOUT ROWID;`,
+}
+
+func openSQLite(dbPath string) (*sql.DB, error) {
+	dsn := fmt.Sprintf("file:%s?_pragma=busy_timeout(%d)&_pragma=journal_mode(WAL)&_pragma=foreign_keys(1)", filepath.ToSlash(dbPath), sqliteBusyTimeout)
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("lỗi mở SQLite '%s': %w", dbPath, err)
+	}
+	db.SetMaxOpenConns(1) // SQLite chỉ cho một writer; tránh lỗi SQLITE_BUSY giữa các kết nối của chính chương trình
+	if err := migrateSQLite(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// migrateSQLite áp dụng các migration chưa chạy, mỗi migration trong một transaction.
+func migrateSQLite(db *sql.DB) error {
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return fmt.Errorf("lỗi đọc phiên bản schema: %w", err)
+	}
+	if version > len(sqliteMigrations) {
+		return fmt.Errorf("schema database (v%d) mới hơn chương trình (v%d)", version, len(sqliteMigrations))
+	}
+	for v := version; v < len(sqliteMigrations); v++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(sqliteMigrations[v]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("lỗi migration schema v%d: %w", v+1, err)
+		}
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", v+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		log.Printf("SQLite: đã nâng schema lên v%d", v+1)
+	}
+	return nil
+}
+
+// --- Sink SQLite: mỗi chu kỳ ghi trong một transaction ---
+type sqliteSink struct {
+	db          *sql.DB
+	dbDeviceID  int64
+	registerIDs map[string]int64
+}
+
+func (s *sqliteSink) Open() error {
+	dbPath := filepath.Join(logDir, sqliteFile)
+	db, err := openSQLite(dbPath)
+	if err != nil {
+		return err
+	}
+	s.db = db
+	if err := s.registerDevice(); err != nil {
+		db.Close()
+		return err
+	}
+	log.Printf("Dữ liệu sẽ được lưu vào SQLite: %s", dbPath)
+	return nil
+}
+
+// registerDevice tạo (hoặc cập nhật) thiết bị và danh sách thanh ghi, lưu ID vào bộ nhớ đệm.
+func (s *sqliteSink) registerDevice() error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`INSERT INTO devices (name, port, slave_id) VALUES (?, ?, ?)
+		ON CONFLICT (name) DO UPDATE SET port = excluded.port, slave_id = excluded.slave_id`,
+		deviceID, portLabel(), int(slaveID)); err != nil {
+		return fmt.Errorf("lỗi ghi thiết bị vào SQLite: %w", err)
+	}
+	if err := tx.QueryRow("SELECT id FROM devices WHERE name = ?", deviceID).Scan(&s.dbDeviceID); err != nil {
+		return err
+	}
+	s.registerIDs = make(map[string]int64)
+	for _, name := range outputRegisterNames() {
+		dataType := "DERIVED"
+		if reg, ok := registermap.Find(registersToRead, name); ok {
+			dataType = reg.Type
+		}
+		if _, err := tx.Exec(`INSERT INTO registers (device_id, name, grp, unit, data_type) VALUES (?, ?, ?, ?, ?)
+			ON CONFLICT (device_id, name) DO UPDATE SET grp = excluded.grp, unit = excluded.unit, data_type = excluded.data_type`,
+			s.dbDeviceID, name, registerGroup(name), registermap.Unit(name), dataType); err != nil {
+			return fmt.Errorf("lỗi ghi thanh ghi '%s' vào SQLite: %w", name, err)
+		}
+		var id int64
+		if err := tx.QueryRow("SELECT id FROM registers WHERE device_id = ? AND name = ?", s.dbDeviceID, name).Scan(&id); err != nil {
+			return err
+		}
+		s.registerIDs[name] = id
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteSink) Write(ctx context.Context, result sinks.CycleResult) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	ts := result.StartTime.UnixMilli()
+	if _, err := tx.ExecContext(ctx, `INSERT OR REPLACE INTO cycles (device_id, ts, read_cycle, read_duration_ms, registers_ok, registers_error)
+		VALUES (?, ?, ?, ?, ?, ?)`, s.dbDeviceID, ts, result.Cycle, result.Duration.Milliseconds(), result.RegistersOK, result.RegistersError); err != nil {
+		return err
+	}
+	stmt, err := tx.PrepareContext(ctx, "INSERT OR REPLACE INTO samples (register_id, ts, value, text_value, quality) VALUES (?, ?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, name := range result.Names {
+		value, ok := result.Data[name]
+		id, known := s.registerIDs[name]
+		if !ok || !known || (!sqliteFullRowMode && !result.Reported[name]) {
+			continue
+		}
+		var numeric, text interface{}
+		quality := sampleQualityGood
+		switch v, q := decode.Classify(value); q {
+		case decode.QualityGood:
+			numeric = decode.Float32Decimal(value, v)
+		case decode.QualityError:
+			text, quality = fmt.Sprint(value), sampleQualityError
+		default:
+			text = fmt.Sprint(value)
+			if decode.IsNA(value) {
+				quality = sampleQualityNA
+			}
+		}
+		if _, err := stmt.ExecContext(ctx, id, ts, numeric, text, quality); err != nil {
+			return fmt.Errorf("lỗi ghi mẫu '%s': %w", name, err)
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteSink) Flush(ctx context.Context) error { return nil }
+
+func (s *sqliteSink) Close(ctx context.Context) error {
+	log.Println("Đã đóng database SQLite.")
+	return s.db.Close()
+}
+
+// --- Lệnh "query": xuất dữ liệu trong SQLite ra CSV ---
+
+// queryTimeLayouts: các định dạng thời gian chấp nhận cho -from/-to (giờ địa phương nếu không có múi giờ).
+var queryTimeLayouts = []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02"}
+
+func parseQueryTime(s string) (time.Time, error) {
+	for _, layout := range queryTimeLayouts {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("thời gian không hợp lệ '%s' (dùng dạng 2006-01-02 15:04:05 hoặc RFC3339)", s)
+}
+
+// runQueryCommand: modbus_go query -from ... -to ... [-registers Voltage_*,Frequency] [-out file.csv]
+// Mỗi dòng CSV là một thời điểm, mỗi cột là một thanh ghi (giống file log CSV).
+func runQueryCommand(args []string) error {
+	fs := flag.NewFlagSet("query", flag.ContinueOnError)
+	dbPath := fs.String("db", filepath.Join(logDir, sqliteFile), "file SQLite")
+	fromStr := fs.String("from", "", "thời điểm bắt đầu (bắt buộc)")
+	toStr := fs.String("to", "", "thời điểm kết thúc (mặc định: hiện tại)")
+	registersArg := fs.String("registers", "", "danh sách thanh ghi, cách nhau bởi dấu phẩy, hỗ trợ * (mặc định: tất cả)")
+	device := fs.String("device", deviceID, "tên thiết bị")
+	outPath := fs.String("out", "", "file CSV đầu ra (mặc định: stdout)")
+	if err := parseFlags(fs, args, 0); err != nil {
+		return err
+	}
+	if *fromStr == "" {
+		return usageErrorf("thiếu tham số -from")
+	}
+	from, err := parseQueryTime(*fromStr)
+	if err != nil {
+		return err
+	}
+	to := time.Now()
+	if *toStr != "" {
+		if to, err = parseQueryTime(*toStr); err != nil {
+			return err
+		}
+	}
+	if _, err := os.Stat(*dbPath); err != nil {
+		return fmt.Errorf("không tìm thấy database '%s': %w", *dbPath, err)
+	}
+	db, err := openSQLite(*dbPath)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	// Chọn thanh ghi theo mẫu, giữ thứ tự khai báo (theo id)
+	rows, err := db.Query(`SELECT r.id, r.name FROM registers r JOIN devices d ON d.id = r.device_id WHERE d.name = ? ORDER BY r.id`, *device)
+	if err != nil {
+		return err
+	}
+	var patterns []string
+	if *registersArg != "" {
+		for _, p := range strings.Split(*registersArg, ",") {
+			patterns = append(patterns, strings.TrimSpace(p))
+		}
+	}
+	var ids []int64
+	var names []string
+	column := make(map[int64]int)
+	for rows.Next() {
+		var id int64
+		var name string
+		if err := rows.Scan(&id, &name); err != nil {
+			rows.Close()
+			return err
+		}
+		if len(sinks.FilterNames([]string{name}, patterns)) == 0 {
+			continue
+		}
+		column[id] = len(names)
+		ids = append(ids, id)
+		names = append(names, name)
+	}
+	rows.Close()
+	if len(ids) == 0 {
+		return fmt.Errorf("không có thanh ghi nào khớp với '%s' cho thiết bị '%s'", *registersArg, *device)
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(ids)), ",")
+	queryArgs := []interface{}{from.UnixMilli(), to.UnixMilli()}
+	for _, id := range ids {
+		queryArgs = append(queryArgs, id)
+	}
+	rows, err = db.Query(`SELECT ts, register_id, value, text_value FROM samples
+		WHERE ts >= ? AND ts <= ? AND register_id IN (`+placeholders+`) ORDER BY ts`, queryArgs...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var out io.Writer = os.Stdout
+	if *outPath != "" {
+		f, err := os.Create(*outPath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+	w := csv.NewWriter(out)
+	if err := w.Write(append([]string{"Timestamp"}, names...)); err != nil {
+		return err
+	}
+	var current []string
+	var currentTS int64
+	count := 0
+	flushRow := func() error {
+		if current == nil {
+			return nil
+		}
+		count++
+		return w.Write(append([]string{time.UnixMilli(currentTS).Format("2006-01-02 15:04:05.000")}, current...))
+	}
+	for rows.Next() {
+		var ts, id int64
+		var value sql.NullFloat64
+		var text sql.NullString
+		if err := rows.Scan(&ts, &id, &value, &text); err != nil {
+			return err
+		}
+		if current == nil || ts != currentTS {
+			if err := flushRow(); err != nil {
+				return err
+			}
+			current, currentTS = make([]string, len(names)), ts
+		}
+		if value.Valid {
+			current[column[id]] = strconv.FormatFloat(value.Float64, 'f', -1, 64)
+		} else {
+			current[column[id]] = text.String
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if err := flushRow(); err != nil {
+		return err
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+	log.Printf("Đã xuất %d dòng, %d thanh ghi (%s -> %s)", count, len(names), from.Format(time.RFC3339), to.Format(time.RFC3339))
+	return nil
+}
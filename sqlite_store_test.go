@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"modbus_test/decode"
+	"modbus_test/sinks"
+)
+
+// TestSQLiteSinkStoresEveryRegister: với sqliteFullRowMode, thanh ghi không vượt deadband (không
+// được báo cáo) vẫn được lưu, để chuỗi thời gian trong database không bị thưa.
+func TestSQLiteSinkStoresEveryRegister(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	oldDir := logDir
+	logDir = t.TempDir()
+	defer func() { logDir = oldDir }()
+
+	s := &sqliteSink{}
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	defer s.Close(ctx)
+	result := sinks.CycleResult{
+		Cycle: 1, StartTime: time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC), Duration: 50 * time.Millisecond,
+		Names: []string{"AE_Delivered", "Frequency", "Meter_Model"},
+		Data: map[string]interface{}{
+			"AE_Delivered": float32(1234.5),
+			"Frequency":    float32(50.01), // Không đổi so với lần trước: không được báo cáo
+			"Meter_Model":  decode.ReadError,
+		},
+		Reported: map[string]bool{"AE_Delivered": true, "Meter_Model": true},
+	}
+	if err := s.Write(ctx, result); err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err := s.db.Query(`SELECT r.name, s.value, s.text_value, s.quality FROM samples s
+		JOIN registers r ON r.id = s.register_id ORDER BY r.name`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	got := make(map[string]string)
+	for rows.Next() {
+		var name string
+		var value sql.NullFloat64
+		var text sql.NullString
+		var quality int
+		if err := rows.Scan(&name, &value, &text, &quality); err != nil {
+			t.Fatal(err)
+		}
+		got[name] = fmt.Sprintf("%v/%q/%d", value.Float64, text.String, quality)
+	}
+	want := map[string]string{
+		"AE_Delivered": `1234.5/""/0`,
+		"Frequency":    `50.01/""/0`,
+		"Meter_Model":  `0/"` + decode.ReadError + `"/2`,
+	}
+	if len(got) != len(want) {
+		t.Errorf("samples = %v, cần %v", got, want)
+	}
+	for name, w := range want {
+		if got[name] != w {
+			t.Errorf("%s = %q, cần %q", name, got[name], w)
+		}
+	}
+}
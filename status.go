@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"modbus_test/decode"
+	"modbus_test/registermap"
+	"modbus_test/sinks"
+	"modbus_test/transport"
+)
+
+// PollerStatus là trạng thái kết nối và thống kê đọc của thiết bị.
+type PollerStatus struct {
+	Device             string     `json:"device"`
+	Port               string     `json:"port"`
+	SlaveID            int        `json:"slave_id"`
+	Connected          bool       `json:"connected"`
+	Paused             bool       `json:"paused"`
+	ConnectedSince     *time.Time `json:"connected_since,omitempty"`
+	LastConnectAttempt *time.Time `json:"last_connect_attempt,omitempty"`
+	LastConnectError   string     `json:"last_connect_error,omitempty"`
+	Reconnects         uint64     `json:"reconnects"`
+	ReadCycles         uint64     `json:"read_cycles"`
+	LastCycleAt        *time.Time `json:"last_cycle_at,omitempty"`
+	LastReadDurationMs int64      `json:"last_read_duration_ms"`
+	RegistersTotal     int        `json:"registers_total"`
+	RegistersOK        int        `json:"registers_ok"`
+	RegistersError     int        `json:"registers_error"`
+	AlarmsActive       int        `json:"alarms_active"`
+}
+
+// Reading là giá trị gần nhất của một thanh ghi.
+type Reading struct {
+	Register  string      `json:"register"`
+	Group     string      `json:"group"`
+	Unit      string      `json:"unit,omitempty"`
+	Value     interface{} `json:"value"`
+	Quality   string      `json:"quality"` // "good", "na", "error"
+	Timestamp time.Time   `json:"timestamp"`
+}
+
+var (
+	statusMu       sync.Mutex
+	pollerStatus   = PollerStatus{Device: deviceID, Port: portNameSimple, SlaveID: int(slaveID)}
+	activeClient   *transport.Client
+	latestReadings = make(map[string]Reading)
+	latestRaw      = make(map[string][]byte)
+)
+
+// qualityLabel phân loại giá trị thành "good", "na" hoặc "error". Chuỗi thông thường
+// (Meter_Model, DATETIME...) được coi là "good".
+func qualityLabel(value interface{}) string {
+	switch _, quality := decode.Classify(value); quality {
+	case decode.QualityGood:
+		return "good"
+	case decode.QualityError:
+		return "error"
+	}
+	if str, isString := value.(string); isString && !decode.IsNA(str) {
+		return "good"
+	}
+	return "na"
+}
+
+// outputValue chuyển giá trị sang dạng xuất ra bên ngoài (JSON/MQTT): số thực ngắn gọn,
+// PowerFactor lấy giá trị PF, chuỗi lỗi/N/A giữ nguyên.
+func outputValue(value interface{}) interface{} {
+	if decode.IsError(value) {
+		return value
+	}
+	if v, quality := decode.Classify(value); quality == decode.QualityGood {
+		return decode.Float32Decimal(value, v)
+	}
+	return decode.Sanitize(value)
+}
+
+func newReading(name string, value interface{}, ts time.Time) Reading {
+	return Reading{
+		Register: name, Group: registerGroup(name), Unit: registermap.Unit(name),
+		Value: outputValue(value), Quality: qualityLabel(value), Timestamp: ts,
+	}
+}
+
+// recordConnect cập nhật trạng thái sau mỗi lần thử kết nối.
+func recordConnect(client *transport.Client, err error) {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+	now := time.Now()
+	pollerStatus.LastConnectAttempt = &now
+	if err != nil {
+		pollerStatus.LastConnectError = err.Error()
+		metricConnectErrors.WithLabelValues(metricsDevice).Inc()
+		return
+	}
+	if pollerStatus.ConnectedSince != nil {
+		pollerStatus.Reconnects++
+		metricReconnects.WithLabelValues(metricsDevice).Inc()
+	}
+	pollerStatus.Connected, pollerStatus.ConnectedSince, pollerStatus.LastConnectError = true, &now, ""
+	activeClient = client
+	metricConnected.WithLabelValues(metricsDevice).Set(1)
+}
+
+func recordDisconnect() {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+	pollerStatus.Connected = false
+	activeClient = nil
+	metricConnected.WithLabelValues(metricsDevice).Set(0)
+}
+
+// recordCycle lưu giá trị gần nhất và thống kê của chu kỳ vừa đọc.
+func recordCycle(result sinks.CycleResult) {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+	ts := result.StartTime
+	pollerStatus.ReadCycles = result.Cycle
+	pollerStatus.LastCycleAt = &ts
+	pollerStatus.LastReadDurationMs = result.Duration.Milliseconds()
+	pollerStatus.RegistersTotal = result.RegistersTotal
+	pollerStatus.RegistersOK = result.RegistersOK
+	pollerStatus.RegistersError = result.RegistersError
+	pollerStatus.AlarmsActive = result.AlarmsActive
+	for _, name := range result.Names {
+		if value, ok := result.Data[name]; ok {
+			latestReadings[name] = newReading(name, value, ts)
+		}
+	}
+}
+
+func recordReading(reading Reading) {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+	latestReadings[reading.Register] = reading
+}
+
+// recordRaw lưu bytes thô gần nhất đọc được của thanh ghi (cho chế độ xem hex).
+func recordRaw(name string, raw []byte) {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+	latestRaw[name] = append(latestRaw[name][:0], raw...)
+}
+
+func latestRawHex(name string) (string, bool) {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+	raw, ok := latestRaw[name]
+	return fmt.Sprintf("%x", raw), ok
+}
+
+// setPollingPaused tạm dừng/tiếp tục vòng lặp đọc thiết bị.
+func setPollingPaused(paused bool) {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+	pollerStatus.Paused = paused
+}
+
+func pollingPaused() bool {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+	return pollerStatus.Paused
+}
+
+func currentStatus() PollerStatus {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+	return pollerStatus
+}
+
+func currentClient() *transport.Client {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+	return activeClient
+}
+
+// latestReading trả về giá trị gần nhất của thanh ghi (false nếu chưa đọc lần nào).
+func latestReading(name string) (Reading, bool) {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+	reading, ok := latestReadings[name]
+	return reading, ok
+}
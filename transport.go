@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"modbus_test/transport"
+)
+
+// transportConfig trả về cấu hình kết nối hiện tại (transportType, cổng, slaveID...).
+func transportConfig() transport.Config {
+	return transport.Config{
+		Type: transportType, Port: portNameSimple, BaudRate: baudRate, DataBits: dataBits, Parity: parity,
+		StopBits: stopBits, Address: tcpAddress, SlaveID: slaveID, Timeout: time.Duration(timeoutMs) * time.Millisecond,
+	}
+}
+
+// faultSpec gài lỗi vào đường truyền để thử khả năng chịu lỗi (tham số --faults, khóa faults trong
+// file cấu hình); rỗng: không gài lỗi.
+var faultSpec = ""
+
+// deviceConn tạo đường truyền theo cấu hình hiện tại, bọc bởi transport.FaultConn khi có faultSpec.
+// Timeout gài mặc định chờ bằng timeoutMs như handler thật.
+func deviceConn() transport.Conn {
+	cfg := transportConfig()
+	conn := transport.NewHandlerConn(transport.NewHandler(cfg))
+	if faultSpec == "" {
+		return conn
+	}
+	faults, _ := transport.ParseFaultSpec(faultSpec) // Đã kiểm tra trong Config.validate
+	if faults.TimeoutDelay == 0 {
+		faults.TimeoutDelay = cfg.Timeout
+	}
+	log.Printf("!!! Gài lỗi đường truyền: %s", faultSpec)
+	return transport.NewFaultConn(conn, faults)
+}
+
+// logFaultCounts ghi số lỗi đã gài (nếu conn là transport.FaultConn).
+func logFaultCounts(conn transport.Conn) {
+	if fc, ok := conn.(*transport.FaultConn); ok {
+		log.Printf("Số yêu cầu theo lỗi đã gài: %v", fc.Counts())
+	}
+}
+
+// portLabel là tên cổng dùng trong deviceID và log: tên cổng COM, hoặc host_port với Modbus TCP.
+func portLabel() string {
+	return transportConfig().Label()
+}
+
+func transportDescription() string {
+	return transportConfig().Describe()
+}
+
+// updateDeviceIdentity tính lại tên thiết bị sau khi cấu hình kết nối thay đổi.
+func updateDeviceIdentity() {
+	deviceID = fmt.Sprintf("%s_%d", portLabel(), slaveID)
+	metricsDevice = fmt.Sprintf("%s:%d", portLabel(), slaveID)
+	statusMu.Lock()
+	pollerStatus.Device, pollerStatus.Port, pollerStatus.SlaveID = deviceID, portLabel(), int(slaveID)
+	statusMu.Unlock()
+}
@@ -0,0 +1,337 @@
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/goburrow/modbus"
+)
+
+// FaultKind là loại lỗi FaultConn gài vào một yêu cầu.
+type FaultKind string
+
+const (
+	FaultNone       FaultKind = "ok"         // Chuyển yêu cầu tới đường truyền như bình thường
+	FaultTimeout    FaultKind = "timeout"    // Không gửi yêu cầu, chờ TimeoutDelay rồi trả về ErrInjectedTimeout
+	FaultCRC        FaultKind = "crc"        // Gửi yêu cầu nhưng bỏ phản hồi, trả về ErrInjectedCRC
+	FaultShort      FaultKind = "short"      // Phản hồi bị cắt còn một phần ngẫu nhiên (thiếu byte)
+	FaultDelay      FaultKind = "delay"      // Chờ Delay rồi mới gửi yêu cầu
+	FaultException  FaultKind = "exception"  // Trả về *modbus.ModbusError với mã ngẫu nhiên trong ExceptionCodes
+	FaultDisconnect FaultKind = "disconnect" // Đóng đường truyền; mọi yêu cầu lỗi ErrInjectedDisconnect cho tới khi Connect lại
+)
+
+// faultKinds là các loại lỗi theo thứ tự bốc thăm xác suất.
+var faultKinds = []FaultKind{FaultTimeout, FaultCRC, FaultShort, FaultDelay, FaultException, FaultDisconnect}
+
+// Giá trị mặc định của FaultConfig khi để trống: thời gian chờ của FaultDelay và các mã exception
+// thiết bị/gateway hay trả về khi bận hoặc lỗi.
+const DefaultFaultDelay = 500 * time.Millisecond
+
+var DefaultFaultExceptions = []byte{
+	modbus.ExceptionCodeServerDeviceFailure,
+	modbus.ExceptionCodeServerDeviceBusy,
+	modbus.ExceptionCodeGatewayTargetDeviceFailedToRespond,
+}
+
+// Lỗi FaultConn trả về thay cho lỗi của đường truyền thật.
+var (
+	ErrInjectedCRC        = errors.New("modbus: response crc does not match (lỗi gài)")
+	ErrInjectedDisconnect = errors.New("mất kết nối tới thiết bị (lỗi gài)")
+)
+
+// ErrInjectedTimeout giống lỗi hết thời gian chờ của handler thật (os.IsTimeout trả về true).
+var ErrInjectedTimeout error = injectedTimeout{}
+
+type injectedTimeout struct{}
+
+func (injectedTimeout) Error() string   { return "modbus: i/o timeout (lỗi gài)" }
+func (injectedTimeout) Timeout() bool   { return true }
+func (injectedTimeout) Temporary() bool { return true }
+
+// FaultConfig là cấu hình gài lỗi của FaultConn.
+type FaultConfig struct {
+	Rates          map[FaultKind]float64 // Xác suất mỗi loại lỗi cho một yêu cầu (tổng ≤ 1)
+	Script         []FaultKind           // Lỗi cho các yêu cầu đầu tiên, theo thứ tự; hết Script thì dùng Rates
+	Loop           bool                  // Lặp lại Script thay vì chuyển sang Rates
+	Delay          time.Duration         // Thời gian chờ của FaultDelay (0: DefaultFaultDelay)
+	TimeoutDelay   time.Duration         // Thời gian chờ trước khi trả về timeout (0: trả về ngay)
+	ExceptionCodes []byte                // Mã exception của FaultException (trống: DefaultFaultExceptions)
+	Seed           int64                 // Seed bốc thăm, cùng seed cho cùng chuỗi lỗi (0: theo thời gian)
+}
+
+// Validate kiểm tra loại lỗi và xác suất.
+func (cfg FaultConfig) Validate() error {
+	total := 0.0
+	for kind, rate := range cfg.Rates {
+		if !knownFault(kind) || kind == FaultNone {
+			return fmt.Errorf("loại lỗi '%s' không hỗ trợ", kind)
+		}
+		if rate < 0 || rate > 1 {
+			return fmt.Errorf("xác suất %s phải trong khoảng 0..1, nhận %v", kind, rate)
+		}
+		total += rate
+	}
+	if total > 1 {
+		return fmt.Errorf("tổng xác suất các loại lỗi là %v, không được lớn hơn 1", total)
+	}
+	for _, kind := range cfg.Script {
+		if !knownFault(kind) {
+			return fmt.Errorf("loại lỗi '%s' trong script không hỗ trợ", kind)
+		}
+	}
+	if cfg.Loop && len(cfg.Script) == 0 {
+		return errors.New("loop cần script")
+	}
+	for _, code := range cfg.ExceptionCodes {
+		if code == 0 || code >= 0x80 {
+			return fmt.Errorf("mã exception %d không hợp lệ", code)
+		}
+	}
+	return nil
+}
+
+func knownFault(kind FaultKind) bool {
+	if kind == FaultNone {
+		return true
+	}
+	for _, k := range faultKinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseFaultSpec đọc cấu hình gài lỗi dạng "khóa=giá trị" cách nhau bởi dấu phẩy (tham số
+// --faults), ví dụ "timeout=0.05,exception=0.02,delay=0.1,delay-time=300ms,seed=42". Các khóa:
+//
+//	timeout, crc, short, delay, exception, disconnect  xác suất (0..1) của từng loại lỗi
+//	delay-time, timeout-time                           Delay và TimeoutDelay (300ms, 1s)
+//	codes                                              mã exception, cách nhau bởi dấu +, ví dụ 4+6
+//	seed                                               seed bốc thăm
+//	script                                             chuỗi lỗi cách nhau bởi dấu +, "loại*n" lặp n lần,
+//	                                                   ví dụ ok*5+timeout+disconnect
+//	loop                                               lặp lại script
+func ParseFaultSpec(spec string) (FaultConfig, error) {
+	cfg := FaultConfig{Rates: make(map[FaultKind]float64)}
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if item == "loop" {
+			cfg.Loop = true
+			continue
+		}
+		key, value, ok := strings.Cut(item, "=")
+		if !ok {
+			return cfg, fmt.Errorf("'%s' không có dạng khóa=giá trị", item)
+		}
+		key, value = strings.ToLower(strings.TrimSpace(key)), strings.TrimSpace(value)
+		var err error
+		switch key {
+		case "delay-time":
+			cfg.Delay, err = parseFaultDuration(value)
+		case "timeout-time":
+			cfg.TimeoutDelay, err = parseFaultDuration(value)
+		case "seed":
+			cfg.Seed, err = strconv.ParseInt(value, 10, 64)
+		case "codes":
+			cfg.ExceptionCodes, err = parseFaultCodes(value)
+		case "script":
+			cfg.Script, err = parseFaultScript(value)
+		default:
+			kind := FaultKind(key)
+			if !knownFault(kind) || kind == FaultNone {
+				return cfg, fmt.Errorf("khóa '%s' không hỗ trợ", key)
+			}
+			cfg.Rates[kind], err = strconv.ParseFloat(value, 64)
+		}
+		if err != nil {
+			return cfg, fmt.Errorf("giá trị '%s' của %s không hợp lệ: %w", value, key, err)
+		}
+	}
+	return cfg, cfg.Validate()
+}
+
+func parseFaultDuration(value string) (time.Duration, error) {
+	d, err := time.ParseDuration(value)
+	if err == nil && d < 0 {
+		err = errors.New("thời gian âm")
+	}
+	return d, err
+}
+
+func parseFaultCodes(value string) ([]byte, error) {
+	var codes []byte
+	for _, s := range strings.Split(value, "+") {
+		code, err := strconv.ParseUint(strings.TrimSpace(s), 0, 8)
+		if err != nil {
+			return nil, err
+		}
+		codes = append(codes, byte(code))
+	}
+	return codes, nil
+}
+
+// maxScriptRepeat giới hạn n trong "loại*n" của script.
+const maxScriptRepeat = 100000
+
+func parseFaultScript(value string) ([]FaultKind, error) {
+	var script []FaultKind
+	for _, s := range strings.Split(value, "+") {
+		name, count, repeated := strings.Cut(strings.TrimSpace(s), "*")
+		n := 1
+		if repeated {
+			var err error
+			if n, err = strconv.Atoi(count); err != nil || n < 1 || n > maxScriptRepeat {
+				return nil, fmt.Errorf("số lần lặp '%s' không hợp lệ", count)
+			}
+		}
+		kind := FaultKind(strings.ToLower(name))
+		if !knownFault(kind) {
+			return nil, fmt.Errorf("loại lỗi '%s' không hỗ trợ", name)
+		}
+		for i := 0; i < n; i++ {
+			script = append(script, kind)
+		}
+	}
+	return script, nil
+}
+
+// FaultConn bọc một Conn và gài lỗi vào các yêu cầu đọc/ghi theo FaultConfig, để thử khả năng
+// chịu lỗi của poller với đường truyền chập chờn (kiểm thử, hoặc tham số --faults với bộ mô phỏng).
+// Connect và Close được chuyển thẳng tới Conn bên trong.
+type FaultConn struct {
+	conn Conn
+	cfg  FaultConfig
+
+	mu     sync.Mutex
+	rng    *rand.Rand
+	step   int
+	down   bool // Đã gài disconnect, chờ Connect
+	counts map[FaultKind]int
+}
+
+// NewFaultConn tạo FaultConn trên conn. cfg cần hợp lệ (FaultConfig.Validate).
+func NewFaultConn(conn Conn, cfg FaultConfig) *FaultConn {
+	if cfg.Delay <= 0 {
+		cfg.Delay = DefaultFaultDelay
+	}
+	if len(cfg.ExceptionCodes) == 0 {
+		cfg.ExceptionCodes = DefaultFaultExceptions
+	}
+	seed := cfg.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return &FaultConn{conn: conn, cfg: cfg, rng: rand.New(rand.NewSource(seed)), counts: make(map[FaultKind]int)}
+}
+
+// Counts trả về số yêu cầu đã nhận theo loại lỗi được gài (FaultNone: yêu cầu không bị gài lỗi).
+// Yêu cầu bị từ chối vì đang mất kết nối sau FaultDisconnect không được đếm.
+func (f *FaultConn) Counts() map[FaultKind]int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	counts := make(map[FaultKind]int, len(f.counts))
+	for kind, n := range f.counts {
+		counts[kind] = n
+	}
+	return counts
+}
+
+func (f *FaultConn) Connect() error {
+	f.mu.Lock()
+	f.down = false
+	f.mu.Unlock()
+	return f.conn.Connect()
+}
+
+func (f *FaultConn) Close() error {
+	return f.conn.Close()
+}
+
+// SetSlaveID chuyển địa chỉ slave tới Conn bên trong (nếu Conn hỗ trợ).
+func (f *FaultConn) SetSlaveID(id byte) {
+	if s, ok := f.conn.(interface{ SetSlaveID(byte) }); ok {
+		s.SetSlaveID(id)
+	}
+}
+
+// next chọn lỗi cho yêu cầu tiếp theo: theo Script, sau đó bốc thăm theo Rates.
+func (f *FaultConn) next() FaultKind {
+	if n := len(f.cfg.Script); n > 0 && (f.step < n || f.cfg.Loop) {
+		kind := f.cfg.Script[f.step%n]
+		f.step++
+		return kind
+	}
+	r := f.rng.Float64()
+	for _, kind := range faultKinds {
+		if r -= f.cfg.Rates[kind]; r < 0 {
+			return kind
+		}
+	}
+	return FaultNone
+}
+
+// do gài lỗi vào một yêu cầu với function code function; send gửi yêu cầu qua Conn bên trong.
+func (f *FaultConn) do(function byte, send func() ([]byte, error)) ([]byte, error) {
+	f.mu.Lock()
+	if f.down {
+		f.mu.Unlock()
+		return nil, ErrInjectedDisconnect
+	}
+	kind := f.next()
+	f.counts[kind]++
+	code := f.cfg.ExceptionCodes[f.rng.Intn(len(f.cfg.ExceptionCodes))]
+	cut := f.rng.Float64()
+	f.down = kind == FaultDisconnect
+	f.mu.Unlock()
+
+	switch kind {
+	case FaultTimeout:
+		time.Sleep(f.cfg.TimeoutDelay)
+		return nil, ErrInjectedTimeout
+	case FaultException:
+		return nil, &modbus.ModbusError{FunctionCode: function | 0x80, ExceptionCode: code}
+	case FaultDisconnect:
+		f.conn.Close()
+		return nil, ErrInjectedDisconnect
+	case FaultDelay:
+		time.Sleep(f.cfg.Delay)
+	}
+	resp, err := send()
+	if err != nil {
+		return resp, err
+	}
+	switch kind {
+	case FaultCRC:
+		return nil, ErrInjectedCRC
+	case FaultShort:
+		return resp[:int(cut*float64(len(resp)))], nil
+	}
+	return resp, nil
+}
+
+func (f *FaultConn) ReadHoldingRegisters(address, quantity uint16) ([]byte, error) {
+	return f.do(modbus.FuncCodeReadHoldingRegisters, func() ([]byte, error) {
+		return f.conn.ReadHoldingRegisters(address, quantity)
+	})
+}
+
+func (f *FaultConn) WriteSingleRegister(address, value uint16) ([]byte, error) {
+	return f.do(modbus.FuncCodeWriteSingleRegister, func() ([]byte, error) {
+		return f.conn.WriteSingleRegister(address, value)
+	})
+}
+
+func (f *FaultConn) WriteMultipleRegisters(address, quantity uint16, value []byte) ([]byte, error) {
+	return f.do(modbus.FuncCodeWriteMultipleRegisters, func() ([]byte, error) {
+		return f.conn.WriteMultipleRegisters(address, quantity, value)
+	})
+}
@@ -0,0 +1,182 @@
+package transport_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/goburrow/modbus"
+
+	"modbus_test/registermap"
+	"modbus_test/transport"
+	"modbus_test/transport/transporttest"
+)
+
+func TestParseFaultSpec(t *testing.T) {
+	cfg, err := transport.ParseFaultSpec("timeout=0.1, exception=0.2,delay-time=300ms,codes=4+0x0b,seed=7,script=ok*2+disconnect,loop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := transport.FaultConfig{
+		Rates:          map[transport.FaultKind]float64{transport.FaultTimeout: 0.1, transport.FaultException: 0.2},
+		Script:         []transport.FaultKind{transport.FaultNone, transport.FaultNone, transport.FaultDisconnect},
+		Loop:           true,
+		Delay:          300 * time.Millisecond,
+		ExceptionCodes: []byte{4, 11},
+		Seed:           7,
+	}
+	if !reflect.DeepEqual(cfg, want) {
+		t.Errorf("ParseFaultSpec = %+v\ncần %+v", cfg, want)
+	}
+
+	for _, spec := range []string{
+		"timeout=0.6,crc=0.6", // Tổng xác suất > 1
+		"timeout=-0.1",
+		"noise=0.1",
+		"ok=0.5",
+		"script=timeout+reboot",
+		"script=ok*0",
+		"codes=0",
+		"delay-time=-1s",
+		"loop",
+		"timeout",
+	} {
+		if _, err := transport.ParseFaultSpec(spec); err == nil {
+			t.Errorf("ParseFaultSpec(%q) không báo lỗi", spec)
+		}
+	}
+	if cfg, err := transport.ParseFaultSpec(""); err != nil || len(cfg.Rates) != 0 || cfg.Script != nil {
+		t.Errorf("ParseFaultSpec(\"\") = %+v, %v; cần cấu hình không gài lỗi", cfg, err)
+	}
+}
+
+// newFaultClient tạo client trên thiết bị giả có thanh ghi 0..1 (addressBase 0), bọc bởi FaultConn.
+func newFaultClient(t *testing.T, cfg transport.FaultConfig) (*transport.Client, *transport.FaultConn, *transporttest.Device) {
+	t.Helper()
+	dev := transporttest.New()
+	dev.Set(0, []byte{0x12, 0x34, 0x56, 0x78})
+	fc := transport.NewFaultConn(dev, cfg)
+	client := transport.NewClientConn(fc, 0)
+	if err := client.Connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return client, fc, dev
+}
+
+var faultRegister = registermap.Register{Name: "R", Address: 0, Type: "INT32U", Length: 2}
+
+func TestFaultConnScript(t *testing.T) {
+	cfg := transport.FaultConfig{
+		Script: []transport.FaultKind{
+			transport.FaultNone, transport.FaultTimeout, transport.FaultCRC, transport.FaultShort,
+			transport.FaultException, transport.FaultDelay, transport.FaultDisconnect,
+		},
+		Delay:          10 * time.Millisecond,
+		ExceptionCodes: []byte{modbus.ExceptionCodeServerDeviceBusy},
+	}
+	client, fc, dev := newFaultClient(t, cfg)
+	ctx := context.Background()
+	read := func() ([]byte, error) { return client.ReadRaw(ctx, faultRegister) }
+
+	if data, err := read(); err != nil || string(data) != "\x12\x34\x56\x78" {
+		t.Errorf("ok: %x, %v", data, err)
+	}
+	if _, err := read(); !errors.Is(err, transport.ErrInjectedTimeout) || !os.IsTimeout(err) {
+		t.Errorf("timeout: %v, cần lỗi timeout", err)
+	}
+	requests := dev.Requests()
+	if _, err := read(); !errors.Is(err, transport.ErrInjectedCRC) {
+		t.Errorf("crc: %v", err)
+	}
+	if dev.Requests() != requests+1 {
+		t.Error("crc: yêu cầu phải tới thiết bị, chỉ phản hồi bị bỏ")
+	}
+	if data, err := read(); !errors.Is(err, transport.ErrLengthMismatch) || len(data) >= 4 {
+		t.Errorf("short: %x, %v; cần phản hồi thiếu byte", data, err)
+	}
+	var mbErr *modbus.ModbusError
+	if _, err := read(); !errors.As(err, &mbErr) || mbErr.ExceptionCode != modbus.ExceptionCodeServerDeviceBusy ||
+		mbErr.FunctionCode != modbus.FuncCodeReadHoldingRegisters|0x80 {
+		t.Errorf("exception: %v", err)
+	}
+	start := time.Now()
+	if _, err := read(); err != nil || time.Since(start) < cfg.Delay {
+		t.Errorf("delay: %v sau %v, cần thành công sau ít nhất %v", err, time.Since(start), cfg.Delay)
+	}
+
+	// Mất kết nối: mọi yêu cầu lỗi cho tới khi Connect lại
+	for i := 0; i < 3; i++ {
+		if _, err := read(); !errors.Is(err, transport.ErrInjectedDisconnect) {
+			t.Errorf("disconnect, yêu cầu %d: %v", i+1, err)
+		}
+	}
+	if err := client.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// Hết script, Rates trống: không gài lỗi
+	if data, err := read(); err != nil || len(data) != 4 {
+		t.Errorf("sau khi kết nối lại: %x, %v", data, err)
+	}
+
+	want := map[transport.FaultKind]int{
+		transport.FaultNone: 2, transport.FaultTimeout: 1, transport.FaultCRC: 1, transport.FaultShort: 1,
+		transport.FaultException: 1, transport.FaultDelay: 1, transport.FaultDisconnect: 1,
+	}
+	if got := fc.Counts(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Counts = %v, cần %v", got, want)
+	}
+}
+
+func TestFaultConnWrite(t *testing.T) {
+	cfg := transport.FaultConfig{Script: []transport.FaultKind{transport.FaultException, transport.FaultCRC}, Loop: true}
+	client, _, dev := newFaultClient(t, cfg)
+	ctx := context.Background()
+	reg := registermap.Register{Address: 0, Length: 1}
+	var mbErr *modbus.ModbusError
+	if err := client.WriteRaw(ctx, reg, []byte{0, 1}); !errors.As(err, &mbErr) || mbErr.FunctionCode != modbus.FuncCodeWriteSingleRegister|0x80 {
+		t.Errorf("exception khi ghi: %v", err)
+	}
+	if got := dev.Registers(0, 1); string(got) != "\x12\x34" {
+		t.Errorf("exception gài: thanh ghi bị ghi thành %x", got)
+	}
+	if err := client.WriteRaw(ctx, reg, []byte{0, 1}); !errors.Is(err, transport.ErrInjectedCRC) {
+		t.Errorf("crc khi ghi: %v", err)
+	}
+	if got := dev.Registers(0, 1); string(got) != "\x00\x01" {
+		t.Errorf("crc gài: thiết bị vẫn phải nhận lệnh ghi, thanh ghi = %x", got)
+	}
+	// Loop: script lặp lại
+	if err := client.WriteRaw(ctx, reg, []byte{0, 2}); !errors.As(err, &mbErr) {
+		t.Errorf("script lặp lại: %v, cần exception", err)
+	}
+}
+
+func TestFaultConnRates(t *testing.T) {
+	cfg := transport.FaultConfig{
+		Rates: map[transport.FaultKind]float64{transport.FaultTimeout: 0.2, transport.FaultException: 0.3},
+		Seed:  42,
+	}
+	const n = 2000
+	run := func() map[transport.FaultKind]int {
+		client, fc, _ := newFaultClient(t, cfg)
+		for i := 0; i < n; i++ {
+			client.ReadRaw(context.Background(), faultRegister)
+		}
+		return fc.Counts()
+	}
+	counts := run()
+	for kind, rate := range map[transport.FaultKind]float64{transport.FaultNone: 0.5, transport.FaultTimeout: 0.2, transport.FaultException: 0.3} {
+		if got := float64(counts[kind]) / n; got < rate-0.05 || got > rate+0.05 {
+			t.Errorf("tỉ lệ %s = %.3f, cần khoảng %.2f", kind, got, rate)
+		}
+	}
+	if len(counts) != 3 {
+		t.Errorf("Counts = %v, chỉ được có ok, timeout và exception", counts)
+	}
+	if again := run(); !reflect.DeepEqual(again, counts) {
+		t.Errorf("cùng seed cho kết quả khác: %v và %v", counts, again)
+	}
+}
@@ -0,0 +1,259 @@
+// Package transport mở kết nối Modbus RTU (cổng COM) hoặc Modbus TCP và đọc/ghi bytes thô của
+// thanh ghi, bảo đảm mỗi thời điểm chỉ có một yêu cầu trên đường truyền.
+package transport
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/goburrow/modbus"
+
+	"modbus_test/registermap"
+)
+
+// Config là cấu hình kết nối.
+type Config struct {
+	Type     string // "rtu": Modbus RTU qua cổng COM; "tcp": Modbus TCP (gateway hoặc thiết bị Ethernet)
+	Port     string // Cổng COM (COM3, /dev/ttyUSB0) khi Type = "rtu"
+	BaudRate int
+	DataBits int
+	Parity   string // "N", "E", "O"
+	StopBits int
+	Address  string // host:port khi Type = "tcp"
+	SlaveID  byte
+	Timeout  time.Duration
+}
+
+// Handler là phần chung của RTU và TCP client handler của goburrow/modbus.
+type Handler interface {
+	modbus.ClientHandler
+	Connect() error
+	Close() error
+}
+
+// Conn là đường truyền tới thiết bị mà Client dùng: handler của goburrow/modbus (NewClient) hoặc
+// thiết bị giả khi kiểm thử (package transporttest). Địa chỉ là địa chỉ trên đường truyền (0-based).
+type Conn interface {
+	Connect() error
+	Close() error
+	ReadHoldingRegisters(address, quantity uint16) ([]byte, error)
+	WriteSingleRegister(address, value uint16) ([]byte, error)
+	WriteMultipleRegisters(address, quantity uint16, value []byte) ([]byte, error)
+}
+
+// handlerConn ghép handler với modbus.Client tạo trên handler đó.
+type handlerConn struct {
+	Handler
+	modbus.Client
+}
+
+// SetSlaveID đổi địa chỉ slave của handler RTU/TCP.
+func (h handlerConn) SetSlaveID(id byte) {
+	switch h := h.Handler.(type) {
+	case *modbus.RTUClientHandler:
+		h.SlaveId = id
+	case *modbus.TCPClientHandler:
+		h.SlaveId = id
+	}
+}
+
+// SerialPortPath trả về đường dẫn mở cổng COM. Windows cần dạng \\.\COMx (bắt buộc với COM10
+// trở lên); tên khác (ví dụ /dev/ttyUSB0 trên Linux) được giữ nguyên.
+func SerialPortPath(name string) string {
+	if strings.HasPrefix(strings.ToUpper(name), "COM") {
+		return `\\.\` + name
+	}
+	return name
+}
+
+// NewHandler tạo handler theo cấu hình (chưa kết nối).
+func NewHandler(cfg Config) Handler {
+	if cfg.Type == "tcp" {
+		handler := modbus.NewTCPClientHandler(cfg.Address)
+		handler.SlaveId = cfg.SlaveID
+		handler.Timeout = cfg.Timeout
+		return handler
+	}
+	handler := modbus.NewRTUClientHandler(SerialPortPath(cfg.Port))
+	handler.BaudRate = cfg.BaudRate
+	handler.DataBits = cfg.DataBits
+	handler.Parity = cfg.Parity
+	handler.StopBits = cfg.StopBits
+	handler.SlaveId = cfg.SlaveID
+	handler.Timeout = cfg.Timeout
+	return handler
+}
+
+// Label là tên cổng dùng trong tên thiết bị và log: tên cổng COM, hoặc host_port với Modbus TCP.
+func (cfg Config) Label() string {
+	if cfg.Type == "tcp" {
+		return strings.ReplaceAll(cfg.Address, ":", "_")
+	}
+	return cfg.Port
+}
+
+// Describe mô tả kết nối cho log, ví dụ "\\.\COM3 (19200 8N1, slave 1)".
+func (cfg Config) Describe() string {
+	if cfg.Type == "tcp" {
+		return fmt.Sprintf("tcp://%s (slave %d)", cfg.Address, cfg.SlaveID)
+	}
+	return fmt.Sprintf("%s (%d %d%s%d, slave %d)", SerialPortPath(cfg.Port), cfg.BaudRate, cfg.DataBits, cfg.Parity, cfg.StopBits, cfg.SlaveID)
+}
+
+// Lỗi của ReadRaw/WriteRaw không đến từ đường truyền.
+var (
+	ErrInvalidAddress = errors.New("địa chỉ cấu hình nhỏ hơn addressBase")
+	ErrLengthMismatch = errors.New("độ dài dữ liệu đọc không khớp")
+)
+
+// Client đọc/ghi thanh ghi qua một handler. Các yêu cầu được tuần tự hóa (vòng lặp đọc và yêu
+// cầu đọc theo lệnh từ REST API dùng chung client).
+//
+// goburrow/modbus không nhận context: khi ctx bị hủy, Connect/ReadRaw/WriteRaw trả về ngay
+// ctx.Err() còn yêu cầu đang chờ trên đường truyền chạy tiếp ở nền tới khi có phản hồi hoặc hết
+// Timeout, và giữ khóa tới lúc đó để yêu cầu sau (hoặc Close) không chen vào giữa.
+type Client struct {
+	mu          sync.Mutex
+	conn        Conn
+	addressBase int
+}
+
+// NewClient tạo client trên handler. addressBase là địa chỉ của thanh ghi đầu tiên trong bảng
+// thanh ghi (1: địa chỉ 1-based như tài liệu thiết bị, 0: địa chỉ trên đường truyền).
+func NewClient(handler Handler, addressBase int) *Client {
+	return NewClientConn(NewHandlerConn(handler), addressBase)
+}
+
+// NewHandlerConn tạo Conn trên handler RTU/TCP, ví dụ để bọc bằng NewFaultConn trước khi tạo Client.
+func NewHandlerConn(handler Handler) Conn {
+	return handlerConn{Handler: handler, Client: modbus.NewClient(handler)}
+}
+
+// NewClientConn tạo client trên một Conn bất kỳ (ví dụ thiết bị giả của transporttest).
+func NewClientConn(conn Conn, addressBase int) *Client {
+	return &Client{conn: conn, addressBase: addressBase}
+}
+
+// do chạy fn trên đường truyền khi đã giữ khóa, hoặc trả về ctx.Err() ngay khi ctx bị hủy.
+func (c *Client) do(ctx context.Context, fn func() ([]byte, error)) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	type reply struct {
+		data []byte
+		err  error
+	}
+	done := make(chan reply, 1)
+	go func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if err := ctx.Err(); err != nil {
+			done <- reply{nil, err}
+			return
+		}
+		data, err := fn()
+		done <- reply{data, err}
+	}()
+	select {
+	case r := <-done:
+		return r.data, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Connect mở kết nối (cổng COM hoặc TCP).
+func (c *Client) Connect(ctx context.Context) error {
+	_, err := c.do(ctx, func() ([]byte, error) { return nil, c.conn.Connect() })
+	return err
+}
+
+// Close đóng kết nối; lần đọc sau sẽ lỗi cho tới khi Connect lại. Close chờ yêu cầu đang chạy ở
+// nền (nếu có) kết thúc.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn.Close()
+}
+
+// SetSlaveID đổi địa chỉ slave (lệnh scan dò nhiều slave trên cùng đường truyền). Conn không có
+// phương thức SetSlaveID(byte) thì bỏ qua.
+func (c *Client) SetSlaveID(id byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if s, ok := c.conn.(interface{ SetSlaveID(byte) }); ok {
+		s.SetSlaveID(id)
+	}
+}
+
+func (c *Client) address0(regInfo registermap.Register) (uint16, error) {
+	if int(regInfo.Address) < c.addressBase {
+		return 0, fmt.Errorf("%w: %d < %d", ErrInvalidAddress, regInfo.Address, c.addressBase)
+	}
+	return regInfo.Address - uint16(c.addressBase), nil
+}
+
+// ReadRaw đọc bytes thô của một thanh ghi/cụm thanh ghi (function 03). Lỗi giao tiếp được trả
+// về nguyên dạng (*modbus.ModbusError, timeout...) để nơi gọi tự xử lý.
+func (c *Client) ReadRaw(ctx context.Context, regInfo registermap.Register) ([]byte, error) {
+	address0, err := c.address0(regInfo)
+	if err != nil {
+		return nil, err
+	}
+	readBytes, err := c.do(ctx, func() ([]byte, error) {
+		return c.conn.ReadHoldingRegisters(address0, regInfo.Length)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(readBytes) != int(regInfo.Length)*2 {
+		return readBytes, fmt.Errorf("%w: nhận %d bytes, cần %d", ErrLengthMismatch, len(readBytes), int(regInfo.Length)*2)
+	}
+	return readBytes, nil
+}
+
+// WriteRaw ghi bytes đã mã hóa vào thanh ghi: function 06 khi chỉ có một thanh ghi, function 16
+// khi nhiều thanh ghi.
+func (c *Client) WriteRaw(ctx context.Context, regInfo registermap.Register, payload []byte) error {
+	address0, err := c.address0(regInfo)
+	if err != nil {
+		return err
+	}
+	_, err = c.do(ctx, func() ([]byte, error) {
+		if len(payload) == 2 {
+			return c.conn.WriteSingleRegister(address0, binary.BigEndian.Uint16(payload))
+		}
+		return c.conn.WriteMultipleRegisters(address0, uint16(len(payload)/2), payload)
+	})
+	return err
+}
+
+// ExceptionMessage trả về tên của mã Modbus exception.
+func ExceptionMessage(code byte) string {
+	switch code {
+	case modbus.ExceptionCodeIllegalFunction:
+		return "Illegal Function"
+	case modbus.ExceptionCodeIllegalDataAddress:
+		return "Illegal Data Address"
+	case modbus.ExceptionCodeIllegalDataValue:
+		return "Illegal Data Value"
+	case modbus.ExceptionCodeServerDeviceFailure:
+		return "Server Device Failure"
+	case modbus.ExceptionCodeAcknowledge:
+		return "Acknowledge"
+	case modbus.ExceptionCodeServerDeviceBusy:
+		return "Server Device Busy"
+	case modbus.ExceptionCodeGatewayPathUnavailable:
+		return "Gateway Path Unavailable"
+	case modbus.ExceptionCodeGatewayTargetDeviceFailedToRespond:
+		return "Gateway Target Device Failed To Respond"
+	default:
+		return "Unknown Exception Code (" + strconv.Itoa(int(code)) + ")"
+	}
+}
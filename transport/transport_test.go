@@ -0,0 +1,87 @@
+package transport_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/goburrow/modbus"
+
+	"modbus_test/registermap"
+	"modbus_test/transport"
+	"modbus_test/transport/transporttest"
+)
+
+func TestClientReadWrite(t *testing.T) {
+	dev := transporttest.New()
+	dev.Set(99, []byte{0x12, 0x34, 0x56, 0x78})
+	client := transport.NewClientConn(dev, 1)
+	ctx := context.Background()
+	if err := client.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	reg := registermap.Register{Name: "R", Address: 100, Type: "INT32U", Length: 2}
+
+	data, err := client.ReadRaw(ctx, reg)
+	if err != nil || string(data) != "\x12\x34\x56\x78" {
+		t.Errorf("ReadRaw = %x, %v", data, err)
+	}
+	if err := client.WriteRaw(ctx, reg, []byte{0, 1, 0, 2}); err != nil {
+		t.Errorf("WriteRaw (function 16) lỗi: %v", err)
+	}
+	if err := client.WriteRaw(ctx, registermap.Register{Address: 101, Length: 1}, []byte{0xAB, 0xCD}); err != nil {
+		t.Errorf("WriteRaw (function 06) lỗi: %v", err)
+	}
+	if got := dev.Registers(99, 2); string(got) != "\x00\x01\xab\xcd" {
+		t.Errorf("thanh ghi sau khi ghi = %x", got)
+	}
+
+	client.SetSlaveID(7)
+	if dev.SlaveID() != 7 {
+		t.Errorf("SetSlaveID không tới thiết bị: %d", dev.SlaveID())
+	}
+}
+
+func TestClientErrors(t *testing.T) {
+	dev := transporttest.New()
+	dev.Set(9, []byte{0, 1, 0, 2})
+	client := transport.NewClientConn(dev, 1)
+	ctx := context.Background()
+	reg := registermap.Register{Name: "R", Address: 10, Type: "INT32U", Length: 2}
+
+	if _, err := client.ReadRaw(ctx, reg); !errors.Is(err, transporttest.ErrNotConnected) {
+		t.Errorf("ReadRaw trước Connect = %v", err)
+	}
+	client.Connect(ctx)
+
+	if _, err := client.ReadRaw(ctx, registermap.Register{Address: 0, Length: 1}); !errors.Is(err, transport.ErrInvalidAddress) {
+		t.Errorf("ReadRaw địa chỉ 0 với addressBase 1 = %v, cần ErrInvalidAddress", err)
+	}
+
+	dev.SetFault(9, transporttest.Fault{Short: 3})
+	if data, err := client.ReadRaw(ctx, reg); !errors.Is(err, transport.ErrLengthMismatch) || len(data) != 3 {
+		t.Errorf("ReadRaw phản hồi thiếu = %x, %v; cần 3 bytes và ErrLengthMismatch", data, err)
+	}
+
+	dev.SetFault(9, transporttest.Fault{Exception: modbus.ExceptionCodeServerDeviceBusy})
+	var mbErr *modbus.ModbusError
+	if _, err := client.ReadRaw(ctx, reg); !errors.As(err, &mbErr) || mbErr.ExceptionCode != modbus.ExceptionCodeServerDeviceBusy {
+		t.Errorf("ReadRaw exception = %v", err)
+	}
+
+	dev.SetFault(9, transporttest.Fault{Timeout: true})
+	var timeout interface{ Timeout() bool }
+	if _, err := client.ReadRaw(ctx, reg); !errors.As(err, &timeout) || !timeout.Timeout() {
+		t.Errorf("ReadRaw timeout = %v", err)
+	}
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	requests := dev.Requests()
+	if _, err := client.ReadRaw(canceled, reg); !errors.Is(err, context.Canceled) {
+		t.Errorf("ReadRaw sau khi hủy ctx = %v", err)
+	}
+	if dev.Requests() != requests {
+		t.Error("yêu cầu vẫn được gửi sau khi ctx bị hủy")
+	}
+}
@@ -0,0 +1,200 @@
+// Package transporttest cung cấp thiết bị Modbus giả (transport.Conn) để kiểm thử mà không cần
+// cổng COM hay gateway: thanh ghi lưu trong bộ nhớ, có thể gài exception, timeout hoặc phản hồi
+// thiếu byte cho từng địa chỉ.
+package transporttest
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+
+	"github.com/goburrow/modbus"
+
+	"modbus_test/transport"
+)
+
+var _ transport.Conn = (*Device)(nil)
+
+// ErrTimeout giống lỗi hết thời gian chờ của handler thật (net.Error với Timeout() = true).
+var ErrTimeout error = timeoutError{}
+
+// ErrNotConnected trả về khi đọc/ghi trước Connect hoặc sau Close.
+var ErrNotConnected = errors.New("thiết bị giả chưa kết nối")
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "modbus: i/o timeout (thiết bị giả)" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// Fault là lỗi gài cho các yêu cầu bắt đầu tại một địa chỉ.
+type Fault struct {
+	Exception byte // != 0: trả về *modbus.ModbusError với mã exception này
+	Timeout   bool // Trả về ErrTimeout
+	Short     int  // > 0: phản hồi chỉ gồm Short byte đầu tiên
+}
+
+// Device là thiết bị giả. Địa chỉ là địa chỉ trên đường truyền (0-based, đã trừ addressBase).
+// Đọc dải có thanh ghi chưa Set trả về exception Illegal Data Address như thiết bị thật.
+type Device struct {
+	mu         sync.Mutex
+	regs       map[uint16]uint16
+	faults     map[uint16]Fault
+	connectErr error
+	connected  bool
+	slaveID    byte
+	requests   int
+}
+
+// New tạo thiết bị giả không có thanh ghi nào.
+func New() *Device {
+	return &Device{regs: make(map[uint16]uint16), faults: make(map[uint16]Fault)}
+}
+
+// Set ghi bytes (Big Endian, mỗi 2 byte một thanh ghi) vào các thanh ghi bắt đầu từ address.
+// Số byte lẻ thì byte cuối được đệm 0.
+func (d *Device) Set(address uint16, data []byte) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for i := 0; i < len(data); i += 2 {
+		word := uint16(data[i]) << 8
+		if i+1 < len(data) {
+			word |= uint16(data[i+1])
+		}
+		d.regs[address+uint16(i/2)] = word
+	}
+}
+
+// Registers trả về giá trị các thanh ghi bắt đầu từ address (thanh ghi chưa Set là 0).
+func (d *Device) Registers(address, quantity uint16) []byte {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	out := make([]byte, 2*int(quantity))
+	for i := uint16(0); i < quantity; i++ {
+		binary.BigEndian.PutUint16(out[2*i:], d.regs[address+i])
+	}
+	return out
+}
+
+// SetFault gài lỗi cho các yêu cầu bắt đầu tại address; Fault{} gỡ lỗi đã gài.
+func (d *Device) SetFault(address uint16, f Fault) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if f == (Fault{}) {
+		delete(d.faults, address)
+		return
+	}
+	d.faults[address] = f
+}
+
+// SetConnectError làm Connect trả về err (nil: kết nối thành công).
+func (d *Device) SetConnectError(err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.connectErr = err
+}
+
+// Requests trả về số yêu cầu đọc/ghi đã nhận (kể cả yêu cầu bị gài lỗi).
+func (d *Device) Requests() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.requests
+}
+
+// SlaveID trả về địa chỉ slave đặt lần cuối qua transport.Client.SetSlaveID.
+func (d *Device) SlaveID() byte {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.slaveID
+}
+
+func (d *Device) Connect() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.connectErr != nil {
+		return d.connectErr
+	}
+	d.connected = true
+	return nil
+}
+
+func (d *Device) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.connected = false
+	return nil
+}
+
+func (d *Device) SetSlaveID(id byte) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.slaveID = id
+}
+
+// request kiểm tra kết nối và lỗi gài cho yêu cầu tại address. Trả về fault để cắt phản hồi.
+func (d *Device) request(function byte, address uint16) (Fault, error) {
+	d.requests++
+	if !d.connected {
+		return Fault{}, ErrNotConnected
+	}
+	f := d.faults[address]
+	switch {
+	case f.Timeout:
+		return f, ErrTimeout
+	case f.Exception != 0:
+		return f, &modbus.ModbusError{FunctionCode: function | 0x80, ExceptionCode: f.Exception}
+	}
+	return f, nil
+}
+
+func (f Fault) cut(resp []byte) []byte {
+	if f.Short > 0 && f.Short < len(resp) {
+		return resp[:f.Short]
+	}
+	return resp
+}
+
+func (d *Device) ReadHoldingRegisters(address, quantity uint16) ([]byte, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	f, err := d.request(modbus.FuncCodeReadHoldingRegisters, address)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, 2*int(quantity))
+	for i := uint16(0); i < quantity; i++ {
+		word, ok := d.regs[address+i]
+		if !ok {
+			return nil, &modbus.ModbusError{FunctionCode: modbus.FuncCodeReadHoldingRegisters | 0x80, ExceptionCode: modbus.ExceptionCodeIllegalDataAddress}
+		}
+		binary.BigEndian.PutUint16(out[2*i:], word)
+	}
+	return f.cut(out), nil
+}
+
+func (d *Device) WriteSingleRegister(address, value uint16) ([]byte, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	f, err := d.request(modbus.FuncCodeWriteSingleRegister, address)
+	if err != nil {
+		return nil, err
+	}
+	d.regs[address] = value
+	return f.cut(binary.BigEndian.AppendUint16(nil, value)), nil
+}
+
+func (d *Device) WriteMultipleRegisters(address, quantity uint16, value []byte) ([]byte, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	f, err := d.request(modbus.FuncCodeWriteMultipleRegisters, address)
+	if err != nil {
+		return nil, err
+	}
+	if len(value) != 2*int(quantity) {
+		return nil, &modbus.ModbusError{FunctionCode: modbus.FuncCodeWriteMultipleRegisters | 0x80, ExceptionCode: modbus.ExceptionCodeIllegalDataValue}
+	}
+	for i := uint16(0); i < quantity; i++ {
+		d.regs[address+i] = binary.BigEndian.Uint16(value[2*i:])
+	}
+	return f.cut(binary.BigEndian.AppendUint16(nil, quantity)), nil
+}
@@ -0,0 +1,563 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/term"
+
+	"modbus_test/decode"
+	"modbus_test/sinks"
+)
+
+// --- Cấu hình giao diện console ---
+const (
+	consoleMode        = "tui"       // "tui": giao diện toàn màn hình vẽ lại tại chỗ; "table": in bảng cuộn mỗi chu kỳ như cũ
+	tuiLogLines        = 4           // Số dòng log gần nhất hiển thị cuối màn hình
+	tuiRefreshInterval = time.Second // Vẽ lại định kỳ để cập nhật thời gian từ lần đọc cuối
+	tuiNameWidth       = 26
+	tuiValueWidth      = 16
+	tuiRangeWidth      = 11
+	tuiColumnGap       = 3
+)
+
+// Mã ANSI dùng để tô màu
+const (
+	ansiReset   = "\x1b[0m"
+	ansiBold    = "\x1b[1m"
+	ansiDim     = "\x1b[2m"
+	ansiRed     = "\x1b[31m"
+	ansiGreen   = "\x1b[32m"
+	ansiYellow  = "\x1b[33m"
+	ansiChanged = "\x1b[1;33m"
+	ansiHeader  = "\x1b[1;7m"
+)
+
+// useTUI trả về true khi dùng giao diện toàn màn hình: consoleMode = "tui" và chương trình chạy
+// trực tiếp trong terminal (không bị chuyển hướng ra file/pipe).
+func useTUI() bool {
+	return consoleMode == "tui" && term.IsTerminal(int(os.Stdin.Fd())) && term.IsTerminal(int(os.Stdout.Fd()))
+}
+
+type tuiRegister struct {
+	value    interface{}
+	changed  bool // Giá trị khác chu kỳ trước
+	min, max float64
+	hasRange bool
+}
+
+// tuiDevice là dữ liệu hiển thị của một thiết bị.
+type tuiDevice struct {
+	id        string
+	names     []string
+	registers map[string]*tuiRegister
+	cycle     uint64
+	lastAt    time.Time
+	duration  time.Duration
+	ok, bad   int
+}
+
+// tuiSegment là một đoạn chữ cùng màu trên một dòng màn hình.
+type tuiSegment struct {
+	text  string
+	color string
+}
+
+type tuiLine []tuiSegment
+
+// tuiLogWriter giữ các dòng log gần nhất để hiển thị trong giao diện thay vì in ra màn hình.
+type tuiLogWriter struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (w *tuiLogWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		w.lines = append(w.lines, strings.TrimSpace(line))
+	}
+	if len(w.lines) > tuiLogLines {
+		w.lines = w.lines[len(w.lines)-tuiLogLines:]
+	}
+	return len(p), nil
+}
+
+func (w *tuiLogWriter) recent() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]string(nil), w.lines...)
+}
+
+// --- Sink giao diện console toàn màn hình ---
+type tuiSink struct {
+	mu          sync.Mutex
+	devices     []*tuiDevice
+	current     int
+	showHex     bool
+	filter      string
+	editing     bool // Đang nhập mẫu lọc
+	input       string
+	scroll      int
+	message     string
+	logs        *tuiLogWriter
+	oldState    *term.State
+	prevLog     io.Writer
+	prevLogrus  io.Writer
+	stop        chan struct{}
+	refreshDone chan struct{}
+}
+
+func (s *tuiSink) Open() error {
+	enableVirtualTerminal()
+	oldState, err := term.MakeRaw(int(os.Stdin.Fd()))
+	if err != nil {
+		return fmt.Errorf("lỗi chuyển terminal sang chế độ raw: %w", err)
+	}
+	s.oldState = oldState
+	s.devices = []*tuiDevice{{id: deviceID, registers: make(map[string]*tuiRegister)}}
+	s.stop, s.refreshDone = make(chan struct{}), make(chan struct{})
+
+	// Log chuẩn và logrus không in ra màn hình nữa mà hiển thị ở cuối giao diện
+	s.logs = &tuiLogWriter{}
+	s.prevLog, s.prevLogrus = log.Writer(), logrus.StandardLogger().Out
+	log.SetOutput(s.logs)
+	if logFile != nil {
+		logrus.SetOutput(io.MultiWriter(s.logs, logFile))
+	} else {
+		logrus.SetOutput(s.logs)
+	}
+
+	os.Stdout.WriteString("\x1b[?1049h\x1b[?25l") // Màn hình phụ, ẩn con trỏ
+	go s.readKeys()
+	go s.refreshLoop()
+	s.render()
+	return nil
+}
+
+func (s *tuiSink) Write(ctx context.Context, result sinks.CycleResult) error {
+	s.mu.Lock()
+	dev := s.device(deviceID)
+	dev.names = result.Names
+	dev.cycle, dev.lastAt, dev.duration = result.Cycle, result.StartTime, result.Duration
+	dev.ok, dev.bad = result.RegistersOK, result.RegistersError
+	for _, name := range result.Names {
+		value := result.Data[name]
+		reg, seen := dev.registers[name]
+		if !seen {
+			reg = &tuiRegister{}
+			dev.registers[name] = reg
+		}
+		reg.changed = seen && fmt.Sprint(reg.value) != fmt.Sprint(value)
+		reg.value = value
+		if v, quality := decode.Classify(value); quality == decode.QualityGood {
+			if !reg.hasRange || v < reg.min {
+				reg.min = v
+			}
+			if !reg.hasRange || v > reg.max {
+				reg.max = v
+			}
+			reg.hasRange = true
+		}
+	}
+	s.mu.Unlock()
+	s.render()
+	return nil
+}
+
+func (s *tuiSink) Flush(ctx context.Context) error { return nil }
+
+func (s *tuiSink) Close(ctx context.Context) error {
+	close(s.stop)
+	<-s.refreshDone
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	os.Stdout.WriteString(ansiReset + "\x1b[?25h\x1b[?1049l")
+	log.SetOutput(s.prevLog)
+	logrus.SetOutput(s.prevLogrus)
+	return term.Restore(int(os.Stdin.Fd()), s.oldState)
+}
+
+// device trả về dữ liệu hiển thị của thiết bị, tạo mới nếu chưa có. Gọi khi đang giữ s.mu.
+func (s *tuiSink) device(id string) *tuiDevice {
+	for _, dev := range s.devices {
+		if dev.id == id {
+			return dev
+		}
+	}
+	dev := &tuiDevice{id: id, registers: make(map[string]*tuiRegister)}
+	s.devices = append(s.devices, dev)
+	return dev
+}
+
+func (s *tuiSink) refreshLoop() {
+	defer close(s.refreshDone)
+	ticker := time.NewTicker(tuiRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.render()
+		}
+	}
+}
+
+// readKeys đọc phím từ stdin (chế độ raw). Goroutine này kết thúc cùng chương trình.
+func (s *tuiSink) readKeys() {
+	buf := make([]byte, 64)
+	for {
+		n, err := os.Stdin.Read(buf)
+		if err != nil {
+			return
+		}
+		quit := false
+		s.mu.Lock()
+		for i := 0; i < n; i++ {
+			if buf[i] == 0x1b && i+2 < n && buf[i+1] == '[' { // Phím mũi tên, PgUp/PgDn
+				switch buf[i+2] {
+				case 'A':
+					s.scroll--
+				case 'B':
+					s.scroll++
+				case '5':
+					s.scroll -= 10
+				case '6':
+					s.scroll += 10
+				}
+				for i += 2; i < n-1 && buf[i] >= '0' && buf[i] <= '9'; i++ { // Bỏ qua tham số, dừng ở ký tự kết thúc
+				}
+				continue
+			}
+			if s.handleKey(buf[i]) {
+				quit = true
+			}
+		}
+		if s.scroll < 0 {
+			s.scroll = 0
+		}
+		s.mu.Unlock()
+		if quit {
+			requestStop(os.Interrupt) // Chế độ raw không sinh SIGINT khi nhấn Ctrl+C
+			return
+		}
+		s.render()
+	}
+}
+
+// handleKey xử lý một phím; trả về true nếu người dùng muốn thoát. Gọi khi đang giữ s.mu.
+func (s *tuiSink) handleKey(key byte) bool {
+	if s.editing {
+		switch key {
+		case '\r', '\n':
+			s.filter, s.editing, s.scroll = s.input, false, 0
+		case 0x1b:
+			s.editing = false
+		case 0x7f, 0x08:
+			if _, size := utf8.DecodeLastRuneInString(s.input); size > 0 {
+				s.input = s.input[:len(s.input)-size]
+			}
+		default:
+			if key >= 0x20 && key < 0x7f {
+				s.input += string(key)
+			}
+		}
+		return false
+	}
+	s.message = ""
+	switch key {
+	case 'q', 0x03:
+		s.message = "Đang thoát..."
+		return true
+	case 'p', ' ':
+		paused := !pollingPaused()
+		setPollingPaused(paused)
+		if paused {
+			s.message = "Đã tạm dừng đọc thiết bị (nhấn p để tiếp tục)"
+		}
+	case '/', 'f':
+		s.editing, s.input = true, s.filter
+	case 'c':
+		s.filter, s.scroll = "", 0
+	case 'x':
+		s.showHex = !s.showHex
+	case 'd':
+		if len(s.devices) < 2 {
+			s.message = "Chỉ có một thiết bị đang được đọc (" + s.devices[0].id + ")"
+		} else {
+			s.current, s.scroll = (s.current+1)%len(s.devices), 0
+		}
+	case 'r':
+		for _, reg := range s.devices[s.current].registers {
+			reg.hasRange = false
+		}
+		s.message = "Đã xóa min/max"
+	case 'j':
+		s.scroll++
+	case 'k':
+		s.scroll--
+	}
+	return false
+}
+
+// matchFilter: mẫu có ký tự glob (*, ?, [) được so khớp như filterNames, ngược lại tìm chuỗi
+// con không phân biệt hoa thường.
+func (s *tuiSink) matchFilter(names []string) []string {
+	if s.filter == "" {
+		return names
+	}
+	if strings.ContainsAny(s.filter, "*?[") {
+		return sinks.FilterNames(names, []string{s.filter})
+	}
+	var filtered []string
+	for _, name := range names {
+		if strings.Contains(strings.ToLower(name), strings.ToLower(s.filter)) {
+			filtered = append(filtered, name)
+		}
+	}
+	return filtered
+}
+
+// groupBlocks tạo khối dòng cho từng nhóm thanh ghi (tiêu đề nhóm và một dòng mỗi thanh ghi).
+func (s *tuiSink) groupBlocks(dev *tuiDevice) [][]tuiLine {
+	alarmed := make(map[string]bool)
+	for _, a := range alarmSnapshot() {
+		if a.Active {
+			alarmed[a.Register] = true
+		}
+	}
+	var blocks [][]tuiLine
+	currentGroup := ""
+	for _, name := range s.matchFilter(dev.names) {
+		reg := dev.registers[name]
+		if reg == nil {
+			continue
+		}
+		if group := registerGroup(name); group != currentGroup || len(blocks) == 0 {
+			title := fmt.Sprintf("── %s %s", group, strings.Repeat("─", tuiNameWidth+tuiValueWidth+2*tuiRangeWidth-len(group)))
+			blocks = append(blocks, []tuiLine{{{title, ansiBold}}})
+			currentGroup = group
+		}
+
+		var text string
+		if s.showHex {
+			if raw, ok := latestRawHex(name); ok {
+				text = raw
+			} else {
+				text = "-" // Thanh ghi ảo hoặc chưa đọc được
+			}
+		} else if str, isString := reg.value.(string); isString {
+			text = str // Không đặt trong ngoặc kép như bảng cuộn
+		} else {
+			_, text = formatConsoleValue(map[string]interface{}{name: reg.value}, name)
+		}
+		valueColor := ""
+		switch qualityLabel(reg.value) {
+		case "error":
+			valueColor = ansiRed
+		case "na":
+			valueColor = ansiDim
+		default:
+			if reg.changed {
+				valueColor = ansiChanged
+			}
+		}
+		nameColor := ""
+		if alarmed[name] {
+			nameColor = ansiRed + ansiBold
+		}
+		minText, maxText := "", ""
+		if reg.hasRange {
+			minText, maxText = fmt.Sprintf("%.2f", reg.min), fmt.Sprintf("%.2f", reg.max)
+		}
+		blocks[len(blocks)-1] = append(blocks[len(blocks)-1], tuiLine{
+			{pad(name, tuiNameWidth) + " ", nameColor},
+			{padLeft(text, tuiValueWidth), valueColor},
+			{" " + padLeft(minText, tuiRangeWidth) + " " + padLeft(maxText, tuiRangeWidth), ansiDim},
+		})
+	}
+	return blocks
+}
+
+// layoutColumns xếp các khối nhóm vào số cột vừa chiều rộng màn hình (khối mới vào cột thấp nhất).
+func layoutColumns(blocks [][]tuiLine, width int) []tuiLine {
+	columnWidth := tuiNameWidth + 1 + tuiValueWidth + 2 + 2*tuiRangeWidth + tuiColumnGap
+	columns := make([][]tuiLine, max(1, width/columnWidth))
+	for _, block := range blocks {
+		shortest := 0
+		for i := range columns {
+			if len(columns[i]) < len(columns[shortest]) {
+				shortest = i
+			}
+		}
+		if len(columns[shortest]) > 0 {
+			columns[shortest] = append(columns[shortest], nil) // Dòng trống giữa hai nhóm
+		}
+		columns[shortest] = append(columns[shortest], block...)
+	}
+	var lines []tuiLine
+	for row := 0; ; row++ {
+		var line tuiLine
+		more := false
+		for i, col := range columns {
+			if row >= len(col) {
+				line = append(line, tuiSegment{strings.Repeat(" ", columnWidth), ""})
+				continue
+			}
+			more = true
+			if i < len(columns)-1 {
+				line = append(line, col[row]...)
+				line = append(line, tuiSegment{strings.Repeat(" ", columnWidth-lineWidth(col[row])), ""})
+			} else {
+				line = append(line, col[row]...)
+			}
+		}
+		if !more {
+			return lines
+		}
+		lines = append(lines, line)
+	}
+}
+
+// render vẽ lại toàn bộ màn hình tại chỗ.
+func (s *tuiSink) render() {
+	width, height, err := term.GetSize(int(os.Stdout.Fd()))
+	if err != nil || width <= 0 || height <= 0 {
+		width, height = 120, 40
+	}
+	status := currentStatus()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dev := s.devices[s.current]
+
+	conn := tuiSegment{" MẤT KẾT NỐI ", ansiRed + ansiBold}
+	if status.Connected {
+		conn = tuiSegment{" ĐÃ KẾT NỐI ", ansiGreen + ansiBold}
+	}
+	age := "chưa có dữ liệu"
+	if !dev.lastAt.IsZero() {
+		age = fmt.Sprintf("%s (%.0fs trước)", dev.lastAt.Format("15:04:05"), time.Since(dev.lastAt).Seconds())
+	}
+	header := tuiLine{
+		{fmt.Sprintf(" Modbus %s  [%d/%d] ", dev.id, s.current+1, len(s.devices)), ansiHeader},
+		conn,
+		{fmt.Sprintf(" Chu kỳ %d  Cập nhật %s  Đọc %dms  OK/Lỗi %d/%d  Kết nối lại %d",
+			dev.cycle, age, dev.duration.Milliseconds(), dev.ok, dev.bad, status.Reconnects), ""},
+	}
+	if status.Paused {
+		header = append(header, tuiSegment{"  TẠM DỪNG", ansiYellow + ansiBold})
+	}
+	if s.showHex {
+		header = append(header, tuiSegment{"  HEX", ansiYellow})
+	}
+	help := tuiLine{{" q:thoát  p:tạm dừng  /:lọc  c:bỏ lọc  x:hex  d:thiết bị  r:xóa min/max  ↑↓/j/k:cuộn", ansiDim}}
+	switch {
+	case s.editing:
+		help = tuiLine{{" Lọc thanh ghi (glob hoặc chuỗi con, Enter: áp dụng, Esc: hủy): ", ansiBold}, {s.input + "_", ""}}
+	case s.message != "":
+		help = append(help, tuiSegment{"   " + s.message, ansiYellow})
+	case s.filter != "":
+		help = append(help, tuiSegment{"   Lọc: " + s.filter, ansiYellow})
+	}
+	columnHeader := tuiLine{{pad("Thanh ghi", tuiNameWidth) + " " + padLeft("Giá trị", tuiValueWidth) + " " +
+		padLeft("Min", tuiRangeWidth) + " " + padLeft("Max", tuiRangeWidth), ansiBold}}
+
+	var footer []tuiLine
+	for _, a := range alarmSnapshot() {
+		if a.Active {
+			footer = append(footer, tuiLine{{fmt.Sprintf(" [CẢNH BÁO] %-8s %s (từ %s)", a.Severity, a.ID, a.RaisedAt.Format("15:04:05")), ansiRed}})
+		}
+	}
+	for _, line := range s.logs.recent() {
+		footer = append(footer, tuiLine{{" " + line, ansiDim}})
+	}
+
+	body := layoutColumns(s.groupBlocks(dev), width)
+	bodyHeight := max(1, height-3-len(footer))
+	if s.scroll > len(body)-bodyHeight {
+		s.scroll = max(0, len(body)-bodyHeight)
+	}
+	body = body[s.scroll:]
+	if len(body) > bodyHeight {
+		body = body[:bodyHeight]
+	}
+
+	lines := []tuiLine{header, help, columnHeader}
+	lines = append(lines, body...)
+	for len(lines) < height-len(footer) {
+		lines = append(lines, nil)
+	}
+	lines = append(lines, footer...)
+	if len(lines) > height {
+		lines = lines[:height]
+	}
+
+	var b strings.Builder
+	b.WriteString("\x1b[H")
+	for i, line := range lines {
+		writeLine(&b, line, width)
+		b.WriteString("\x1b[K")
+		if i < len(lines)-1 {
+			b.WriteString("\r\n")
+		}
+	}
+	b.WriteString("\x1b[J")
+	os.Stdout.WriteString(b.String())
+}
+
+// writeLine ghi một dòng có màu, cắt bớt theo chiều rộng màn hình.
+func writeLine(b *strings.Builder, line tuiLine, width int) {
+	remaining := width
+	for _, seg := range line {
+		if remaining <= 0 {
+			break
+		}
+		text := seg.text
+		if n := utf8.RuneCountInString(text); n > remaining {
+			text = string([]rune(text)[:remaining])
+		}
+		remaining -= utf8.RuneCountInString(text)
+		if seg.color != "" {
+			b.WriteString(seg.color + text + ansiReset)
+		} else {
+			b.WriteString(text)
+		}
+	}
+}
+
+func lineWidth(line tuiLine) int {
+	n := 0
+	for _, seg := range line {
+		n += utf8.RuneCountInString(seg.text)
+	}
+	return n
+}
+
+// pad/padLeft căn chữ theo số ký tự (rune), cắt bớt nếu dài hơn độ rộng.
+func pad(s string, width int) string {
+	if n := utf8.RuneCountInString(s); n < width {
+		return s + strings.Repeat(" ", width-n)
+	} else if n > width {
+		return string([]rune(s)[:width])
+	}
+	return s
+}
+
+func padLeft(s string, width int) string {
+	if n := utf8.RuneCountInString(s); n < width {
+		return strings.Repeat(" ", width-n) + s
+	} else if n > width {
+		return string([]rune(s)[n-width:])
+	}
+	return s
+}
@@ -0,0 +1,6 @@
+//go:build !windows
+
+package main
+
+// enableVirtualTerminal: terminal trên Linux/macOS luôn hiểu mã ANSI.
+func enableVirtualTerminal() {}